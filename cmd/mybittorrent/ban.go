@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Peers are banned by IP once they sent this many corrupt pieces
+const maxCorruptPieces = 2
+
+var ErrPeerBanned = errors.New("peer banned")
+
+type BannedPeer struct {
+	Ip     string
+	Reason string
+	At     time.Time
+}
+
+// BanList keeps the IPs of peers that sent us corrupt data. Each corrupt
+// piece a peer is found guilty of is a strike, maxCorruptPieces strikes ban
+// it. Bans are kept in the file at Path, if set, between runs.
+type BanList struct {
+	Path string
+
+	mu      sync.Mutex
+	strikes map[string]int
+	banned  map[string]BannedPeer
+}
+
+func NewBanList(path string) *BanList {
+	return &BanList{
+		Path:    path,
+		strikes: make(map[string]int),
+		banned:  make(map[string]BannedPeer),
+	}
+}
+
+// Load reads the bans saved at Path, a missing file is an empty list
+func (b *BanList) Load() error {
+	data, err := os.ReadFile(b.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var banned []BannedPeer
+	err = json.Unmarshal(data, &banned)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, peer := range banned {
+		if ip := net.ParseIP(peer.Ip); ip != nil {
+			b.banned[ip.String()] = peer
+		}
+	}
+
+	return nil
+}
+
+// Save writes the bans to Path, it does nothing without one
+func (b *BanList) Save() error {
+	if b.Path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(b.Banned())
+	if err != nil {
+		return err
+	}
+
+	tmpPath := b.Path + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, b.Path)
+}
+
+// Strike counts a corrupt piece against the IP, it tells whether the IP got
+// banned for it
+func (b *BanList) Strike(ip net.IP) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := ip.String()
+	if _, ok := b.banned[key]; ok {
+		return false
+	}
+
+	b.strikes[key]++
+	if b.strikes[key] < maxCorruptPieces {
+		return false
+	}
+
+	b.banned[key] = BannedPeer{Ip: key, Reason: "sent corrupt pieces", At: time.Now()}
+
+	return true
+}
+
+func (b *BanList) Ban(ip net.IP, reason string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.banned[ip.String()] = BannedPeer{Ip: ip.String(), Reason: reason, At: time.Now()}
+}
+
+func (b *BanList) IsBanned(ip net.IP) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.banned[ip.String()]
+
+	return ok
+}
+
+// Banned returns the banned peers, oldest ban first
+func (b *BanList) Banned() []BannedPeer {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	banned := make([]BannedPeer, 0, len(b.banned))
+	for _, peer := range b.banned {
+		banned = append(banned, peer)
+	}
+
+	sort.Slice(banned, func(i, j int) bool {
+		return banned[i].At.Before(banned[j].At)
+	})
+
+	return banned
+}
@@ -2,7 +2,10 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
 	"sort"
 	"strconv"
 	"unicode"
@@ -28,12 +31,22 @@ func decodeString(reader *bufio.Reader) (string, error) {
 		return "", err
 	}
 
-	bytes, err := readBytes(reader, length)
-	if err != nil {
+	if length < 0 {
+		return "", fmt.Errorf("invalid string length %d", length)
+	}
+
+	// The length comes from the input, so the string is read as it arrives
+	// rather than allocated up front, a length past the end of the input
+	// fails without allocating it
+	var buff bytes.Buffer
+	_, err = io.CopyN(&buff, reader, int64(length))
+	if errors.Is(err, io.EOF) {
+		return "", fmt.Errorf("string of %d bytes runs past the end of the input", length)
+	} else if err != nil {
 		return "", err
 	}
 
-	return string(bytes), nil
+	return buff.String(), nil
 }
 
 func decodeInt(reader *bufio.Reader) (int, error) {
@@ -119,6 +132,11 @@ func decodeDictionary(reader *bufio.Reader) (map[string]any, error) {
 		m[key] = val
 	}
 
+	_, err = reader.Discard(1)
+	if err != nil {
+		return nil, err
+	}
+
 	return m, nil
 }
 
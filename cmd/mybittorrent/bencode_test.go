@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeBencode(t *testing.T) {
+	tests := []struct {
+		input string
+		want  any
+	}{
+		{"5:hello", "hello"},
+		{"0:", ""},
+		{"i-42e", -42},
+		{"l4:spami7ee", []any{"spam", 7}},
+		{"d1:ad1:bi1eee", map[string]any{"a": map[string]any{"b": 1}}},
+	}
+
+	for _, test := range tests {
+		got, err := decodeBencode(bufio.NewReader(strings.NewReader(test.input)))
+		if err != nil {
+			t.Errorf("decodeBencode(%q): %s", test.input, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("decodeBencode(%q) = %#v, want %#v", test.input, got, test.want)
+		}
+	}
+}
+
+func TestDecodeBencodeMalformed(t *testing.T) {
+	inputs := []string{
+		// A string length far past the end of the input used to be
+		// allocated up front and crash the process
+		"d1:t999999999999999:abce",
+		"99999999999999999999:a",
+		"-1:a",
+		"5:abc",
+		"l5:abc",
+		"d3:key",
+		"i12",
+		"x",
+	}
+
+	for _, input := range inputs {
+		_, err := decodeBencode(bufio.NewReader(strings.NewReader(input)))
+		if err == nil {
+			t.Errorf("decodeBencode(%q) succeeded, want an error", input)
+		}
+	}
+}
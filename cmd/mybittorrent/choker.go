@@ -0,0 +1,378 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultUploadSlots        = 3
+	defaultOptimisticSlots    = 1
+	chokeInterval             = 10 * time.Second
+	optimisticUnchokeInterval = 30 * time.Second
+	// A peer we want pieces from that sent nothing for this long is snubbing
+	// us and loses its regular upload slot
+	snubTimeout = time.Minute
+	// Peers connected for less than this are new, they are more likely to get
+	// the optimistic unchoke so they get something to trade quickly
+	optimisticNewPeerAge    = time.Minute
+	optimisticNewPeerWeight = 3
+)
+
+// Clock tells the choker the time, a fake clock lets its rounds run without
+// waiting for them
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+type ChokerConfig struct {
+	// Peers unchoked for their rates, defaultUploadSlots if zero
+	UploadSlots int
+	// Peers unchoked at random, defaultOptimisticSlots if zero
+	OptimisticSlots int
+	// We don't download from the peers, they are ranked by how fast they
+	// download from us instead of how fast they upload to us
+	Seeding bool
+	Clock   Clock
+}
+
+type chokerPeer struct {
+	setChoked func(choked bool) error
+
+	choked         bool
+	interested     bool
+	amInterested   bool
+	optimistic     bool
+	connectedAt    time.Time
+	lastDownloaded time.Time
+
+	// Bytes since the last round, and the rates from them
+	downloaded   int
+	uploaded     int
+	downloadRate float64
+	uploadRate   float64
+}
+
+// Choker decides which peers we upload to. Every chokeInterval the peers that
+// upload to us fastest get the upload slots, tit-for-tat, or those that
+// download from us fastest once we are seeding. Peers snubbing us don't get a
+// slot for their rate. Every optimisticUnchokeInterval an optimistic slot goes
+// to a random interested peer, new peers being more likely, so peers we
+// don't trade with yet get a chance to show their rate.
+type Choker struct {
+	Config ChokerConfig
+
+	mu             sync.Mutex
+	rand           *rand.Rand
+	peers          map[*Peer]*chokerPeer
+	lastRound      time.Time
+	lastOptimistic time.Time
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewChoker(config ChokerConfig) *Choker {
+	if config.UploadSlots == 0 {
+		config.UploadSlots = defaultUploadSlots
+	}
+
+	if config.OptimisticSlots == 0 {
+		config.OptimisticSlots = defaultOptimisticSlots
+	}
+
+	if config.Clock == nil {
+		config.Clock = systemClock{}
+	}
+
+	now := config.Clock.Now()
+
+	return &Choker{
+		Config:         config,
+		rand:           rand.New(rand.NewSource(now.UnixNano())),
+		peers:          make(map[*Peer]*chokerPeer),
+		lastRound:      now,
+		lastOptimistic: now,
+		done:           make(chan struct{}),
+	}
+}
+
+// Start runs a round every chokeInterval until Close
+func (c *Choker) Start() {
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+
+		ticker := time.NewTicker(chokeInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				c.Rechoke()
+			}
+		}
+	}()
+}
+
+func (c *Choker) Close() {
+	close(c.done)
+	c.wg.Wait()
+}
+
+// AddPeer starts choking a new peer, setChoked is called to choke and
+// unchoke it and must not call back into the choker
+func (c *Choker) AddPeer(peer *Peer, setChoked func(choked bool) error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.Config.Clock.Now()
+
+	c.peers[peer] = &chokerPeer{
+		setChoked:      setChoked,
+		choked:         true,
+		connectedAt:    now,
+		lastDownloaded: now,
+	}
+}
+
+func (c *Choker) RemovePeer(peer *Peer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.peers, peer)
+}
+
+// SetInterested records whether the peer wants to download from us. A peer
+// that gets interested while a slot is free is unchoked right away instead
+// of at the next round.
+func (c *Choker) SetInterested(peer *Peer, interested bool) {
+	c.mu.Lock()
+
+	p, ok := c.peers[peer]
+	if !ok {
+		c.mu.Unlock()
+		return
+	}
+
+	p.interested = interested
+
+	unchoke := interested && p.choked && c.unchokedCount() < c.Config.UploadSlots+c.Config.OptimisticSlots
+	if unchoke {
+		p.choked = false
+	}
+
+	c.mu.Unlock()
+
+	if unchoke {
+		p.setChoked(false)
+	}
+}
+
+// SetAmInterested records whether we want to download from the peer, only
+// then can it snub us
+func (c *Choker) SetAmInterested(peer *Peer, interested bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if p, ok := c.peers[peer]; ok {
+		if interested && !p.amInterested {
+			p.lastDownloaded = c.Config.Clock.Now()
+		}
+
+		p.amInterested = interested
+	}
+}
+
+// Downloaded counts block bytes the peer sent us
+func (c *Choker) Downloaded(peer *Peer, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if p, ok := c.peers[peer]; ok {
+		p.downloaded += n
+		p.lastDownloaded = c.Config.Clock.Now()
+	}
+}
+
+// Uploaded counts block bytes we sent the peer
+func (c *Choker) Uploaded(peer *Peer, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if p, ok := c.peers[peer]; ok {
+		p.uploaded += n
+	}
+}
+
+// IsChoked tells whether we choke the peer
+func (c *Choker) IsChoked(peer *Peer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.peers[peer]
+
+	return !ok || p.choked
+}
+
+// IsSnubbed tells whether the peer sent us nothing for snubTimeout while we
+// wanted its pieces
+func (c *Choker) IsSnubbed(peer *Peer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p, ok := c.peers[peer]
+
+	return ok && c.isSnubbed(p, c.Config.Clock.Now())
+}
+
+func (c *Choker) isSnubbed(p *chokerPeer, now time.Time) bool {
+	return !c.Config.Seeding && p.amInterested && now.Sub(p.lastDownloaded) >= snubTimeout
+}
+
+func (c *Choker) unchokedCount() int {
+	count := 0
+	for _, p := range c.peers {
+		if !p.choked {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Rechoke runs a round: it updates the rates, gives the upload slots to the
+// best peers and rotates the optimistic unchoke when it is due
+func (c *Choker) Rechoke() {
+	c.mu.Lock()
+
+	now := c.Config.Clock.Now()
+	elapsed := now.Sub(c.lastRound).Seconds()
+	c.lastRound = now
+
+	candidates := make([]*Peer, 0, len(c.peers))
+
+	for peer, p := range c.peers {
+		if elapsed > 0 {
+			p.downloadRate = averageRate(p.downloadRate, float64(p.downloaded)/elapsed)
+			p.uploadRate = averageRate(p.uploadRate, float64(p.uploaded)/elapsed)
+		}
+
+		p.downloaded = 0
+		p.uploaded = 0
+
+		if p.interested && !c.isSnubbed(p, now) {
+			candidates = append(candidates, peer)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := c.peers[candidates[i]], c.peers[candidates[j]]
+
+		if c.Config.Seeding {
+			if a.uploadRate != b.uploadRate {
+				return a.uploadRate > b.uploadRate
+			}
+		} else if a.downloadRate != b.downloadRate {
+			return a.downloadRate > b.downloadRate
+		}
+
+		// Peers that stayed longer win ties, so slots don't flap
+		return a.connectedAt.Before(b.connectedAt)
+	})
+
+	unchoked := make(map[*Peer]bool)
+	for _, peer := range candidates[:min(len(candidates), c.Config.UploadSlots)] {
+		unchoked[peer] = true
+	}
+
+	c.updateOptimistic(now, unchoked)
+
+	changed := make(map[*chokerPeer]bool)
+	for peer, p := range c.peers {
+		choked := !unchoked[peer] && !p.optimistic
+		if p.choked != choked {
+			p.choked = choked
+			changed[p] = choked
+		}
+	}
+
+	c.mu.Unlock()
+
+	for p, choked := range changed {
+		p.setChoked(choked)
+	}
+}
+
+// updateOptimistic keeps the optimistic unchokes until they are due for
+// rotation, then picks new ones among the interested peers without a
+// regular slot
+func (c *Choker) updateOptimistic(now time.Time, unchoked map[*Peer]bool) {
+	rotate := now.Sub(c.lastOptimistic) >= optimisticUnchokeInterval
+	if rotate {
+		c.lastOptimistic = now
+	}
+
+	optimisticCount := 0
+	for peer, p := range c.peers {
+		// A peer that earned a regular slot no longer needs its optimistic one
+		p.optimistic = p.optimistic && !rotate && p.interested && !unchoked[peer]
+		if p.optimistic {
+			optimisticCount++
+		}
+	}
+
+	for optimisticCount < c.Config.OptimisticSlots {
+		peer := c.pickOptimistic(now, unchoked)
+		if peer == nil {
+			return
+		}
+
+		c.peers[peer].optimistic = true
+		optimisticCount++
+	}
+}
+
+// pickOptimistic picks an interested peer without a slot at random, new
+// peers count optimisticNewPeerWeight times
+func (c *Choker) pickOptimistic(now time.Time, unchoked map[*Peer]bool) *Peer {
+	var picked *Peer
+	totalWeight := 0
+
+	for peer, p := range c.peers {
+		if !p.interested || p.optimistic || unchoked[peer] {
+			continue
+		}
+
+		weight := 1
+		if now.Sub(p.connectedAt) < optimisticNewPeerAge {
+			weight = optimisticNewPeerWeight
+		}
+
+		// Weighted reservoir sampling
+		totalWeight += weight
+		if c.rand.Intn(totalWeight) < weight {
+			picked = peer
+		}
+	}
+
+	return picked
+}
+
+func averageRate(rate float64, sample float64) float64 {
+	if rate == 0 {
+		return sample
+	}
+
+	return (rate + sample) / 2
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// testChoker runs a choker on a fake clock with count peers, the
+// returned map tells which peers setChoked last unchoked
+func testChoker(config ChokerConfig, count int) (*Choker, *fakeClock, []*Peer, map[*Peer]bool) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	config.Clock = clock
+
+	choker := NewChoker(config)
+	peers := make([]*Peer, count)
+	unchoked := make(map[*Peer]bool)
+
+	for i := range peers {
+		peer := &Peer{Addr: Addr{Ip: net.IPv4(10, 0, 0, byte(i)), Port: 6881}}
+		peers[i] = peer
+
+		choker.AddPeer(peer, func(choked bool) error {
+			unchoked[peer] = !choked
+			return nil
+		})
+
+		// Later peers connect later and lose ties
+		clock.Advance(time.Second)
+	}
+
+	return choker, clock, peers, unchoked
+}
+
+func countUnchoked(unchoked map[*Peer]bool) int {
+	count := 0
+	for _, u := range unchoked {
+		if u {
+			count++
+		}
+	}
+
+	return count
+}
+
+func TestChokerUnchokesInterestedPeersWhileSlotsAreFree(t *testing.T) {
+	choker, _, peers, unchoked := testChoker(ChokerConfig{UploadSlots: 1, OptimisticSlots: 1}, 3)
+
+	for _, peer := range peers {
+		choker.SetInterested(peer, true)
+	}
+
+	if !unchoked[peers[0]] || !unchoked[peers[1]] || unchoked[peers[2]] {
+		t.Fatalf("unchoked %v, want the first two peers", unchoked)
+	}
+
+	if choker.IsChoked(peers[0]) || !choker.IsChoked(peers[2]) {
+		t.Error("IsChoked disagrees with setChoked")
+	}
+}
+
+func TestChokerRanksPeers(t *testing.T) {
+	tests := []struct {
+		name    string
+		seeding bool
+	}{
+		{"downloading ranks by what peers send us", false},
+		{"seeding ranks by what we send peers", true},
+	}
+
+	for _, test := range tests {
+		choker, clock, peers, unchoked := testChoker(ChokerConfig{UploadSlots: 2, OptimisticSlots: 1, Seeding: test.seeding}, 5)
+
+		for _, peer := range peers {
+			choker.SetInterested(peer, true)
+		}
+
+		// The first peers send us the most, we send the most to the last ones
+		for i, peer := range peers {
+			choker.Downloaded(peer, (len(peers)-i)*1000)
+			choker.Uploaded(peer, (i+1)*1000)
+		}
+
+		clock.Advance(chokeInterval)
+		choker.Rechoke()
+
+		best := []*Peer{peers[0], peers[1]}
+		if test.seeding {
+			best = []*Peer{peers[4], peers[3]}
+		}
+
+		for _, peer := range best {
+			if !unchoked[peer] {
+				t.Errorf("%s: peer %s has no slot", test.name, peer.Addr.ToString())
+			}
+		}
+
+		// Both regular slots and the optimistic one
+		if count := countUnchoked(unchoked); count != 3 {
+			t.Errorf("%s: %d peers unchoked, want 3", test.name, count)
+		}
+	}
+}
+
+func TestChokerSnubbedPeersLoseTheirSlot(t *testing.T) {
+	choker, clock, peers, unchoked := testChoker(ChokerConfig{UploadSlots: 1, OptimisticSlots: 1}, 3)
+	fast, slow := peers[0], peers[1]
+
+	for _, peer := range peers {
+		choker.SetInterested(peer, true)
+		choker.SetAmInterested(peer, true)
+	}
+
+	choker.Downloaded(fast, 100000)
+	choker.Downloaded(slow, 1000)
+	clock.Advance(chokeInterval)
+	choker.Rechoke()
+
+	if !unchoked[fast] || choker.IsSnubbed(fast) {
+		t.Fatal("the fastest peer has no slot")
+	}
+
+	// fast goes quiet, slow keeps sending a little
+	for elapsed := time.Duration(0); elapsed < snubTimeout; elapsed += chokeInterval {
+		choker.Downloaded(slow, 1000)
+		clock.Advance(chokeInterval)
+		choker.Rechoke()
+	}
+
+	if !choker.IsSnubbed(fast) || choker.IsSnubbed(slow) {
+		t.Fatalf("snubbed: fast %v, slow %v", choker.IsSnubbed(fast), choker.IsSnubbed(slow))
+	}
+
+	// fast can only be unchoked optimistically
+	if !unchoked[slow] {
+		t.Error("the regular slot didn't go to the peer still sending")
+	}
+
+	// We don't wait for anything when seeding, nobody snubs us
+	choker.Config.Seeding = true
+	if choker.IsSnubbed(fast) {
+		t.Error("peer snubbing a seeder")
+	}
+}
+
+func TestChokerRotatesOptimisticUnchoke(t *testing.T) {
+	choker, clock, peers, unchoked := testChoker(ChokerConfig{UploadSlots: 1, OptimisticSlots: 1}, 4)
+
+	for _, peer := range peers {
+		choker.SetInterested(peer, true)
+	}
+
+	// peers[0] keeps the regular slot
+	optimisticPeers := make(map[*Peer]bool)
+
+	for round := 0; round < 60; round++ {
+		choker.Downloaded(peers[0], 100000)
+		clock.Advance(chokeInterval)
+		choker.Rechoke()
+
+		if !unchoked[peers[0]] {
+			t.Fatalf("round %d: the fastest peer lost its slot", round)
+		}
+
+		if count := countUnchoked(unchoked); count != 2 {
+			t.Fatalf("round %d: %d peers unchoked, want 2", round, count)
+		}
+
+		for _, peer := range peers[1:] {
+			if unchoked[peer] {
+				optimisticPeers[peer] = true
+			}
+		}
+	}
+
+	// The optimistic unchoke is random, in 20 rotations every peer gets one
+	if len(optimisticPeers) != 3 {
+		t.Errorf("%d peers got the optimistic unchoke, want 3", len(optimisticPeers))
+	}
+}
+
+func TestChokerUninterestedPeersStayChoked(t *testing.T) {
+	choker, clock, peers, unchoked := testChoker(ChokerConfig{}, 2)
+
+	choker.SetInterested(peers[0], true)
+	choker.SetInterested(peers[0], false)
+	choker.Downloaded(peers[1], 100000)
+
+	clock.Advance(chokeInterval)
+	choker.Rechoke()
+
+	if count := countUnchoked(unchoked); count != 0 {
+		t.Errorf("%d uninterested peers unchoked", count)
+	}
+}
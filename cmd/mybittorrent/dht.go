@@ -0,0 +1,857 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	dhtQueryTimeout    = 2 * time.Second
+	dhtLookupAlpha     = 3
+	dhtTokenRotation   = 5 * time.Minute
+	dhtPeerTTL         = 30 * time.Minute
+	dhtMaxPeerValues   = 50
+	dhtMaintenanceTick = time.Minute
+	dhtAnnounceEvery   = 15 * time.Minute
+	compactNodeSize    = 26
+	// KRPC messages stay well under the MTU, anything bigger isn't one
+	dhtMaxPacketSize = 1500
+	// Announces past these caps evict the oldest info hash or peer, nodes
+	// announcing garbage can't grow the store without limit
+	dhtMaxInfoHashes       = 2000
+	dhtMaxPeersPerInfoHash = 500
+)
+
+var DefaultDHTBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+var ErrDHTQueryTimeout = errors.New("dht query timeout")
+
+type DHTConfig struct {
+	ListenAddr     string
+	BootstrapNodes []string
+	// Node id and routing table are kept between runs when set
+	StatePath string
+	// Socket to use instead of listening on ListenAddr, so the DHT can
+	// share its port with uTP
+	Conn net.PacketConn
+}
+
+type dhtPendingQuery struct {
+	addr     string
+	response chan map[string]any
+}
+
+type DHT struct {
+	Config DHTConfig
+	Id     NodeId
+
+	conn  net.PacketConn
+	table *dhtRoutingTable
+
+	mu                  sync.Mutex
+	pending             map[string]*dhtPendingQuery
+	nextTransactionId   uint16
+	tokenSecret         []byte
+	previousTokenSecret []byte
+	peers               map[string]*dhtStoredPeers
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func NewDHT(config DHTConfig) *DHT {
+	if config.BootstrapNodes == nil {
+		config.BootstrapNodes = DefaultDHTBootstrapNodes
+	}
+
+	return &DHT{
+		Config:  config,
+		Id:      randomNodeId(),
+		pending: make(map[string]*dhtPendingQuery),
+		peers:   make(map[string]*dhtStoredPeers),
+		done:    make(chan struct{}),
+	}
+}
+
+func (d *DHT) Start() error {
+	savedNodes := make([]Addr, 0)
+
+	if d.Config.StatePath != "" {
+		var err error
+		savedNodes, err = d.loadState()
+		if err != nil {
+			return err
+		}
+	}
+
+	d.table = newDhtRoutingTable(d.Id)
+	d.tokenSecret = randomBytes(16)
+	d.previousTokenSecret = d.tokenSecret
+
+	d.conn = d.Config.Conn
+	if d.conn == nil {
+		conn, err := net.ListenPacket("udp", d.Config.ListenAddr)
+		if err != nil {
+			return err
+		}
+
+		d.conn = conn
+	}
+
+	d.wg.Add(2)
+	go func() {
+		defer d.wg.Done()
+		d.readLoop()
+	}()
+	go func() {
+		defer d.wg.Done()
+		d.maintenance()
+	}()
+
+	go d.bootstrap(savedNodes)
+
+	return nil
+}
+
+func (d *DHT) Close() error {
+	close(d.done)
+	d.conn.Close()
+	d.wg.Wait()
+
+	if d.Config.StatePath != "" {
+		return d.saveState()
+	}
+
+	return nil
+}
+
+func (d *DHT) Addr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+// AddNode makes a node known to the DHT, for example one from the torrent's
+// nodes key, by pinging it
+func (d *DHT) AddNode(hostPort string) {
+	addr, err := net.ResolveUDPAddr("udp", hostPort)
+	if err != nil {
+		return
+	}
+
+	go d.query(Addr{Ip: addr.IP, Port: uint16(addr.Port)}, "ping", map[string]any{})
+}
+
+func (d *DHT) readLoop() {
+	buf := make([]byte, 65536)
+
+	for {
+		n, from, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-d.done:
+				return
+			default:
+				continue
+			}
+		}
+
+		udpAddr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+
+		d.handlePacket(buf[:n], udpAddr)
+	}
+}
+
+func (d *DHT) handlePacket(packet []byte, from *net.UDPAddr) {
+	if len(packet) > dhtMaxPacketSize {
+		return
+	}
+
+	decoded, err := decodeBencode(bufio.NewReader(bytes.NewReader(packet)))
+	if err != nil {
+		return
+	}
+
+	msg, ok := decoded.(map[string]any)
+	if !ok {
+		return
+	}
+
+	transactionId, _ := msg["t"].(string)
+	fromAddr := Addr{Ip: from.IP, Port: uint16(from.Port)}
+
+	switch msg["y"] {
+	case "q":
+		d.handleQuery(msg, transactionId, fromAddr)
+
+	case "r", "e":
+		d.mu.Lock()
+		pending, ok := d.pending[transactionId]
+		if ok && pending.addr == fromAddr.ToString() {
+			delete(d.pending, transactionId)
+		}
+		d.mu.Unlock()
+
+		if ok && pending.addr == fromAddr.ToString() {
+			pending.response <- msg
+		}
+	}
+}
+
+func (d *DHT) send(addr Addr, msg map[string]any) error {
+	encoded, err := encodeBencode(msg)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.conn.WriteTo([]byte(encoded), &net.UDPAddr{IP: addr.Ip, Port: int(addr.Port)})
+
+	return err
+}
+
+func (d *DHT) query(addr Addr, method string, args map[string]any) (map[string]any, error) {
+	args["id"] = string(d.Id[:])
+
+	d.mu.Lock()
+	d.nextTransactionId++
+	transactionId := string([]byte{byte(d.nextTransactionId >> 8), byte(d.nextTransactionId)})
+	pending := &dhtPendingQuery{addr: addr.ToString(), response: make(chan map[string]any, 1)}
+	d.pending[transactionId] = pending
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, transactionId)
+		d.mu.Unlock()
+	}()
+
+	err := d.send(addr, map[string]any{
+		"t": transactionId,
+		"y": "q",
+		"q": method,
+		"a": args,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-d.done:
+		return nil, net.ErrClosed
+
+	case <-time.After(dhtQueryTimeout):
+		return nil, ErrDHTQueryTimeout
+
+	case msg := <-pending.response:
+		if msg["y"] == "e" {
+			return nil, fmt.Errorf("dht error response %v", msg["e"])
+		}
+
+		resp, ok := msg["r"].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("dht response without body")
+		}
+
+		id, ok := resp["id"].(string)
+		if !ok || len(id) != 20 {
+			return nil, fmt.Errorf("dht response without node id")
+		}
+
+		d.table.seen(NodeId([]byte(id)), addr)
+
+		return resp, nil
+	}
+}
+
+func (d *DHT) handleQuery(msg map[string]any, transactionId string, from Addr) {
+	args, ok := msg["a"].(map[string]any)
+	if !ok {
+		d.sendError(from, transactionId, 203, "missing arguments")
+		return
+	}
+
+	id, ok := args["id"].(string)
+	if !ok || len(id) != 20 {
+		d.sendError(from, transactionId, 203, "missing node id")
+		return
+	}
+
+	d.table.seen(NodeId([]byte(id)), from)
+
+	resp := map[string]any{"id": string(d.Id[:])}
+
+	switch msg["q"] {
+	case "ping":
+
+	case "find_node":
+		target, ok := args["target"].(string)
+		if !ok || len(target) != 20 {
+			d.sendError(from, transactionId, 203, "missing target")
+			return
+		}
+
+		resp["nodes"] = encodeCompactNodes(d.table.closest(NodeId([]byte(target)), dhtBucketSize))
+
+	case "get_peers":
+		infoHash, ok := args["info_hash"].(string)
+		if !ok || len(infoHash) != 20 {
+			d.sendError(from, transactionId, 203, "missing info_hash")
+			return
+		}
+
+		resp["token"] = d.token(from.Ip, false)
+
+		values := d.storedPeers(infoHash)
+		if len(values) > 0 {
+			resp["values"] = values
+		} else {
+			resp["nodes"] = encodeCompactNodes(d.table.closest(NodeId([]byte(infoHash)), dhtBucketSize))
+		}
+
+	case "announce_peer":
+		infoHash, ok := args["info_hash"].(string)
+		if !ok || len(infoHash) != 20 {
+			d.sendError(from, transactionId, 203, "missing info_hash")
+			return
+		}
+
+		token, _ := args["token"].(string)
+		if token != d.token(from.Ip, false) && token != d.token(from.Ip, true) {
+			d.sendError(from, transactionId, 203, "bad token")
+			return
+		}
+
+		port, _ := args["port"].(int)
+		if impliedPort, _ := args["implied_port"].(int); impliedPort == 1 {
+			port = int(from.Port)
+		}
+
+		if port <= 0 || port > 65535 {
+			d.sendError(from, transactionId, 203, "bad port")
+			return
+		}
+
+		d.storePeer(infoHash, Addr{Ip: from.Ip, Port: uint16(port)})
+
+	default:
+		d.sendError(from, transactionId, 204, "method unknown")
+		return
+	}
+
+	d.send(from, map[string]any{
+		"t": transactionId,
+		"y": "r",
+		"r": resp,
+	})
+}
+
+func (d *DHT) sendError(addr Addr, transactionId string, code int, message string) {
+	d.send(addr, map[string]any{
+		"t": transactionId,
+		"y": "e",
+		"e": []any{code, message},
+	})
+}
+
+// Tokens are bound to the querying node's IP and stay valid for one secret
+// rotation after they were handed out
+func (d *DHT) token(ip net.IP, previous bool) string {
+	d.mu.Lock()
+	secret := d.tokenSecret
+	if previous {
+		secret = d.previousTokenSecret
+	}
+	d.mu.Unlock()
+
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	hasher := sha1.New()
+	hasher.Write(secret)
+	hasher.Write(ip)
+
+	return string(hasher.Sum(nil)[:8])
+}
+
+// dhtStoredPeers are the peers announced for an info hash, by IP so a host
+// takes a single entry however many ports it announces
+type dhtStoredPeers struct {
+	peers        map[string]dhtStoredPeer
+	lastAnnounce time.Time
+}
+
+type dhtStoredPeer struct {
+	compactAddr string
+	announced   time.Time
+}
+
+func (d *DHT) storePeer(infoHash string, addr Addr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+
+	stored, ok := d.peers[infoHash]
+	if !ok {
+		if len(d.peers) >= dhtMaxInfoHashes {
+			d.evictInfoHash()
+		}
+
+		stored = &dhtStoredPeers{peers: make(map[string]dhtStoredPeer)}
+		d.peers[infoHash] = stored
+	}
+
+	ip := addr.Ip.String()
+	if _, ok := stored.peers[ip]; !ok && len(stored.peers) >= dhtMaxPeersPerInfoHash {
+		stored.evictPeer()
+	}
+
+	stored.peers[ip] = dhtStoredPeer{compactAddr: string(addr.ToBytes()), announced: now}
+	stored.lastAnnounce = now
+}
+
+// evictInfoHash drops the info hash announced least recently
+func (d *DHT) evictInfoHash() {
+	var oldest string
+	var oldestAnnounce time.Time
+
+	for infoHash, stored := range d.peers {
+		if oldestAnnounce.IsZero() || stored.lastAnnounce.Before(oldestAnnounce) {
+			oldest = infoHash
+			oldestAnnounce = stored.lastAnnounce
+		}
+	}
+
+	delete(d.peers, oldest)
+}
+
+// evictPeer drops the peer announced least recently
+func (s *dhtStoredPeers) evictPeer() {
+	var oldest string
+	var oldestAnnounce time.Time
+
+	for ip, peer := range s.peers {
+		if oldestAnnounce.IsZero() || peer.announced.Before(oldestAnnounce) {
+			oldest = ip
+			oldestAnnounce = peer.announced
+		}
+	}
+
+	delete(s.peers, oldest)
+}
+
+func (d *DHT) storedPeers(infoHash string) []any {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	values := make([]any, 0)
+
+	stored, ok := d.peers[infoHash]
+	if !ok {
+		return values
+	}
+
+	for _, peer := range stored.peers {
+		if len(values) == dhtMaxPeerValues {
+			break
+		}
+
+		values = append(values, peer.compactAddr)
+	}
+
+	return values
+}
+
+type dhtLookupResult struct {
+	Peers   []Addr
+	Closest []dhtNode
+	Tokens  map[NodeId]string
+}
+
+// lookup walks the DHT towards target, asking the closest nodes it knows for
+// even closer ones until the closest nodes found have all been queried. With
+// getPeers the nodes are also asked for peers of the target info hash.
+func (d *DHT) lookup(target NodeId, getPeers bool) dhtLookupResult {
+	result := dhtLookupResult{Tokens: make(map[NodeId]string)}
+
+	shortlist := d.table.closest(target, dhtBucketSize)
+	seen := make(map[NodeId]bool)
+	for _, node := range shortlist {
+		seen[node.Id] = true
+	}
+
+	queried := make(map[NodeId]bool)
+	responded := make([]dhtNode, 0)
+	foundPeers := make(map[string]bool)
+
+	var mu sync.Mutex
+
+	for {
+		candidates := make([]dhtNode, 0, dhtLookupAlpha)
+		for _, node := range shortlist[:min(len(shortlist), dhtBucketSize)] {
+			if !queried[node.Id] {
+				candidates = append(candidates, node)
+				queried[node.Id] = true
+			}
+
+			if len(candidates) == dhtLookupAlpha {
+				break
+			}
+		}
+
+		if len(candidates) == 0 {
+			break
+		}
+
+		failed := make(map[NodeId]bool)
+
+		var wg sync.WaitGroup
+		wg.Add(len(candidates))
+
+		for _, node := range candidates {
+			node := node
+			go func() {
+				defer wg.Done()
+
+				var resp map[string]any
+				var err error
+				if getPeers {
+					resp, err = d.query(node.Addr, "get_peers", map[string]any{"info_hash": string(target[:])})
+				} else {
+					resp, err = d.query(node.Addr, "find_node", map[string]any{"target": string(target[:])})
+				}
+
+				mu.Lock()
+				defer mu.Unlock()
+
+				if err != nil {
+					d.table.failed(node.Id)
+					failed[node.Id] = true
+					return
+				}
+
+				responded = append(responded, node)
+
+				if token, ok := resp["token"].(string); ok {
+					result.Tokens[node.Id] = token
+				}
+
+				if values, ok := resp["values"].([]any); ok {
+					for _, value := range values {
+						compactAddr, ok := value.(string)
+						if !ok || foundPeers[compactAddr] {
+							continue
+						}
+
+						addr := Addr{}
+						if addr.ReadFromBytes([]byte(compactAddr)) == nil && addr.Port != 0 {
+							foundPeers[compactAddr] = true
+							result.Peers = append(result.Peers, addr)
+						}
+					}
+				}
+
+				if nodes, ok := resp["nodes"].(string); ok {
+					for _, newNode := range decodeCompactNodes(nodes) {
+						if !seen[newNode.Id] && newNode.Id != d.Id {
+							seen[newNode.Id] = true
+							shortlist = append(shortlist, newNode)
+						}
+					}
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		remaining := make([]dhtNode, 0, len(shortlist))
+		for _, node := range shortlist {
+			if !failed[node.Id] {
+				remaining = append(remaining, node)
+			}
+		}
+
+		shortlist = remaining
+		sortByDistance(shortlist, target)
+	}
+
+	sortByDistance(responded, target)
+	result.Closest = responded[:min(len(responded), dhtBucketSize)]
+
+	return result
+}
+
+// GetPeers looks up peers for the info hash and, when port isn't zero,
+// announces us as a peer listening on port to the closest nodes.
+func (d *DHT) GetPeers(infoHash Hash, port int) []Addr {
+	target := NodeId([]byte(infoHash.Hash))
+
+	result := d.lookup(target, true)
+
+	if port > 0 {
+		for _, node := range result.Closest {
+			token, ok := result.Tokens[node.Id]
+			if !ok {
+				continue
+			}
+
+			go d.query(node.Addr, "announce_peer", map[string]any{
+				"info_hash":    infoHash.String(),
+				"port":         port,
+				"token":        token,
+				"implied_port": 0,
+			})
+		}
+	}
+
+	return result.Peers
+}
+
+func (d *DHT) bootstrap(savedNodes []Addr) {
+	var wg sync.WaitGroup
+
+	for _, addr := range savedNodes {
+		addr := addr
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.query(addr, "ping", map[string]any{})
+		}()
+	}
+
+	for _, hostPort := range d.Config.BootstrapNodes {
+		hostPort := hostPort
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			udpAddr, err := net.ResolveUDPAddr("udp4", hostPort)
+			if err != nil {
+				return
+			}
+
+			addr := Addr{Ip: udpAddr.IP, Port: uint16(udpAddr.Port)}
+			resp, err := d.query(addr, "find_node", map[string]any{"target": string(d.Id[:])})
+			if err != nil {
+				return
+			}
+
+			if nodes, ok := resp["nodes"].(string); ok {
+				for _, node := range decodeCompactNodes(nodes) {
+					d.table.seen(node.Id, node.Addr)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	d.lookup(d.Id, false)
+}
+
+func (d *DHT) maintenance() {
+	ticker := time.NewTicker(dhtMaintenanceTick)
+	defer ticker.Stop()
+
+	lastRotation := time.Now()
+	lastSave := time.Now()
+
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+		}
+
+		d.mu.Lock()
+		if time.Since(lastRotation) >= dhtTokenRotation {
+			d.previousTokenSecret = d.tokenSecret
+			d.tokenSecret = randomBytes(16)
+			lastRotation = time.Now()
+		}
+
+		for infoHash, stored := range d.peers {
+			for ip, peer := range stored.peers {
+				if time.Since(peer.announced) > dhtPeerTTL {
+					delete(stored.peers, ip)
+				}
+			}
+
+			if len(stored.peers) == 0 {
+				delete(d.peers, infoHash)
+			}
+		}
+		d.mu.Unlock()
+
+		for _, node := range d.table.questionable() {
+			node := node
+			go func() {
+				_, err := d.query(node.Addr, "ping", map[string]any{})
+				if err != nil {
+					d.table.failed(node.Id)
+				}
+			}()
+		}
+
+		if d.table.len() < dhtBucketSize {
+			go d.bootstrap(nil)
+		}
+
+		if d.Config.StatePath != "" && time.Since(lastSave) >= dhtTokenRotation {
+			err := d.saveState()
+			if err != nil {
+				fmt.Printf("DHT state save error: %s\n", err)
+			}
+			lastSave = time.Now()
+		}
+	}
+}
+
+type dhtStateNode struct {
+	Id   string
+	Addr string
+}
+
+type dhtState struct {
+	Id    string
+	Nodes []dhtStateNode
+}
+
+func (d *DHT) saveState() error {
+	state := dhtState{Id: d.Id.Hex()}
+	for _, node := range d.table.allNodes() {
+		if !node.isBad() {
+			state.Nodes = append(state.Nodes, dhtStateNode{Id: node.Id.Hex(), Addr: node.Addr.ToString()})
+		}
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := d.Config.StatePath + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, d.Config.StatePath)
+}
+
+// loadState restores our node id and returns the addresses of the nodes we
+// knew, they get pinged before being trusted again
+func (d *DHT) loadState() ([]Addr, error) {
+	data, err := os.ReadFile(d.Config.StatePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	state := dhtState{}
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := nodeIdFromHex(state.Id)
+	if err == nil {
+		d.Id = id
+	}
+
+	addrs := make([]Addr, 0, len(state.Nodes))
+	for _, node := range state.Nodes {
+		addr := Addr{}
+		if addr.ReadFromString(node.Addr) == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+
+	return addrs, nil
+}
+
+func encodeCompactNodes(nodes []dhtNode) string {
+	buf := make([]byte, 0, len(nodes)*compactNodeSize)
+	for _, node := range nodes {
+		if node.Addr.Ip.To4() == nil {
+			continue
+		}
+
+		buf = append(buf, node.Id[:]...)
+		buf = append(buf, node.Addr.ToBytes()...)
+	}
+
+	return string(buf)
+}
+
+func decodeCompactNodes(data string) []dhtNode {
+	nodes := make([]dhtNode, 0, len(data)/compactNodeSize)
+	for offset := 0; offset+compactNodeSize <= len(data); offset += compactNodeSize {
+		node := dhtNode{Id: NodeId([]byte(data[offset : offset+20]))}
+
+		err := node.Addr.ReadFromBytes([]byte(data[offset+20 : offset+compactNodeSize]))
+		if err != nil || node.Addr.Port == 0 {
+			continue
+		}
+
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+func randomBytes(n int) []byte {
+	buf := make([]byte, n)
+	rand.Read(buf)
+
+	return buf
+}
+
+// DHTPeerSource looks up the torrent's peers in the DHT. With a Port it also
+// announces us as a peer, without one the lookups are all it does and other
+// peers never find us through the DHT.
+type DHTPeerSource struct {
+	DHT      *DHT
+	InfoHash Hash
+	// Port we accept peer connections on, zero for lookups only
+	Port int
+}
+
+func (s *DHTPeerSource) Run(ctx context.Context, found chan<- DiscoveredPeer) error {
+	for {
+		for _, addr := range s.DHT.GetPeers(s.InfoHash, s.Port) {
+			if !sendDiscoveredPeer(ctx, found, DiscoveredPeer{Addr: addr, Origin: PeerOriginDHT}) {
+				return nil
+			}
+		}
+
+		// Look up again soon while the routing table is still filling up
+		wait := dhtAnnounceEvery
+		if s.DHT.table.len() < dhtBucketSize*4 {
+			wait = 10 * time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
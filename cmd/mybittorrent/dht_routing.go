@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	dhtBucketSize = 8
+	// Nodes that haven't answered for this long are questionable
+	dhtNodeGoodFor = 15 * time.Minute
+	// Nodes that failed this many queries in a row are replaced first
+	dhtNodeMaxFailures = 2
+)
+
+type NodeId [20]byte
+
+func randomNodeId() NodeId {
+	id := NodeId{}
+	rand.Read(id[:])
+
+	return id
+}
+
+func nodeIdFromHex(str string) (NodeId, error) {
+	id := NodeId{}
+
+	decoded, err := hex.DecodeString(str)
+	if err != nil {
+		return id, err
+	}
+
+	if len(decoded) != len(id) {
+		return id, fmt.Errorf("incorrect node id length %d", len(decoded))
+	}
+
+	copy(id[:], decoded)
+
+	return id, nil
+}
+
+func (id NodeId) Hex() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id NodeId) distance(other NodeId) NodeId {
+	d := NodeId{}
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+
+	return d
+}
+
+// commonPrefixLen is the number of leading bits shared by both ids
+func (id NodeId) commonPrefixLen(other NodeId) int {
+	for i := range id {
+		x := id[i] ^ other[i]
+		if x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+
+	return len(id) * 8
+}
+
+type dhtNode struct {
+	Id       NodeId
+	Addr     Addr
+	LastSeen time.Time
+	Failures int
+}
+
+func (n *dhtNode) isGood() bool {
+	return n.Failures == 0 && time.Since(n.LastSeen) < dhtNodeGoodFor
+}
+
+func (n *dhtNode) isBad() bool {
+	return n.Failures >= dhtNodeMaxFailures
+}
+
+// dhtRoutingTable keeps one bucket per length of the prefix shared with our
+// own id, which is what the classic bucket splitting converges to: buckets
+// near our id cover few ids and far ones cover most of the id space.
+type dhtRoutingTable struct {
+	mu      sync.Mutex
+	ownId   NodeId
+	buckets [161][]*dhtNode
+}
+
+func newDhtRoutingTable(ownId NodeId) *dhtRoutingTable {
+	return &dhtRoutingTable{ownId: ownId}
+}
+
+func (t *dhtRoutingTable) bucketIndex(id NodeId) int {
+	return t.ownId.commonPrefixLen(id)
+}
+
+// seen records a node that sent us a message or answered a query
+func (t *dhtRoutingTable) seen(id NodeId, addr Addr) {
+	if id == t.ownId {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	bucketIndex := t.bucketIndex(id)
+	bucket := t.buckets[bucketIndex]
+
+	for _, node := range bucket {
+		if node.Id == id {
+			node.Addr = addr
+			node.LastSeen = time.Now()
+			node.Failures = 0
+			return
+		}
+	}
+
+	newNode := &dhtNode{Id: id, Addr: addr, LastSeen: time.Now()}
+
+	if len(bucket) < dhtBucketSize {
+		t.buckets[bucketIndex] = append(bucket, newNode)
+		return
+	}
+
+	// The bucket is full, the newcomer only replaces a node that stopped
+	// answering. Long lived nodes are preferred as they are likely to stay.
+	replaceIndex := -1
+	for i, node := range bucket {
+		if node.isBad() {
+			replaceIndex = i
+			break
+		}
+
+		if !node.isGood() && replaceIndex == -1 {
+			replaceIndex = i
+		}
+	}
+
+	if replaceIndex != -1 && !bucket[replaceIndex].isGood() {
+		bucket[replaceIndex] = newNode
+	}
+}
+
+func (t *dhtRoutingTable) failed(id NodeId) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	bucketIndex := t.bucketIndex(id)
+	for _, node := range t.buckets[bucketIndex] {
+		if node.Id == id {
+			node.Failures++
+			return
+		}
+	}
+}
+
+func (t *dhtRoutingTable) closest(target NodeId, count int) []dhtNode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	nodes := make([]dhtNode, 0)
+	for _, bucket := range t.buckets {
+		for _, node := range bucket {
+			if !node.isBad() {
+				nodes = append(nodes, *node)
+			}
+		}
+	}
+
+	sortByDistance(nodes, target)
+
+	return nodes[:min(count, len(nodes))]
+}
+
+func (t *dhtRoutingTable) questionable() []dhtNode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	nodes := make([]dhtNode, 0)
+	for _, bucket := range t.buckets {
+		for _, node := range bucket {
+			if !node.isGood() {
+				nodes = append(nodes, *node)
+			}
+		}
+	}
+
+	return nodes
+}
+
+func (t *dhtRoutingTable) allNodes() []dhtNode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	nodes := make([]dhtNode, 0)
+	for _, bucket := range t.buckets {
+		for _, node := range bucket {
+			nodes = append(nodes, *node)
+		}
+	}
+
+	return nodes
+}
+
+func (t *dhtRoutingTable) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	size := 0
+	for _, bucket := range t.buckets {
+		size += len(bucket)
+	}
+
+	return size
+}
+
+func sortByDistance(nodes []dhtNode, target NodeId) {
+	sort.Slice(nodes, func(i, j int) bool {
+		di := nodes[i].Id.distance(target)
+		dj := nodes[j].Id.distance(target)
+
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// startDHTNetwork starts size nodes on loopback, all bootstrapping from the
+// first one
+func startDHTNetwork(t *testing.T, size int) []*DHT {
+	nodes := make([]*DHT, 0, size)
+
+	for i := 0; i < size; i++ {
+		config := DHTConfig{ListenAddr: "127.0.0.1:0", BootstrapNodes: []string{}}
+		if i > 0 {
+			config.BootstrapNodes = []string{nodes[0].Addr().String()}
+		}
+
+		node := NewDHT(config)
+
+		err := node.Start()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		t.Cleanup(func() { node.Close() })
+
+		nodes = append(nodes, node)
+	}
+
+	// The first node hears from every other one as they bootstrap
+	deadline := time.Now().Add(10 * time.Second)
+	for nodes[0].table.len() < size-1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("bootstrap node knows %d nodes, want %d", nodes[0].table.len(), size-1)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return nodes
+}
+
+func TestDHTAnnounceAndGetPeers(t *testing.T) {
+	nodes := startDHTNetwork(t, 12)
+
+	infoHash := Hash{Hash: randomBytes(20)}
+
+	if peers := nodes[1].GetPeers(infoHash, 0); len(peers) != 0 {
+		t.Fatalf("found %d peers before any announce", len(peers))
+	}
+
+	// Only peers that asked for a port are announced
+	nodes[2].GetPeers(infoHash, 0)
+	nodes[3].GetPeers(infoHash, 6881)
+
+	var peers []Addr
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(peers) == 0 && time.Now().Before(deadline) {
+		// announce_peer is sent in the background
+		time.Sleep(50 * time.Millisecond)
+		peers = nodes[len(nodes)-1].GetPeers(infoHash, 0)
+	}
+
+	if len(peers) != 1 || peers[0].ToString() != "127.0.0.1:6881" {
+		t.Fatalf("found peers %v, want 127.0.0.1:6881", peers)
+	}
+}
+
+func TestDHTDropsMalformedPackets(t *testing.T) {
+	d := NewDHT(DHTConfig{})
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+
+	packets := [][]byte{
+		[]byte("d1:t999999999999999:abce"),
+		[]byte("d1:y1:q1:q-5:ping"),
+		bytes.Repeat([]byte("l"), dhtMaxPacketSize+1),
+	}
+
+	// The DHT isn't started, a packet that got past decoding would crash
+	// on the missing socket
+	for _, packet := range packets {
+		d.handlePacket(packet, from)
+	}
+}
+
+func TestDHTPeerStoreCaps(t *testing.T) {
+	d := NewDHT(DHTConfig{})
+
+	// age backdates what was stored for the info hash, so it is the oldest
+	age := func(infoHash string) {
+		stored := d.peers[infoHash]
+		stored.lastAnnounce = stored.lastAnnounce.Add(-time.Minute)
+
+		for ip, peer := range stored.peers {
+			peer.announced = peer.announced.Add(-time.Minute)
+			stored.peers[ip] = peer
+		}
+	}
+
+	infoHash := string(randomBytes(20))
+
+	// A host announcing many ports takes one entry, the last port
+	for port := 1; port <= 10; port++ {
+		d.storePeer(infoHash, Addr{Ip: net.IPv4(10, 0, 0, 1), Port: uint16(port)})
+	}
+
+	last := Addr{Ip: net.IPv4(10, 0, 0, 1), Port: 10}
+
+	values := d.storedPeers(infoHash)
+	if len(values) != 1 || values[0] != string(last.ToBytes()) {
+		t.Fatalf("stored %q for one host, want its last port", values)
+	}
+
+	age(infoHash)
+
+	for i := 0; i < dhtMaxPeersPerInfoHash; i++ {
+		d.storePeer(infoHash, Addr{Ip: net.IPv4(10, 1, byte(i/256), byte(i%256)), Port: 6881})
+	}
+
+	stored := d.peers[infoHash].peers
+	if len(stored) != dhtMaxPeersPerInfoHash {
+		t.Errorf("%d peers stored, want %d", len(stored), dhtMaxPeersPerInfoHash)
+	}
+
+	if _, ok := stored[net.IPv4(10, 0, 0, 1).String()]; ok {
+		t.Error("the oldest peer wasn't evicted")
+	}
+
+	age(infoHash)
+
+	for i := 0; i < dhtMaxInfoHashes; i++ {
+		d.storePeer(string(randomBytes(20)), Addr{Ip: net.IPv4(10, 2, 0, 1), Port: 6881})
+	}
+
+	if len(d.peers) != dhtMaxInfoHashes {
+		t.Errorf("%d info hashes stored, want %d", len(d.peers), dhtMaxInfoHashes)
+	}
+
+	if _, ok := d.peers[infoHash]; ok {
+		t.Error("the oldest info hash wasn't evicted")
+	}
+}
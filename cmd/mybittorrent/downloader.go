@@ -1,93 +1,315 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
+	"net"
 	"os"
 	"sync"
-	"syscall"
+	"sync/atomic"
+	"time"
 )
 
 type Downloader struct {
-	PeerId string
+	PeerId      string
+	PeerSources []PeerSource
+	AddressBook *PeerAddressBook
+	Extensions  *ExtensionRegistry
+	// Peer exchange is disabled when nil and for private torrents
+	PEX        *PEX
+	Encryption EncryptionPolicy
+	// Peers are dialed over uTP as well as TCP when set, whichever
+	// connects first is used
+	UTP *UTPSocket
+
+	// Timeouts, the defaults are used when zero. A peer that doesn't serve
+	// a request within RequestTimeout is snubbing us, its pieces go to other
+	// peers.
+	ConnectTimeout    time.Duration
+	HandshakeTimeout  time.Duration
+	RequestTimeout    time.Duration
+	InactivityTimeout time.Duration
+
+	// Peers that sent corrupt pieces are banned by IP, Download creates an
+	// empty list when nil
+	Bans *BanList
+	// Peers in the filter's ranges are never connected, whichever source
+	// found them
+	IPFilter *IPFilter
+	// Bandwidth caps of this torrent and of all the torrents it shares the
+	// host with, every byte on the peer connections counts. Nil limits
+	// don't limit.
+	RateLimits       *RateLimits
+	GlobalRateLimits *RateLimits
+	// Peers connect to us through the listener while we download, Download
+	// registers the torrent on it. Nothing is accepted when nil.
+	Listener *PeerListener
+	// Decides which peers we upload to, Download runs one with the default
+	// slots when nil
+	Choker *Choker
+
+	// Connected peers by peer id, set by Download
+	connected *connectedPeers
+	// Serves the pieces saved so far to the peers, set by Download
+	uploads      *Seeder
+	hashFailures atomic.Int64
+}
+
+// DownloadStats tells how the download went
+type DownloadStats struct {
+	// Pieces that failed the hash check
+	HashFailures int64
+	Banned       []BannedPeer
+	// Block bytes sent to peers
+	Uploaded int64
 }
 
 var (
 	ErrPeerConnection = errors.New("peer connection error")
+	// Two seeders have nothing to trade, their connection is closed
+	ErrBothSeeders = errors.New("both peers are seeders")
+)
+
+const (
+	peerRetryInterval       = 10 * time.Second
+	utpDialTimeout          = 3 * time.Second
+	defaultConnectTimeout   = 5 * time.Second
+	defaultHandshakeTimeout = 20 * time.Second
+	// How long a peer with nothing to download waits before looking for
+	// pieces other peers gave back
+	pieceWaitInterval = time.Second
+	// download_piece gives up on a peer that didn't send the piece in time
+	pieceDownloadTimeout = time.Minute
 )
 
 func (d *Downloader) Download(metafile TorrentMetaInfo, path string) error {
+	sources := d.PeerSources
+	if len(sources) == 0 {
+		sources = []PeerSource{&TrackerPeerSource{
+			Tracker:  &Tracker{AnnounceUrl: metafile.Announce, PeerId: d.PeerId},
+			MetaInfo: metafile,
+		}}
+	}
+
+	if d.AddressBook == nil {
+		d.AddressBook = NewPeerAddressBook()
+	}
+
+	if d.Extensions == nil {
+		d.Extensions = NewExtensionRegistry()
+		d.Extensions.Version = clientVersion
+		d.Extensions.RequestQueueSize = defaultRequestQueueSize
+	}
+
+	if metafile.Info.Private != 0 {
+		d.PEX = nil
+	}
 
-	t := Tracker{
-		AnnounceUrl: metafile.Announce,
-		PeerId:      d.PeerId,
+	if d.Bans == nil {
+		d.Bans = NewBanList("")
 	}
 
-	peers, err := t.getPeers(metafile)
+	d.connected = newConnectedPeers(d.PeerId)
+
+	if d.PEX != nil {
+		d.Extensions.Register(pexExtensionName, d.PEX)
+	}
+
+	piecesCount := len(metafile.Info.Pieces)
+
+	wanted := make([]int, piecesCount)
+	for pieceIndex := range wanted {
+		wanted[pieceIndex] = pieceIndex
+	}
+
+	storage, err := openDownloadStorage(metafile, path)
 	if err != nil {
 		return err
 	}
 
-	if len(peers) == 0 {
-		return fmt.Errorf("no peers to start download")
+	defer storage.Close()
+
+	// Without extensions of its own the seeder leaves the extended
+	// handshake and messages to the download
+	d.uploads = NewSeeder(metafile, storage)
+	d.uploads.Choker = d.Choker
+
+	if d.uploads.Choker == nil {
+		d.uploads.Choker = NewChoker(ChokerConfig{})
+		d.uploads.Choker.Start()
+		defer d.uploads.Choker.Close()
 	}
 
-	pieces := make([]Piece, len(metafile.Info.Pieces))
-	for pieceIndex := range pieces {
-		pieces[pieceIndex].Index = pieceIndex
-		pieces[pieceIndex].Hash = metafile.Info.Pieces[pieceIndex]
+	picker := newPiecePicker(metafile, wanted)
+	fileSaveQueue := make(chan Piece, piecesCount)
+
+	var wg sync.WaitGroup
+	wg.Add(piecesCount)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var peersMu sync.Mutex
+	activePeers := make(map[*Peer]bool)
+
+	defer func() {
+		// Peers see the download is over before their connections go away
+		cancel()
+
+		peersMu.Lock()
+		defer peersMu.Unlock()
+
+		for peer := range activePeers {
+			peer.Disconnect()
+		}
+	}()
+
+	pieceDone := func(piece Piece) {
+		fileSaveQueue <- piece
+		wg.Done()
 	}
 
-	piecesQueue := make(chan Piece, len(pieces))
-	fileSaveQueue := make(chan Piece, len(pieces))
+	// servePeer runs the session of a peer we dial or one that connected to
+	// us
+	servePeer := func(peer *Peer) error {
+		peersMu.Lock()
+		activePeers[peer] = true
+		peersMu.Unlock()
 
-	for _, piece := range pieces {
-		piecesQueue <- piece
+		defer func() {
+			peersMu.Lock()
+			delete(activePeers, peer)
+			peersMu.Unlock()
+
+			if d.PEX != nil {
+				d.PEX.PeerDisconnected(peer)
+			}
+
+			peer.Disconnect()
+		}()
+
+		return d.downloadPieces(ctx, peer, metafile, picker, pieceDone)
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(len(pieces))
+	runPeer := func(addr Addr) {
+		if d.Bans.IsBanned(addr.Ip) {
+			d.AddressBook.Ban(addr)
+			return
+		}
+
+		peer := &Peer{
+			Addr:       addr,
+			HavePieces: NewPiecesMap(len(metafile.Info.Pieces)),
+		}
 
-	fmt.Printf("Start donwload frorm %d peers\n", len(peers))
+		if d.PEX != nil {
+			defer d.PEX.RemoveConnected(addr)
+		}
 
-	for _, peer := range peers {
-		peer := peer
-		go func() {
-			for pieceToDownload := range piecesQueue {
-				pieceToDownload.Blocks, err = d.downloadPiece(&peer, metafile, pieceToDownload.Index)
+		err := servePeer(peer)
 
-				if err != nil {
-					piecesQueue <- pieceToDownload
+		if err != nil && ctx.Err() == nil {
+			if errors.Is(err, ErrSelfConnection) || errors.Is(err, ErrPeerBanned) {
+				fmt.Printf("Banned %s: %s\n", addr.ToString(), err)
+				d.AddressBook.Ban(addr)
+				return
+			}
+
+			// The peer is still connected through another address
+			if errors.Is(err, ErrDuplicateConnection) {
+				d.AddressBook.MarkDisconnected(addr)
+				return
+			}
+
+			fmt.Printf("YEET the peer - %s: %s\n", peer.Addr.Ip, err)
+			d.AddressBook.MarkFailed(addr)
+			return // YEET the peer
+		}
+
+		d.AddressBook.MarkDisconnected(addr)
+	}
+
+	// Inbound peers are left out of the address book, we don't know which
+	// port they accept connections on
+	if d.Listener != nil {
+		d.Listener.Register(metafile.InfoHash, TorrentHandlerFunc(func(peer *Peer) {
+			if d.Bans.IsBanned(peer.Addr.Ip) {
+				return
+			}
+
+			peer.HavePieces = NewPiecesMap(piecesCount)
+			peer.Conn = limitConn(peer.Conn, d.RateLimits)
+
+			err := servePeer(peer)
+			if err != nil && ctx.Err() == nil && !errors.Is(err, ErrDuplicateConnection) {
+				fmt.Printf("Inbound peer %s dropped: %s\n", peer.Addr.ToString(), err)
+			}
+		}))
+
+		defer d.Listener.Unregister(metafile.InfoHash)
+	}
+
+	discovered := discoverPeers(ctx, sources)
+	noPeers := make(chan struct{})
+
+	// PEX only hears of peers from the connected ones, it isn't a source
+	// still looking once the others ran out
+	var exchanged <-chan DiscoveredPeer
+	if d.PEX != nil {
+		exchanged = discoverPeers(ctx, []PeerSource{&PEXPeerSource{PEX: d.PEX}})
+	}
+
+	addPeer := func(discoveredPeer DiscoveredPeer) {
+		if d.IPFilter.Blocks(discoveredPeer.Addr.Ip) {
+			return
+		}
 
-					if errors.Is(err, ErrPeerConnection) {
-						fmt.Printf("YEET the peer - %s \n", peer.Addr.Ip)
-						return // YEET the peer
-					} else if errors.Is(err, syscall.EPIPE) {
-						peer.Disconnect()
+		if d.AddressBook.Add(discoveredPeer) {
+			fmt.Printf("Discovered peer %s from %s\n", discoveredPeer.Addr.ToString(), discoveredPeer.Origin)
+		}
+
+		if d.AddressBook.Acquire(discoveredPeer.Addr) {
+			go runPeer(discoveredPeer.Addr)
+		}
+	}
+
+	go func() {
+		retryTicker := time.NewTicker(peerRetryInterval)
+		defer retryTicker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case discoveredPeer, ok := <-discovered:
+				if !ok {
+					discovered = nil
+					if d.AddressBook.Len() == 0 {
+						close(noPeers)
 					}
 					continue
 				}
 
-				pieceToDownload.sortBlocks()
+				addPeer(discoveredPeer)
 
-				isValid, _ := pieceToDownload.checkHash()
-				if !isValid {
-					fmt.Printf("Invalid piece %d hash\n", pieceToDownload.Index)
-					piecesQueue <- pieceToDownload
+			case exchangedPeer, ok := <-exchanged:
+				if !ok {
+					exchanged = nil
 					continue
 				}
 
-				fileSaveQueue <- pieceToDownload
+				addPeer(exchangedPeer)
 
-				wg.Done()
+			case <-retryTicker.C:
+				for _, addr := range d.AddressBook.Ready() {
+					if d.AddressBook.Acquire(addr) {
+						go runPeer(addr)
+					}
+				}
 			}
-		}()
-	}
-
-	defer func() {
-		for _, peer := range peers {
-			peer.Disconnect()
 		}
 	}()
 
@@ -96,116 +318,654 @@ func (d *Downloader) Download(metafile TorrentMetaInfo, path string) error {
 	go func() {
 		dowloadedPieces := 0
 		for pieceToSave := range fileSaveQueue {
-			err = savePieceToFile(pieceToSave, path, metafile.Info.PieceLength)
+			err := savePieceToFile(pieceToSave, path, metafile.Info.PieceLength)
 			dowloadedPieces += 1
-			fmt.Printf("[%d/%d] Piece saved %d \n", dowloadedPieces, len(pieces), pieceToSave.Index)
+			fmt.Printf("[%d/%d] Piece saved %d \n", dowloadedPieces, piecesCount, pieceToSave.Index)
 			if err != nil {
 				fmt.Println(err)
 				return
 			}
+
+			d.uploads.AddPiece(pieceToSave.Index)
 		}
 		close(fileSaveIsDone)
 	}()
 
-	wg.Wait()
+	downloadIsDone := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(downloadIsDone)
+	}()
+
+	select {
+	case <-downloadIsDone:
+	case <-noPeers:
+		return fmt.Errorf("no peers to start download")
+	}
+
 	close(fileSaveQueue)
 	<-fileSaveIsDone
 
 	return nil
 }
 
-func (d *Downloader) downloadPiece(peer *Peer, metafile TorrentMetaInfo, pieceIndex int) ([]PieceBlock, error) {
-	if peer.Conn == nil {
-		conn, err := peer.Connect()
+// openPeer connects to the peer and exchanges the handshakes, what the peer
+// has arrives later in the session and what we have goes out with the
+// session's greeting
+func (d *Downloader) openPeer(peer *Peer, metafile TorrentMetaInfo) error {
+	conn, err := d.connectPeer(peer, metafile.InfoHash)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrPeerConnection, err)
+	}
+
+	peer.Conn = conn
+
+	// The handshake must not hang on a silent peer, the session has its own
+	// timeouts
+	conn.SetDeadline(time.Now().Add(d.handshakeTimeout()))
+	defer conn.SetDeadline(time.Time{})
+
+	err = peer.SendHandshake(metafile.InfoHash, d.PeerId)
+	if err != nil {
+		peer.Disconnect()
+		return fmt.Errorf("%w: handshake error %w", ErrPeerConnection, err)
+	}
+
+	return nil
+}
+
+// sendGreeting queues the extended handshake and what we have, the pieces
+// serving has to offer or nothing
+func (d *Downloader) sendGreeting(peer *Peer, serving *seedSession) error {
+	if d.Extensions != nil && peer.SupportsExtensionProtocol() {
+		err := peer.SendExtendedHandshake(d.Extensions)
 		if err != nil {
-			return nil, fmt.Errorf("%w: %s", ErrPeerConnection, err)
+			return fmt.Errorf("extended handshake error %s", err)
 		}
+	}
 
-		peer.Conn = conn
+	if serving != nil {
+		return serving.sendGreeting()
+	}
 
-		err = peer.SendHandshake(metafile.InfoHash, d.PeerId)
+	// With the Fast Extension the peer needs to hear what we have even
+	// though it is nothing
+	if peer.SupportsFastExtension() {
+		err := peer.SendHaveNone()
 		if err != nil {
-			peer.Disconnect()
-			return nil, fmt.Errorf("%w: handshake error %s", ErrPeerConnection, err)
+			return fmt.Errorf("have none error %s", err)
 		}
+	}
 
-		msg, err := peer.ReadMessage()
-		if err != nil || msg.MsgId != int(MsgIdBitfield) {
-			peer.Disconnect()
-			return nil, fmt.Errorf("%w: bitfields message error %s", ErrPeerConnection, err)
+	return nil
+}
+
+// addPexPeer advertises the peer to the others once we know whether it is
+// a seed
+func (d *Downloader) addPexPeer(peer *Peer) {
+	if d.PEX == nil || peer.Inbound {
+		return
+	}
+
+	// We reached the peer, so others can reach it too
+	flags := byte(PexFlagReachable)
+	if peer.HavePieces.isComplete() {
+		flags |= PexFlagSeed
+	}
+
+	if isUtpConn(peer.Conn) {
+		flags |= PexFlagUtp
+	}
+
+	d.PEX.AddConnected(peer.Addr, flags)
+}
+
+// downloadPieces keeps the peer's request queue filled with blocks of the
+// pieces it owns, picking the next piece as soon as every block of the current
+// ones is requested so the peer never runs dry between pieces. In endgame it
+// helps with the blocks other peers are still waiting for. Verified pieces
+// are passed to pieceDone and the peer's unfinished pieces are given back when
+// it returns. The peer is served the pieces of d.uploads when set.
+func (d *Downloader) downloadPieces(ctx context.Context, peer *Peer, metafile TorrentMetaInfo, pieces *piecePicker, pieceDone func(Piece)) error {
+	if !peer.isConnected() {
+		err := d.openPeer(peer, metafile)
+		if err != nil {
+			return err
 		}
+	}
 
-		peer.HavePieces.updateFromBitfield(msg.Payload)
+	pc := NewPeerConn(peer)
+	// Nothing for this peer right now, other peers may still give pieces
+	// back
+	pc.TickInterval = pieceWaitInterval
+	if d.InactivityTimeout > 0 {
+		pc.InactivityTimeout = d.InactivityTimeout
 	}
 
-	if !peer.HavePieces.hasPiece(pieceIndex) {
-		return nil, fmt.Errorf("%s peer dont have piece #%d", peer.Addr.Ip, pieceIndex)
+	if d.connected != nil {
+		replaced, err := d.connected.add(peer, !peer.Inbound)
+		if err != nil {
+			return err
+		}
+
+		if replaced != nil && replaced.session != nil {
+			replaced.session.Close(ErrDuplicateConnection)
+		}
+
+		defer d.connected.remove(peer)
 	}
 
-	err := peer.SendIntrested()
+	var serving *seedSession
+	var choker *Choker
+	if d.uploads != nil {
+		serving = &seedSession{seeder: d.uploads, pc: pc}
+		choker = d.uploads.Choker
+	}
+
+	err := d.sendGreeting(peer, serving)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("%w: %w", ErrPeerConnection, err)
+	}
+
+	// Peers are ranked by what they send us, and snub us when they send
+	// nothing while we want their pieces
+	if choker != nil {
+		choker.AddPeer(peer, serving.setChoked)
+		defer choker.RemovePeer(peer)
+	}
+
+	pieces.updatePeer(peer)
+	d.sendPex(peer)
+
+	queue := newRequestQueue(peer.requestQueueLimit())
+	// Pieces the peer rejected, sent corrupt or was too slow with are left to
+	// other peers
+	skipped := make(map[int]bool)
+
+	defer func() {
+		for req := range queue.pending {
+			pieces.unrequested(req)
+		}
+
+		pieces.removePeer(peer)
+	}()
+
+	forgetRequest := func(req BlockRequest) {
+		queue.remove(req)
+		pieces.unrequested(req)
+	}
+
+	fillQueue := func() error {
+		for queue.hasRoom() {
+			req, found := pieces.nextBlock(peer, skipped)
+
+			// A choked peer only picks pieces it allows us to request
+			if !found {
+				if pieces.pick(peer, skipped) {
+					continue
+				}
+
+				if pieces.isEndgame() {
+					req, found = pieces.endgameBlock(peer, skipped, queue)
+				}
+			}
+
+			if !found {
+				return nil
+			}
+
+			err := peer.SendBlockRequest(req.Index, req.Begin, req.Length)
+			if err != nil {
+				return fmt.Errorf("send block request error %s", err)
+			}
+
+			queue.sent(req)
+			pieces.requested(req)
+		}
+
+		return nil
+	}
+
+	// cancelReceived cancels the requests for blocks that arrived from other
+	// peers in the meantime
+	cancelReceived := func() error {
+		for req := range queue.pending {
+			if !pieces.isReceived(req) {
+				continue
+			}
+
+			forgetRequest(req)
+
+			err := peer.SendCancel(req)
+			if err != nil {
+				return fmt.Errorf("send cancel error %s", err)
+			}
+		}
+
+		return nil
+	}
+
+	// snub gives the blocks a peer that stopped serving us was asked for,
+	// and the pieces it owns, to other peers. The peer keeps a single
+	// request until it serves one.
+	snub := func() error {
+		if !queue.snubbed {
+			fmt.Printf("%s peer snubbed us, %d requests timed out\n", peer.Addr.Ip, queue.outstanding())
+			queue.snubbed = true
+		}
+
+		for req := range queue.pending {
+			forgetRequest(req)
+			skipped[req.Index] = true
+
+			err := peer.SendCancel(req)
+			if err != nil {
+				return fmt.Errorf("send cancel error %s", err)
+			}
+		}
+
+		pieces.giveBackAll(peer)
+
+		return nil
 	}
 
-	pieceLength := peer.CalculatePieceLength(metafile.Info.Length, metafile.Info.PieceLength, pieceIndex)
-	pieceBloksCount := calculateBlocksCount(pieceLength)
+	// updateInterest tells the peer whether it has pieces we still need,
+	// PeerConn only sends the changes
+	updateInterest := func() error {
+		if pieces.haveAll() && peer.HavePieces.isComplete() {
+			return ErrBothSeeders
+		}
 
-	pieceBlocks := make([]PieceBlock, 0)
+		interested := pieces.isInteresting(peer, skipped)
+		if choker != nil {
+			choker.SetAmInterested(peer, interested)
+		}
 
-	pieceRequested := false
+		return pc.SetInterested(interested)
+	}
 
-	for {
-		msg, err := peer.ReadMessage()
+	update := func() error {
+		err := cancelReceived()
 		if err != nil {
-			return nil, fmt.Errorf("read message error: %s", err)
+			return err
 		}
 
-		switch msg.MsgId {
-		case int(MsgIdKeepAlive):
-			fmt.Println("Keep alive received")
+		err = updateInterest()
+		if err != nil {
+			return err
+		}
 
-		case int(MsgIdChoke):
-			peer.Disconnect()
-			return nil, fmt.Errorf("choke")
+		return fillQueue()
+	}
+
+	pc.Events = PeerConnEvents{
+		Choked: func() error {
+			// Without the Fast Extension a choke silently drops all our
+			// requests, with it every dropped request gets a reject
+			if !peer.SupportsFastExtension() {
+				for req := range queue.pending {
+					forgetRequest(req)
+				}
+			}
+
+			return nil
+		},
+
+		Unchoked: update,
+
+		Have: func(pieceIndex int) error {
+			pieces.peerHave(peer, pieceIndex)
+
+			return update()
+		},
+
+		Bitfield: func() error {
+			pieces.updatePeer(peer)
+			d.addPexPeer(peer)
+
+			return update()
+		},
+
+		AllowedFast: func(pieceIndex int) error {
+			return update()
+		},
+
+		Piece: func(block PieceBlock) error {
+			req := BlockRequest{Index: block.Index, Begin: block.Begin, Length: len(block.Block)}
+
+			err := pieces.validate(req)
+			if err != nil {
+				return err
+			}
+
+			// Blocks we didn't ask this peer for, or whose request we
+			// cancelled or lost to a choke, are dropped
+			if !queue.received(req) {
+				return nil
+			}
+
+			if choker != nil {
+				choker.Downloaded(peer, req.Length)
+			}
+
+			pieces.unrequested(req)
+
+			progress := pieces.receive(block, peer)
+			if progress != nil {
+				piece := progress.piece()
+
+				isValid, _ := piece.checkHash()
+				if isValid {
+					pieceDone(piece)
+					d.sendPex(peer)
+
+					for _, culprit := range pieces.verified(progress) {
+						d.corruptPiece(culprit, piece.Index)
+					}
+				} else {
+					fmt.Printf("Invalid piece %d hash\n", piece.Index)
+					d.hashFailures.Add(1)
+
+					if culprit := pieces.hashFailed(progress); culprit != nil {
+						if culprit == peer {
+							skipped[piece.Index] = true
+						}
+
+						d.corruptPiece(culprit, piece.Index)
+					}
+				}
+			}
 
-		case int(MsgIdHave):
-			peerHavePieceIndex := int(msg.Payload[0])
-			peer.HavePieces.setPieceStatus(peerHavePieceIndex, true)
+			if d.Bans != nil && d.Bans.IsBanned(peer.Addr.Ip) {
+				return ErrPeerBanned
+			}
+
+			return update()
+		},
+
+		Reject: func(req BlockRequest) error {
+			if !queue.isPending(req) {
+				return nil
+			}
+
+			forgetRequest(req)
 
-		case int(MsgIdUnchoke):
-			if !pieceRequested {
-				_, err := peer.SendPieceBlocksRequests(pieceIndex, pieceLength)
+			// A peer rejecting while it lets us request won't serve the block,
+			// the piece is left to other peers
+			if peer.canRequest(req.Index) {
+				fmt.Printf("%s peer rejected piece #%d\n", peer.Addr.Ip, req.Index)
+				skipped[req.Index] = true
+				pieces.giveBack(req.Index, peer)
+			}
+
+			return update()
+		},
+
+		Extended: func(msg ExtendedMessage) error {
+			if d.Extensions != nil {
+				err := d.Extensions.HandleMessage(peer, msg)
 				if err != nil {
-					return nil, fmt.Errorf("send piece blocks request error: %s", err)
+					return fmt.Errorf("extended message error %s", err)
 				}
-				pieceRequested = true
 			}
 
-		case int(MsgIdPiece):
-			block, err := msg.PieceBlock()
-			if err != nil {
-				return nil, fmt.Errorf("piece block decode error: %s", err)
+			queue.limit = peer.requestQueueLimit()
+
+			return nil
+		},
+
+		Tick: func() error {
+			if queue.timedOut(d.requestTimeout()) {
+				err := snub()
+				if err != nil {
+					return err
+				}
+			}
+
+			if serving != nil {
+				err := serving.sendHaves()
+				if err != nil {
+					return err
+				}
 			}
 
-			pieceBlocks = append(pieceBlocks, block)
+			return update()
+		},
+	}
+
+	if serving != nil {
+		serving.serveEvents(&pc.Events)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		pc.Close(ctx.Err())
+	})
+	defer stop()
 
-		default:
-			return nil, fmt.Errorf("undexpected message id %d", msg.MsgId)
+	err = pc.Run()
+	if ctx.Err() != nil || errors.Is(err, ErrBothSeeders) {
+		return nil
+	}
+
+	return fmt.Errorf("%w: %w", ErrPeerConnection, err)
+}
+
+// downloadPiece downloads a single piece from the peer
+func (d *Downloader) downloadPiece(peer *Peer, metafile TorrentMetaInfo, pieceIndex int) ([]byte, error) {
+	if !peer.isConnected() {
+		err := d.openPeer(peer, metafile)
+		if err != nil {
+			return nil, err
 		}
+	}
+
+	if !peer.HavePieces.hasPiece(pieceIndex) {
+		return nil, fmt.Errorf("%s peer dont have piece #%d", peer.Addr.Ip, pieceIndex)
+	}
+
+	pieces := newPiecePicker(metafile, []int{pieceIndex})
 
-		if len(pieceBlocks) == pieceBloksCount {
-			break
+	ctx, cancel := context.WithTimeout(context.Background(), pieceDownloadTimeout)
+	defer cancel()
+
+	var data []byte
+
+	err := d.downloadPieces(ctx, peer, metafile, pieces, func(piece Piece) {
+		data = piece.Data
+		cancel()
+	})
+
+	if data == nil {
+		if err == nil {
+			err = fmt.Errorf("%s peer didn't send piece #%d", peer.Addr.Ip, pieceIndex)
 		}
+
+		return nil, err
 	}
 
-	return pieceBlocks, nil
+	return data, nil
+}
+
+func (d *Downloader) Stats() DownloadStats {
+	stats := DownloadStats{HashFailures: d.hashFailures.Load()}
+
+	if d.Bans != nil {
+		stats.Banned = d.Bans.Banned()
+	}
+
+	if d.uploads != nil {
+		stats.Uploaded = d.uploads.Uploaded()
+	}
+
+	return stats
+}
+
+// corruptPiece counts a corrupt piece against the peer that sent it, a peer
+// banned for it is disconnected along with every other connection from its
+// IP
+func (d *Downloader) corruptPiece(peer *Peer, pieceIndex int) {
+	fmt.Printf("%s peer sent corrupt data in piece #%d\n", peer.Addr.Ip, pieceIndex)
+
+	if d.Bans == nil || !d.Bans.Strike(peer.Addr.Ip) {
+		return
+	}
+
+	err := d.Bans.Save()
+	if err != nil {
+		fmt.Printf("Ban list save error: %s\n", err)
+	}
+
+	if d.connected != nil {
+		d.connected.closeIp(peer.Addr.Ip, ErrPeerBanned)
+	}
+}
+
+func (d *Downloader) sendPex(peer *Peer) {
+	if d.PEX == nil {
+		return
+	}
+
+	err := d.PEX.MaybeSend(peer)
+	if err != nil {
+		fmt.Printf("PEX send error: %s\n", err)
+	}
+}
+
+func (d *Downloader) connectPeer(peer *Peer, infoHash Hash) (net.Conn, error) {
+	conn, err := d.dialPeer(peer)
+	if err != nil || d.Encryption == EncryptionDisable {
+		return conn, err
+	}
+
+	cryptoProvide := uint32(mseCryptoRC4)
+	if d.Encryption == EncryptionPrefer {
+		cryptoProvide |= mseCryptoPlaintext
+	}
+
+	// openPeer sets the deadline of the BitTorrent handshake afterwards
+	encryptedConn, err := mseInitiate(conn, time.Time{}, infoHash, cryptoProvide)
+	if err == nil {
+		return encryptedConn, nil
+	}
+
+	conn.Close()
+
+	if d.Encryption == EncryptionRequire {
+		return nil, err
+	}
+
+	// Peers without MSE drop the connection when they don't see a plaintext
+	// handshake, so they get one on a new connection
+	return d.dialPeer(peer)
+}
+
+func (d *Downloader) dialPeer(peer *Peer) (net.Conn, error) {
+	conn, err := d.dialTransport(peer)
+	if err != nil {
+		return nil, err
+	}
+
+	return limitConn(conn, d.GlobalRateLimits, d.RateLimits), nil
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+	utp  bool
+}
+
+// dialTransport connects over TCP, and over uTP at the same time when it is
+// enabled so peers without uTP cost no extra wait. The first connection
+// established is kept, the other one is closed.
+func (d *Downloader) dialTransport(peer *Peer) (net.Conn, error) {
+	if d.UTP == nil {
+		return peer.Connect(d.connectTimeout())
+	}
+
+	results := make(chan dialResult, 2)
+
+	go func() {
+		conn, err := d.UTP.DialTimeout(peer.Addr.ToString(), utpDialTimeout)
+		results <- dialResult{conn: conn, err: err, utp: true}
+	}()
+
+	go func() {
+		conn, err := peer.Connect(d.connectTimeout())
+		results <- dialResult{conn: conn, err: err}
+	}()
+
+	var tcpErr error
+
+	for pending := 2; pending > 0; pending-- {
+		result := <-results
+		if result.err == nil {
+			if pending > 1 {
+				go closeDialResult(results)
+			}
+
+			return result.conn, nil
+		}
+
+		if !result.utp {
+			tcpErr = result.err
+		}
+	}
+
+	return nil, tcpErr
+}
+
+// closeDialResult closes the connection of a dial that lost the race
+func closeDialResult(results <-chan dialResult) {
+	if result := <-results; result.err == nil {
+		result.conn.Close()
+	}
+}
+
+func (d *Downloader) connectTimeout() time.Duration {
+	if d.ConnectTimeout > 0 {
+		return d.ConnectTimeout
+	}
+
+	return defaultConnectTimeout
+}
+
+func (d *Downloader) handshakeTimeout() time.Duration {
+	if d.HandshakeTimeout > 0 {
+		return d.HandshakeTimeout
+	}
+
+	return defaultHandshakeTimeout
+}
+
+func (d *Downloader) requestTimeout() time.Duration {
+	if d.RequestTimeout > 0 {
+		return d.RequestTimeout
+	}
+
+	return defaultRequestTimeout
 }
 
 func calculateBlocksCount(pieceLength int) int {
-	blockSize := 16 * 1024
 	return int(math.Ceil(float64(pieceLength) / float64(blockSize)))
 }
 
+// openDownloadStorage creates the output file if needed and opens it for the
+// seeder, pieces are read back from it once saved
+func openDownloadStorage(metafile TorrentMetaInfo, path string) (*Storage, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	f.Close()
+
+	// Every file of the torrent is written to the one output file
+	metafile.Info.MultiFile = false
+	metafile.Info.Files = []TorrentFileInfoFile{{Length: metafile.Info.Length}}
+
+	return OpenStorage(metafile, path)
+}
+
 func savePieceToFile(piece Piece, path string, pieceLength int) error {
 	// If the file doesn't exist, create it
 	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
@@ -215,11 +975,7 @@ func savePieceToFile(piece Piece, path string, pieceLength int) error {
 
 	defer f.Close()
 
-	for _, block := range piece.Blocks {
-		pieceOffset := piece.Index*pieceLength + block.Begin
+	_, err = f.WriteAt(piece.Data, int64(piece.Index*pieceLength))
 
-		f.WriteAt(block.Block, int64(pieceOffset))
-	}
-
-	return nil
+	return err
 }
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestChokedPeerDownloadsAllowedFastPieces(t *testing.T) {
+	const piecesCount = 8
+	const allowedPiece = 5
+
+	metafile := TorrentMetaInfo{Info: TorrentFileInfo{
+		Length:      piecesCount * blockSize,
+		PieceLength: blockSize,
+		Pieces:      make([]Hash, piecesCount),
+	}}
+
+	conn, remote := loopbackPair(t)
+
+	peer := &Peer{
+		Addr:       Addr{Ip: net.IPv4(127, 0, 0, 1), Port: 6881},
+		Conn:       conn,
+		HavePieces: NewPiecesMap(piecesCount),
+	}
+	peer.Reserved[reservedFastByte] |= reservedFastBit
+
+	wanted := make([]int, piecesCount)
+	for i := range wanted {
+		wanted[i] = i
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := &Downloader{PeerId: NewPeerId()}
+	pieces := newPiecePicker(metafile, wanted)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- d.downloadPieces(ctx, peer, metafile, pieces, func(Piece) {})
+	}()
+
+	// The remote peer has everything and keeps us choked, one piece is
+	// allowed anyway
+	for _, msg := range []Message{HaveAllMessage{}, AllowedFastMessage{Index: allowedPiece}} {
+		err := writeMessage(remote, msg.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for {
+		raw, err := readMessage(remote)
+		if err != nil {
+			t.Fatalf("no request while choked: %s", err)
+		}
+
+		msg, err := DecodeMessage(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if req, ok := msg.(RequestMessage); ok {
+			if req.Index != allowedPiece {
+				t.Errorf("requested piece %d while choked, only %d is allowed", req.Index, allowedPiece)
+			}
+
+			break
+		}
+	}
+
+	remote.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("downloadPieces still running after the peer left")
+	}
+}
+
+func TestDownloadServesSavedPieces(t *testing.T) {
+	const piecesCount = 2
+
+	data := randomBytes(piecesCount * blockSize)
+	metafile := TorrentMetaInfo{
+		InfoHash: Hash{Hash: randomBytes(20)},
+		Info: TorrentFileInfo{
+			Name:        "data",
+			Length:      len(data),
+			PieceLength: blockSize,
+			Files:       []TorrentFileInfoFile{{Path: []string{"data"}, Length: len(data)}},
+		},
+	}
+
+	for pieceIndex := 0; pieceIndex < piecesCount; pieceIndex++ {
+		sum := sha1.Sum(data[pieceIndex*blockSize : (pieceIndex+1)*blockSize])
+		metafile.Info.Pieces = append(metafile.Info.Pieces, Hash{Hash: sum[:]})
+	}
+
+	dir := t.TempDir()
+
+	// The seeder only has the first piece, the second one is ours to give
+	seedPath := filepath.Join(dir, "seed")
+	err := os.WriteFile(seedPath, append(slices.Clone(data[:blockSize]), make([]byte, blockSize)...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err := OpenStorage(metafile, seedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	seeder := NewSeeder(metafile, storage)
+	seeder.Verify()
+
+	seedListener := NewPeerListener(NewPeerId())
+	seedListener.Register(metafile.InfoHash, seeder)
+
+	seedAddr, err := seedListener.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer seedListener.Close()
+
+	listener := NewPeerListener(NewPeerId())
+
+	listenAddr, err := listener.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	d := &Downloader{
+		PeerId:      listener.PeerId,
+		PeerSources: []PeerSource{&StaticPeerSource{Addrs: []Addr{addrFromNetAddr(seedAddr)}}},
+		Listener:    listener,
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Download(metafile, filepath.Join(dir, "out"))
+	}()
+
+	// Connections are refused until the download registers the torrent
+	for start := time.Now(); len(listener.infoHashes()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("download didn't register on the listener")
+		}
+	}
+
+	conn, err := net.Dial("tcp", listenAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	send := func(msg Message) {
+		err := writeMessage(conn, msg.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	handshake := Handshake{InfoHash: metafile.InfoHash, PeerId: NewPeerId()}
+
+	_, err = conn.Write(handshake.toBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = readBytes(conn, handshakeLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send(BitfieldMessage{Bitfield: []byte{0x40}})
+
+	// The download's requests for our piece wait until it served us the
+	// seeder's, it can't finish before
+	var heldBack []BlockRequest
+	haveFirst, interested, unchoked, requested := false, false, false, false
+
+	for served := false; !served; {
+		raw, err := readMessage(conn)
+		if err != nil {
+			t.Fatalf("no piece served: %s", err)
+		}
+
+		msg, err := DecodeMessage(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch msg := msg.(type) {
+		case BitfieldMessage:
+			haveFirst = msg.Bitfield[0]&0x80 != 0
+		case HaveMessage:
+			haveFirst = haveFirst || msg.Index == 0
+		case InterestedMessage:
+			send(UnchokeMessage{})
+		case UnchokeMessage:
+			unchoked = true
+		case RequestMessage:
+			heldBack = append(heldBack, msg.BlockRequest)
+		case PieceMessage:
+			if msg.Index != 0 || msg.Begin != 0 || !bytes.Equal(msg.Block, data[:blockSize]) {
+				t.Fatalf("served block at offset %d of piece #%d, want the first piece", msg.Begin, msg.Index)
+			}
+
+			served = true
+		}
+
+		if haveFirst && !interested {
+			send(InterestedMessage{})
+			interested = true
+		}
+
+		if haveFirst && unchoked && !requested {
+			send(RequestMessage{BlockRequest{Index: 0, Begin: 0, Length: blockSize}})
+			requested = true
+		}
+	}
+
+	for _, req := range heldBack {
+		send(PieceMessage{PieceBlock{Index: req.Index, Begin: req.Begin, Block: data[req.Index*blockSize+req.Begin:][:req.Length]}})
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("download didn't finish")
+	}
+
+	saved, err := os.ReadFile(filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(saved, data) {
+		t.Error("saved data differs")
+	}
+
+	if uploaded := d.Stats().Uploaded; uploaded != blockSize {
+		t.Errorf("uploaded %d bytes, want %d", uploaded, blockSize)
+	}
+}
+
+func TestDownloadFeedsChoker(t *testing.T) {
+	const piecesCount = 2
+
+	data := randomBytes(blockSize)
+	sum := sha1.Sum(data)
+
+	metafile := TorrentMetaInfo{Info: TorrentFileInfo{
+		Length:      piecesCount * blockSize,
+		PieceLength: blockSize,
+		Pieces:      []Hash{{Hash: sum[:]}, {Hash: randomBytes(20)}},
+	}}
+
+	conn, remote := loopbackPair(t)
+
+	peer := &Peer{
+		Addr:       Addr{Ip: net.IPv4(127, 0, 0, 1), Port: 6881},
+		Conn:       conn,
+		HavePieces: NewPiecesMap(piecesCount),
+	}
+
+	choker := NewChoker(ChokerConfig{Clock: &fakeClock{now: time.Unix(1700000000, 0)}})
+
+	// chokerPeer reads the choker's record of the peer
+	chokerPeer := func() chokerPeer {
+		choker.mu.Lock()
+		defer choker.mu.Unlock()
+
+		p, ok := choker.peers[peer]
+		if !ok {
+			t.Fatal("peer not added to the choker")
+		}
+
+		return *p
+	}
+
+	d := &Downloader{PeerId: NewPeerId(), uploads: NewSeeder(metafile, nil)}
+	d.uploads.Choker = choker
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- d.downloadPieces(ctx, peer, metafile, newPiecePicker(metafile, []int{0, 1}), func(Piece) {})
+	}()
+
+	// The peer only has the first piece
+	for _, msg := range []Message{BitfieldMessage{Bitfield: []byte{0x80}}, UnchokeMessage{}} {
+		err := writeMessage(remote, msg.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// readUntil reads the peer's side of the connection up to a message
+	// matching want
+	readUntil := func(want func(Message) bool) Message {
+		for {
+			raw, err := readMessage(remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg, err := DecodeMessage(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want(msg) {
+				return msg
+			}
+		}
+	}
+
+	req := readUntil(func(msg Message) bool {
+		_, ok := msg.(RequestMessage)
+		return ok
+	}).(RequestMessage)
+
+	if !chokerPeer().amInterested {
+		t.Error("choker doesn't know we want the peer's pieces")
+	}
+
+	err := writeMessage(remote, PieceMessage{PieceBlock{Index: req.Index, Begin: req.Begin, Block: data}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing left to want from the peer once the piece is in
+	readUntil(func(msg Message) bool {
+		_, ok := msg.(NotInterestedMessage)
+		return ok
+	})
+
+	p := chokerPeer()
+	if p.downloaded != blockSize {
+		t.Errorf("choker counted %d bytes downloaded, want %d", p.downloaded, blockSize)
+	}
+
+	if p.amInterested {
+		t.Error("choker still thinks we want the peer's pieces")
+	}
+
+	remote.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("downloadPieces still running after the peer left")
+	}
+
+	choker.mu.Lock()
+	defer choker.mu.Unlock()
+
+	if _, ok := choker.peers[peer]; ok {
+		t.Error("peer still in the choker after the session")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+const (
+	extendedHandshakeId     = 0
+	clientVersion           = "mybittorrent 0.1"
+	defaultRequestQueueSize = 250
+)
+
+// ExtensionHandler handles the extended messages (BEP 10) of one extension.
+// The payload doesn't include the extended message id.
+type ExtensionHandler interface {
+	HandleMessage(peer *Peer, payload []byte) error
+}
+
+// Handlers implementing ExtensionPeerHandshaked are told when a peer's
+// extended handshake arrives, for example to start sending it messages.
+type ExtensionPeerHandshaked interface {
+	PeerHandshaked(peer *Peer)
+}
+
+type ExtendedHandshake struct {
+	M            map[string]int
+	V            string
+	P            int
+	Reqq         int
+	YourIp       net.IP
+	MetadataSize int
+}
+
+type PeerExtensions struct {
+	// The peer's extended handshake, nil until it is received
+	Handshake *ExtendedHandshake
+}
+
+func (pe *PeerExtensions) remoteId(name string) (int, bool) {
+	if pe.Handshake == nil {
+		return 0, false
+	}
+
+	id, ok := pe.Handshake.M[name]
+
+	return id, ok && id != 0
+}
+
+// ExtensionRegistry holds the extensions we support. Each registered
+// extension gets a local message id that we advertise in the extended
+// handshake and the peer uses when sending us its messages, while messages to
+// the peer use the id from the peer's handshake.
+type ExtensionRegistry struct {
+	Version          string
+	ListenPort       int
+	RequestQueueSize int
+	MetadataSize     int
+
+	mu       sync.Mutex
+	localIds map[string]int
+	handlers map[int]ExtensionHandler
+}
+
+func NewExtensionRegistry() *ExtensionRegistry {
+	return &ExtensionRegistry{
+		localIds: make(map[string]int),
+		handlers: make(map[int]ExtensionHandler),
+	}
+}
+
+func (r *ExtensionRegistry) Register(name string, handler ExtensionHandler) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id, ok := r.localIds[name]; ok {
+		r.handlers[id] = handler
+		return id
+	}
+
+	id := len(r.localIds) + 1
+	r.localIds[name] = id
+	r.handlers[id] = handler
+
+	return id
+}
+
+func (r *ExtensionRegistry) LocalId(name string) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id, ok := r.localIds[name]
+
+	return id, ok
+}
+
+func (r *ExtensionRegistry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.localIds))
+	for name := range r.localIds {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+func (r *ExtensionRegistry) handshakePayload(peer *Peer) ([]byte, error) {
+	r.mu.Lock()
+	m := make(map[string]any, len(r.localIds))
+	for name, id := range r.localIds {
+		m[name] = id
+	}
+	r.mu.Unlock()
+
+	handshake := map[string]any{"m": m}
+
+	if r.Version != "" {
+		handshake["v"] = r.Version
+	}
+
+	if r.ListenPort > 0 {
+		handshake["p"] = r.ListenPort
+	}
+
+	if r.RequestQueueSize > 0 {
+		handshake["reqq"] = r.RequestQueueSize
+	}
+
+	if r.MetadataSize > 0 {
+		handshake["metadata_size"] = r.MetadataSize
+	}
+
+	if ip := peer.Addr.Ip.To4(); ip != nil {
+		handshake["yourip"] = string(ip)
+	} else if ip := peer.Addr.Ip.To16(); ip != nil {
+		handshake["yourip"] = string(ip)
+	}
+
+	encoded, err := encodeBencode(handshake)
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(encoded), nil
+}
+
+// HandleMessage handles an extended message. Messages of extensions we don't
+// know are ignored.
+func (r *ExtensionRegistry) HandleMessage(peer *Peer, msg ExtendedMessage) error {
+	if msg.Id == extendedHandshakeId {
+		handshake, err := parseExtendedHandshake(msg.Payload)
+		if err != nil {
+			return err
+		}
+
+		// Later handshakes only update what they contain, an id of zero
+		// disables the extension
+		if previous := peer.Extensions.Handshake; previous != nil {
+			for name, id := range handshake.M {
+				previous.M[name] = id
+			}
+			handshake.M = previous.M
+		}
+
+		peer.Extensions.Handshake = &handshake
+
+		r.mu.Lock()
+		handlers := make([]ExtensionHandler, 0, len(r.handlers))
+		for _, handler := range r.handlers {
+			handlers = append(handlers, handler)
+		}
+		r.mu.Unlock()
+
+		for _, handler := range handlers {
+			if hook, ok := handler.(ExtensionPeerHandshaked); ok {
+				hook.PeerHandshaked(peer)
+			}
+		}
+
+		return nil
+	}
+
+	r.mu.Lock()
+	handler, ok := r.handlers[int(msg.Id)]
+	r.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return handler.HandleMessage(peer, msg.Payload)
+}
+
+func parseExtendedHandshake(payload []byte) (ExtendedHandshake, error) {
+	handshake := ExtendedHandshake{M: make(map[string]int)}
+
+	decoded, err := decodeBencode(bufio.NewReader(bytes.NewReader(payload)))
+	if err != nil {
+		return handshake, err
+	}
+
+	dict, ok := decoded.(map[string]any)
+	if !ok {
+		return handshake, fmt.Errorf("extended handshake is not a dictionary")
+	}
+
+	if m, ok := dict["m"].(map[string]any); ok {
+		for name, id := range m {
+			if id, ok := id.(int); ok && id >= 0 && id <= 255 {
+				handshake.M[name] = id
+			}
+		}
+	}
+
+	handshake.V, _ = dict["v"].(string)
+	handshake.P, _ = dict["p"].(int)
+	handshake.Reqq, _ = dict["reqq"].(int)
+	handshake.MetadataSize, _ = dict["metadata_size"].(int)
+
+	if yourIp, ok := dict["yourip"].(string); ok && (len(yourIp) == net.IPv4len || len(yourIp) == net.IPv6len) {
+		handshake.YourIp = net.IP(yourIp)
+	}
+
+	return handshake, nil
+}
+
+func (p *Peer) SendExtendedHandshake(r *ExtensionRegistry) error {
+	payload, err := r.handshakePayload(p)
+	if err != nil {
+		return err
+	}
+
+	return p.WriteMessage(ExtendedMessage{Id: extendedHandshakeId, Payload: payload})
+}
+
+// ExchangeExtendedHandshakes sends our extended handshake and reads messages
+// until the peer's arrives, for connections that run no session
+func (p *Peer) ExchangeExtendedHandshakes(r *ExtensionRegistry) error {
+	err := p.SendExtendedHandshake(r)
+	if err != nil {
+		return err
+	}
+
+	for {
+		raw, err := readMessage(p.Conn)
+		if err != nil {
+			return err
+		}
+
+		msg, err := DecodeMessage(raw)
+		if err != nil {
+			return err
+		}
+
+		if extended, ok := msg.(ExtendedMessage); ok && extended.Id == extendedHandshakeId {
+			return r.HandleMessage(p, extended)
+		}
+	}
+}
+
+func (p *Peer) SupportsExtension(name string) bool {
+	_, ok := p.Extensions.remoteId(name)
+
+	return ok
+}
+
+func (p *Peer) SendExtendedMessage(name string, payload []byte) error {
+	id, ok := p.Extensions.remoteId(name)
+	if !ok {
+		return fmt.Errorf("peer doesn't support extension %s", name)
+	}
+
+	return p.WriteMessage(ExtendedMessage{Id: byte(id), Payload: payload})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseExtendedHandshake(t *testing.T) {
+	payload := "d1:md6:ut_pexi1e11:ut_metadatai2e3:badi300ee1:pi6881e4:reqqi500e1:v6:test 16:yourip4:\x7f\x00\x00\x01e"
+
+	handshake, err := parseExtendedHandshake([]byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if handshake.M["ut_pex"] != 1 || handshake.M["ut_metadata"] != 2 {
+		t.Errorf("extension ids %v", handshake.M)
+	}
+
+	if _, ok := handshake.M["bad"]; ok {
+		t.Errorf("id out of range kept: %v", handshake.M)
+	}
+
+	if handshake.P != 6881 || handshake.Reqq != 500 || handshake.V != "test 1" {
+		t.Errorf("handshake %+v", handshake)
+	}
+
+	if !handshake.YourIp.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("yourip %s", handshake.YourIp)
+	}
+}
+
+func TestExtendedHandshakeMalformed(t *testing.T) {
+	payloads := []string{
+		"d1:md6:ut_pexi1ee1:v999999999999999:abce",
+		"d1:mi-99999999999999999999ee",
+		"d1:m",
+		"li1ee",
+		"",
+	}
+
+	registry := NewExtensionRegistry()
+	registry.Register(pexExtensionName, NewPEX())
+
+	for _, payload := range payloads {
+		peer := &Peer{Addr: Addr{Ip: net.IPv4(127, 0, 0, 1), Port: 6881}}
+
+		err := registry.HandleMessage(peer, ExtendedMessage{Id: extendedHandshakeId, Payload: []byte(payload)})
+		if err == nil {
+			t.Errorf("handshake %q accepted", payload)
+		}
+
+		if peer.Extensions.Handshake != nil {
+			t.Errorf("handshake %q set on the peer", payload)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const (
+	// Number of allowed fast pieces we give every peer
+	allowedFastSetSize = 10
+	// Suggestions beyond this are ignored
+	maxSuggestedPieces = 32
+)
+
+type BlockRequest struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// allowedFastSet computes the pieces a peer at ip may download while choked,
+// using the canonical algorithm from BEP 6 so both sides of a connection
+// agree on the set.
+func allowedFastSet(ip net.IP, infoHash Hash, piecesCount int, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || piecesCount == 0 {
+		return nil
+	}
+
+	k = min(k, piecesCount)
+
+	x := make([]byte, 0, 4+len(infoHash.Hash))
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infoHash.Hash...)
+
+	set := make([]int, 0, k)
+	inSet := make(map[int]bool)
+
+	for len(set) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+
+		for i := 0; i < 5 && len(set) < k; i++ {
+			y := binary.BigEndian.Uint32(x[i*4 : i*4+4])
+			index := int(y % uint32(piecesCount))
+
+			if !inSet[index] {
+				inSet[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+
+	return set
+}
+
+func (p *Peer) SendHaveAll() error {
+	return p.WriteMessage(HaveAllMessage{})
+}
+
+func (p *Peer) SendHaveNone() error {
+	return p.WriteMessage(HaveNoneMessage{})
+}
+
+func (p *Peer) SendSuggestPiece(pieceIndex int) error {
+	return p.WriteMessage(SuggestPieceMessage{Index: pieceIndex})
+}
+
+func (p *Peer) SendAllowedFast(pieceIndex int) error {
+	return p.WriteMessage(AllowedFastMessage{Index: pieceIndex})
+}
+
+func (p *Peer) SendRejectRequest(req BlockRequest) error {
+	return p.WriteMessage(RejectRequestMessage{req})
+}
+
+func (p *Peer) canRequest(pieceIndex int) bool {
+	return (p.session != nil && !p.session.PeerChoking()) || p.AllowedFast[pieceIndex]
+}
+
+// handleFastMessage updates the peer state for the Fast Extension messages
+// that don't depend on the piece being downloaded
+func (p *Peer) handleFastMessage(msg Message) error {
+	if !p.SupportsFastExtension() {
+		return fmt.Errorf("fast extension message %d from a peer without fast extension", msg.Encode().MsgId)
+	}
+
+	switch msg := msg.(type) {
+	case HaveAllMessage:
+		for i := range p.HavePieces.PiecesStatus {
+			p.HavePieces.PiecesStatus[i] = true
+		}
+
+	case HaveNoneMessage:
+		for i := range p.HavePieces.PiecesStatus {
+			p.HavePieces.PiecesStatus[i] = false
+		}
+
+	case SuggestPieceMessage:
+		if len(p.Suggested) < maxSuggestedPieces {
+			p.Suggested = append(p.Suggested, msg.Index)
+		}
+
+	case AllowedFastMessage:
+		if p.AllowedFast == nil {
+			p.AllowedFast = make(map[int]bool)
+		}
+
+		p.AllowedFast[msg.Index] = true
+	}
+
+	return nil
+}
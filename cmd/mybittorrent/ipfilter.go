@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DAT ranges with an access level above this are allowed, as in eMule
+const ipFilterDatMaxBlockedLevel = 127
+
+type ipRange struct {
+	start netip.Addr
+	end   netip.Addr
+}
+
+// IPFilter blocks peers whose IP is in one of its ranges. Lists are loaded in
+// the PeerGuardian P2P text format, the eMule DAT format or as CIDR blocks,
+// and can be mixed. The ranges are kept sorted and merged, so a lookup is a
+// binary search however long the lists are.
+//
+// A nil filter blocks nothing.
+type IPFilter struct {
+	ranges []ipRange
+	sorted bool
+}
+
+func NewIPFilter() *IPFilter {
+	return &IPFilter{sorted: true}
+}
+
+// LoadFile adds the ranges of a blocklist file
+func (f *IPFilter) LoadFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	err = f.Load(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Load adds the ranges of a blocklist, the format is worked out line by line.
+// Empty lines and lines starting with # or // are skipped, any other line
+// that isn't a range is an error.
+func (f *IPFilter) Load(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+
+		ipRange, blocked, err := parseIPFilterLine(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+
+		if blocked {
+			f.ranges = append(f.ranges, ipRange)
+			f.sorted = false
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	f.merge()
+
+	return nil
+}
+
+// Add blocks the addresses from start to end
+func (f *IPFilter) Add(start netip.Addr, end netip.Addr) error {
+	start, end = start.Unmap(), end.Unmap()
+
+	if start.Is4() != end.Is4() || end.Less(start) {
+		return fmt.Errorf("invalid range %s - %s", start, end)
+	}
+
+	f.ranges = append(f.ranges, ipRange{start: start, end: end})
+	f.sorted = false
+	f.merge()
+
+	return nil
+}
+
+// Blocks tells whether the IP is in a blocked range
+func (f *IPFilter) Blocks(ip net.IP) bool {
+	if f == nil || len(f.ranges) == 0 {
+		return false
+	}
+
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return false
+	}
+
+	addr = addr.Unmap()
+
+	// The last range starting at or before the address is the only one
+	// that can hold it
+	i := sort.Search(len(f.ranges), func(i int) bool {
+		return addr.Less(f.ranges[i].start)
+	})
+
+	return i > 0 && !f.ranges[i-1].end.Less(addr)
+}
+
+// Len is the number of ranges once overlapping ones are merged
+func (f *IPFilter) Len() int {
+	if f == nil {
+		return 0
+	}
+
+	return len(f.ranges)
+}
+
+// merge sorts the ranges and joins those that overlap or touch
+func (f *IPFilter) merge() {
+	if f.sorted {
+		return
+	}
+
+	sort.Slice(f.ranges, func(i, j int) bool {
+		return f.ranges[i].start.Less(f.ranges[j].start)
+	})
+
+	merged := f.ranges[:0]
+	for _, r := range f.ranges {
+		if last := len(merged) - 1; last >= 0 && r.start.Is4() == merged[last].end.Is4() {
+			if next := merged[last].end.Next(); !next.IsValid() || !next.Less(r.start) {
+				if merged[last].end.Less(r.end) {
+					merged[last].end = r.end
+				}
+
+				continue
+			}
+		}
+
+		merged = append(merged, r)
+	}
+
+	f.ranges = merged
+	f.sorted = true
+}
+
+// parseIPFilterLine parses a range in any of the formats, it also tells
+// whether the range is blocked, DAT ranges can allow their addresses
+func parseIPFilterLine(line string) (ipRange, bool, error) {
+	// P2P lines start with a description, which may contain anything
+	if i := strings.LastIndex(line, ":"); i >= 0 {
+		if r, err := parseAddrRange(line[i+1:]); err == nil {
+			return r, true, nil
+		}
+	}
+
+	switch {
+	case strings.Contains(line, ","):
+		return parseDatLine(line)
+
+	case strings.Contains(line, "/"):
+		prefix, err := netip.ParsePrefix(line)
+		if err != nil {
+			return ipRange{}, false, err
+		}
+
+		return prefixRange(prefix.Masked()), true, nil
+
+	case strings.Contains(line, "-"):
+		r, err := parseAddrRange(line)
+
+		return r, err == nil, err
+
+	default:
+		addr, err := parseFilterAddr(line)
+		if err != nil {
+			return ipRange{}, false, err
+		}
+
+		return ipRange{start: addr, end: addr}, true, nil
+	}
+}
+
+// parseDatLine parses "start - end , level , description"
+func parseDatLine(line string) (ipRange, bool, error) {
+	fields := strings.SplitN(line, ",", 3)
+
+	r, err := parseAddrRange(fields[0])
+	if err != nil {
+		return ipRange{}, false, err
+	}
+
+	level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return ipRange{}, false, fmt.Errorf("invalid access level %q", fields[1])
+	}
+
+	return r, level <= ipFilterDatMaxBlockedLevel, nil
+}
+
+func parseAddrRange(s string) (ipRange, error) {
+	startPart, endPart, ok := strings.Cut(s, "-")
+	if !ok {
+		return ipRange{}, fmt.Errorf("invalid range %q", s)
+	}
+
+	start, err := parseFilterAddr(startPart)
+	if err != nil {
+		return ipRange{}, err
+	}
+
+	end, err := parseFilterAddr(endPart)
+	if err != nil {
+		return ipRange{}, err
+	}
+
+	if start.Is4() != end.Is4() || end.Less(start) {
+		return ipRange{}, fmt.Errorf("invalid range %q", s)
+	}
+
+	return ipRange{start: start, end: end}, nil
+}
+
+// parseFilterAddr parses an address, IPv4 octets may have leading zeros as
+// DAT lists pad them to three digits
+func parseFilterAddr(s string) (netip.Addr, error) {
+	s = strings.TrimSpace(s)
+
+	if strings.Count(s, ".") == 3 && !strings.Contains(s, ":") {
+		octets := strings.Split(s, ".")
+		for i, octet := range octets {
+			if trimmed := strings.TrimLeft(octet, "0"); trimmed != "" {
+				octets[i] = trimmed
+			} else if octet != "" {
+				octets[i] = "0"
+			}
+		}
+
+		s = strings.Join(octets, ".")
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+
+	return addr.Unmap(), nil
+}
+
+func prefixRange(prefix netip.Prefix) ipRange {
+	start := prefix.Addr()
+	bytes := start.AsSlice()
+
+	// Set the host bits
+	for bit := prefix.Bits(); bit < len(bytes)*8; bit++ {
+		bytes[bit/8] |= 0x80 >> (bit % 8)
+	}
+
+	end, _ := netip.AddrFromSlice(bytes)
+
+	return ipRange{start: start.Unmap(), end: end.Unmap()}
+}
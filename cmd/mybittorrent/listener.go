@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Peers that don't finish the handshake in time are dropped
+const defaultListenerHandshakeTimeout = 30 * time.Second
+
+var ErrUnknownTorrent = errors.New("unknown torrent")
+
+// TorrentHandler takes over inbound connections of a torrent after the
+// handshakes, the peer's connection, id and reserved bits are set.
+type TorrentHandler interface {
+	HandlePeer(peer *Peer)
+}
+
+// TorrentHandlerFunc lets a function handle a torrent's peers
+type TorrentHandlerFunc func(peer *Peer)
+
+func (f TorrentHandlerFunc) HandlePeer(peer *Peer) {
+	f(peer)
+}
+
+// PeerListener accepts connections from peers and hands them to the handler
+// of the torrent they ask for, going by the info hash in their handshake. One
+// listener serves every torrent and can accept on several listeners at once,
+// such as a TCP port and a uTP socket.
+type PeerListener struct {
+	PeerId     string
+	Encryption EncryptionPolicy
+	// defaultListenerHandshakeTimeout if zero
+	HandshakeTimeout time.Duration
+	// Connections from the filter's ranges are closed before the handshake
+	IPFilter *IPFilter
+	// Bandwidth caps of every inbound connection, handshakes included. The
+	// handlers can add limits of their own.
+	RateLimits *RateLimits
+
+	mu        sync.Mutex
+	torrents  map[string]TorrentHandler
+	listeners []net.Listener
+	conns     map[net.Conn]bool
+	closed    bool
+}
+
+func NewPeerListener(peerId string) *PeerListener {
+	return &PeerListener{
+		PeerId:   peerId,
+		torrents: make(map[string]TorrentHandler),
+		conns:    make(map[net.Conn]bool),
+	}
+}
+
+func (l *PeerListener) Register(infoHash Hash, handler TorrentHandler) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.torrents[infoHash.String()] = handler
+}
+
+func (l *PeerListener) Unregister(infoHash Hash) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.torrents, infoHash.String())
+}
+
+// Listen accepts TCP connections on addr in the background
+func (l *PeerListener) Listen(addr string) (net.Addr, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	go l.Serve(listener)
+
+	return listener.Addr(), nil
+}
+
+// Serve accepts connections on listener until it is closed
+func (l *PeerListener) Serve(listener net.Listener) error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return listener.Close()
+	}
+	l.listeners = append(l.listeners, listener)
+	l.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+
+			return err
+		}
+
+		go l.handleConn(conn)
+	}
+}
+
+func (l *PeerListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.closed = true
+
+	var err error
+	for _, listener := range l.listeners {
+		if closeErr := listener.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+
+	for conn := range l.conns {
+		conn.Close()
+	}
+
+	return err
+}
+
+func (l *PeerListener) infoHashes() []Hash {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	hashes := make([]Hash, 0, len(l.torrents))
+	for infoHash := range l.torrents {
+		hashes = append(hashes, Hash{Hash: []byte(infoHash)})
+	}
+
+	return hashes
+}
+
+func (l *PeerListener) track(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return false
+	}
+
+	l.conns[conn] = true
+
+	return true
+}
+
+func (l *PeerListener) untrack(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.conns, conn)
+}
+
+func (l *PeerListener) handleConn(conn net.Conn) {
+	if l.IPFilter.Blocks(addrFromNetAddr(conn.RemoteAddr()).Ip) {
+		conn.Close()
+		return
+	}
+
+	conn = limitConn(conn, l.RateLimits)
+	if !l.track(conn) {
+		conn.Close()
+		return
+	}
+
+	defer func() {
+		l.untrack(conn)
+		conn.Close()
+	}()
+
+	peer, handler, err := l.accept(conn)
+	if err != nil {
+		fmt.Printf("Inbound peer %s refused: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	handler.HandlePeer(peer)
+}
+
+// accept runs the encryption and BitTorrent handshakes of an inbound
+// connection and finds the torrent it is for
+func (l *PeerListener) accept(conn net.Conn) (*Peer, TorrentHandler, error) {
+	timeout := l.HandshakeTimeout
+	if timeout == 0 {
+		timeout = defaultListenerHandshakeTimeout
+	}
+
+	// The deadline covers every handshake, peers stalling halfway are dropped
+	deadline := time.Now().Add(timeout)
+	conn.SetDeadline(deadline)
+
+	peerConn, skey, err := mseAccept(conn, deadline, l.infoHashes(), l.Encryption)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	handshakeBytes, err := readBytes(peerConn, handshakeLength)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	handshake, err := NewHandshakeFromBytes(handshakeBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// An encrypted peer already told which torrent it wants
+	if skey != nil && !bytes.Equal(skey.Hash, handshake.InfoHash.Hash) {
+		return nil, nil, fmt.Errorf("handshake info hash %s doesn't match the encryption key", handshake.InfoHash.Hex())
+	}
+
+	l.mu.Lock()
+	handler, ok := l.torrents[handshake.InfoHash.String()]
+	l.mu.Unlock()
+
+	if !ok {
+		return nil, nil, fmt.Errorf("%w %s", ErrUnknownTorrent, handshake.InfoHash.Hex())
+	}
+
+	reply := Handshake{InfoHash: handshake.InfoHash, PeerId: l.PeerId}
+	reply.Reserved[reservedExtensionByte] |= reservedExtensionBit
+	reply.Reserved[reservedFastByte] |= reservedFastBit
+
+	_, err = peerConn.Write(reply.toBytes())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Refused only after our reply, it tells our side of the connection that
+	// it reached itself
+	if handshake.PeerId == l.PeerId {
+		return nil, nil, ErrSelfConnection
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	peer := &Peer{
+		Addr:     addrFromNetAddr(conn.RemoteAddr()),
+		Conn:     peerConn,
+		PeerId:   handshake.PeerId,
+		Reserved: handshake.Reserved,
+		Inbound:  true,
+	}
+
+	return peer, handler, nil
+}
+
+func addrFromNetAddr(netAddr net.Addr) Addr {
+	switch a := netAddr.(type) {
+	case *net.TCPAddr:
+		return Addr{Ip: a.IP, Port: uint16(a.Port)}
+	case *net.UDPAddr:
+		return Addr{Ip: a.IP, Port: uint16(a.Port)}
+	}
+
+	addr := Addr{}
+	addr.ReadFromString(netAddr.String())
+
+	return addr
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type testTorrentHandler chan *Peer
+
+func (h testTorrentHandler) HandlePeer(peer *Peer) {
+	h <- peer
+}
+
+func startTestListener(t *testing.T, handshakeTimeout time.Duration) (*PeerListener, net.Addr, testTorrentHandler, Hash) {
+	listener := NewPeerListener(NewPeerId())
+	listener.HandshakeTimeout = handshakeTimeout
+
+	infoHash := Hash{Hash: randomBytes(20)}
+	handler := make(testTorrentHandler, 1)
+	listener.Register(infoHash, handler)
+
+	addr, err := listener.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { listener.Close() })
+
+	return listener, addr, handler, infoHash
+}
+
+func TestPeerListenerDropsStalledHandshakes(t *testing.T) {
+	const handshakeTimeout = 300 * time.Millisecond
+
+	_, addr, handler, infoHash := startTestListener(t, handshakeTimeout)
+	handshake := Handshake{InfoHash: infoHash, PeerId: NewPeerId()}
+
+	tests := []struct {
+		name string
+		sent []byte
+	}{
+		{"nothing", nil},
+		{"part of the protocol name", btProtocolName[:5]},
+		{"part of an MSE public key", randomBytes(mseKeySize / 2)},
+		{"part of a plaintext handshake", handshake.toBytes()[:len(btProtocolName)+10]},
+	}
+
+	for _, test := range tests {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = conn.Write(test.sent)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The listener closes the connection, well before mseHandshakeTimeout
+		start := time.Now()
+		conn.SetReadDeadline(start.Add(5 * handshakeTimeout))
+
+		_, err = io.ReadAll(conn)
+		conn.Close()
+
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Errorf("%s: connection still open after %s", test.name, time.Since(start))
+		}
+	}
+
+	select {
+	case peer := <-handler:
+		t.Errorf("stalled peer %s handed over", peer.Addr.ToString())
+	default:
+	}
+}
+
+func TestPeerListenerAcceptsHandshake(t *testing.T) {
+	listener, addr, handler, infoHash := startTestListener(t, 0)
+
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	peerId := NewPeerId()
+	handshake := Handshake{InfoHash: infoHash, PeerId: peerId}
+
+	_, err = conn.Write(handshake.toBytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	reply, err := readBytes(conn, handshakeLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replyHandshake, err := NewHandshakeFromBytes(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if replyHandshake.PeerId != listener.PeerId {
+		t.Errorf("reply from peer id %x", replyHandshake.PeerId)
+	}
+
+	select {
+	case peer := <-handler:
+		if peer.PeerId != peerId {
+			t.Errorf("handed over peer id %x, want %x", peer.PeerId, peerId)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer not handed over")
+	}
+}
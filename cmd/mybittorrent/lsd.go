@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	lsdIpv4Group = "239.192.152.143:6771"
+	lsdIpv6Group = "[ff15::efc0:988f]:6771"
+
+	lsdAnnounceInterval = 5 * time.Minute
+	// BEP 14 asks for no more than one announce per torrent per minute
+	lsdMinAnnounceGap = time.Minute
+	// Repeated announces of one peer for one torrent within this window are
+	// ignored, so a chatty host can't flood the downloads with the same peer
+	lsdReceiveWindow = time.Minute
+	lsdMaxPacketSize = 1400
+)
+
+type LSDConfig struct {
+	// Port we accept peer connections on. Without one we announce nothing
+	// and only pick up the peers announcing on the LAN.
+	Port int
+	// Interface to join the multicast groups on, the system default if empty
+	Interface string
+	// Multicast groups to use, both the IPv4 and IPv6 one if nil
+	Groups []string
+	// How often active torrents are announced, lsdAnnounceInterval if zero
+	AnnounceInterval time.Duration
+}
+
+type lsdGroup struct {
+	host     string
+	addr     *net.UDPAddr
+	listener *net.UDPConn
+	sender   *net.UDPConn
+}
+
+// LSD implements Local Service Discovery (BEP 14), announcing the torrents we
+// are active on to the LAN over multicast and picking up peers that announce
+// the same torrents.
+type LSD struct {
+	Config LSDConfig
+
+	cookie string
+	groups []*lsdGroup
+
+	mu            sync.Mutex
+	lastAnnounced map[string]time.Time
+	lastReceived  map[string]time.Time
+	subscribers   map[string]map[chan Addr]bool
+
+	announceNow chan struct{}
+	done        chan struct{}
+	wg          sync.WaitGroup
+}
+
+func NewLSD(config LSDConfig) *LSD {
+	if config.Groups == nil {
+		config.Groups = []string{lsdIpv4Group, lsdIpv6Group}
+	}
+
+	if config.AnnounceInterval == 0 {
+		config.AnnounceInterval = lsdAnnounceInterval
+	}
+
+	return &LSD{
+		Config:        config,
+		cookie:        hex.EncodeToString(randomBytes(8)),
+		lastAnnounced: make(map[string]time.Time),
+		lastReceived:  make(map[string]time.Time),
+		subscribers:   make(map[string]map[chan Addr]bool),
+		announceNow:   make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+}
+
+func (l *LSD) Start() error {
+	var ifi *net.Interface
+	if l.Config.Interface != "" {
+		var err error
+		ifi, err = net.InterfaceByName(l.Config.Interface)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, groupAddr := range l.Config.Groups {
+		addr, err := net.ResolveUDPAddr("udp", groupAddr)
+		if err != nil {
+			return err
+		}
+
+		network := "udp4"
+		if addr.IP.To4() == nil {
+			network = "udp6"
+		}
+
+		listener, err := net.ListenMulticastUDP(network, ifi, addr)
+		if err != nil {
+			// Hosts without IPv6 can still use the IPv4 group
+			fmt.Printf("LSD can't join %s: %s\n", groupAddr, err)
+			continue
+		}
+
+		sender, err := net.ListenUDP(network, nil)
+		if err != nil {
+			listener.Close()
+			fmt.Printf("LSD can't send to %s: %s\n", groupAddr, err)
+			continue
+		}
+
+		l.groups = append(l.groups, &lsdGroup{
+			host:     groupAddr,
+			addr:     addr,
+			listener: listener,
+			sender:   sender,
+		})
+	}
+
+	if len(l.groups) == 0 {
+		return fmt.Errorf("LSD couldn't join any multicast group")
+	}
+
+	for _, group := range l.groups {
+		group := group
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			l.readLoop(group)
+		}()
+	}
+
+	if l.Config.Port > 0 {
+		l.wg.Add(1)
+		go func() {
+			defer l.wg.Done()
+			l.announceLoop()
+		}()
+	}
+
+	return nil
+}
+
+func (l *LSD) Close() error {
+	close(l.done)
+
+	for _, group := range l.groups {
+		group.listener.Close()
+		group.sender.Close()
+	}
+
+	l.wg.Wait()
+
+	return nil
+}
+
+// subscribe makes the info hash active, it is announced to the LAN if we have
+// a port and peers announcing it are sent to the returned channel until
+// unsubscribe is called
+func (l *LSD) subscribe(infoHash Hash) chan Addr {
+	found := make(chan Addr, 16)
+	key := infoHash.String()
+
+	l.mu.Lock()
+	if l.subscribers[key] == nil {
+		l.subscribers[key] = make(map[chan Addr]bool)
+	}
+	l.subscribers[key][found] = true
+	l.mu.Unlock()
+
+	select {
+	case l.announceNow <- struct{}{}:
+	default:
+	}
+
+	return found
+}
+
+func (l *LSD) unsubscribe(infoHash Hash, found chan Addr) {
+	key := infoHash.String()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.subscribers[key], found)
+	if len(l.subscribers[key]) == 0 {
+		delete(l.subscribers, key)
+	}
+}
+
+func (l *LSD) announceLoop() {
+	ticker := time.NewTicker(min(l.Config.AnnounceInterval, lsdMinAnnounceGap))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		case <-l.announceNow:
+		}
+
+		l.announceDue()
+	}
+}
+
+func (l *LSD) announceDue() {
+	l.mu.Lock()
+	due := make([]string, 0)
+	for infoHash := range l.subscribers {
+		last, ok := l.lastAnnounced[infoHash]
+		if !ok || time.Since(last) >= l.Config.AnnounceInterval {
+			due = append(due, infoHash)
+			l.lastAnnounced[infoHash] = time.Now()
+		}
+	}
+
+	for infoHash, last := range l.lastAnnounced {
+		if _, ok := l.subscribers[infoHash]; !ok && time.Since(last) >= lsdMinAnnounceGap {
+			delete(l.lastAnnounced, infoHash)
+		}
+	}
+	l.mu.Unlock()
+
+	if len(due) == 0 {
+		return
+	}
+
+	for _, group := range l.groups {
+		for _, packet := range l.announcePackets(group.host, due) {
+			_, err := group.sender.WriteToUDP(packet, group.addr)
+			if err != nil {
+				fmt.Printf("LSD announce error: %s\n", err)
+			}
+		}
+	}
+}
+
+// announcePackets puts as many info hashes into each announce as fit into a
+// packet that won't be fragmented
+func (l *LSD) announcePackets(host string, infoHashes []string) [][]byte {
+	header := fmt.Sprintf("BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", host, l.Config.Port)
+	footer := fmt.Sprintf("cookie: %s\r\n\r\n\r\n", l.cookie)
+
+	packets := make([][]byte, 0)
+
+	packet := header
+	hashesInPacket := 0
+
+	for _, infoHash := range infoHashes {
+		line := fmt.Sprintf("Infohash: %s\r\n", hex.EncodeToString([]byte(infoHash)))
+
+		if hashesInPacket > 0 && len(packet)+len(line)+len(footer) > lsdMaxPacketSize {
+			packets = append(packets, []byte(packet+footer))
+			packet = header
+			hashesInPacket = 0
+		}
+
+		packet += line
+		hashesInPacket++
+	}
+
+	return append(packets, []byte(packet+footer))
+}
+
+func (l *LSD) readLoop(group *lsdGroup) {
+	buf := make([]byte, 65536)
+
+	for {
+		n, from, err := group.listener.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+				continue
+			}
+		}
+
+		l.handleAnnounce(buf[:n], from)
+	}
+}
+
+func (l *LSD) handleAnnounce(packet []byte, from *net.UDPAddr) {
+	port, infoHashes, cookie, err := parseLsdAnnounce(packet)
+	if err != nil || cookie == l.cookie {
+		return
+	}
+
+	addr := Addr{Ip: from.IP, Port: port}
+	if ip4 := from.IP.To4(); ip4 != nil {
+		addr.Ip = ip4
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+
+	for key, received := range l.lastReceived {
+		if now.Sub(received) >= lsdReceiveWindow {
+			delete(l.lastReceived, key)
+		}
+	}
+
+	for _, infoHash := range infoHashes {
+		subscribers, ok := l.subscribers[infoHash]
+		if !ok {
+			continue
+		}
+
+		receivedKey := infoHash + addr.ToString()
+		if _, ok := l.lastReceived[receivedKey]; ok {
+			continue
+		}
+		l.lastReceived[receivedKey] = now
+
+		for found := range subscribers {
+			select {
+			case found <- addr:
+			default:
+			}
+		}
+	}
+}
+
+func parseLsdAnnounce(packet []byte) (uint16, []string, string, error) {
+	reader := bufio.NewReader(bytes.NewReader(packet))
+
+	requestLine, err := reader.ReadString('\n')
+	if err != nil {
+		return 0, nil, "", err
+	}
+
+	if strings.TrimSpace(requestLine) != "BT-SEARCH * HTTP/1.1" {
+		return 0, nil, "", fmt.Errorf("not an LSD announce")
+	}
+
+	var port uint16
+	infoHashes := make([]string, 0)
+	cookie := ""
+
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if ok {
+			value = strings.TrimSpace(value)
+
+			switch http.CanonicalHeaderKey(strings.TrimSpace(name)) {
+			case "Port":
+				parsedPort, err := strconv.Atoi(value)
+				if err != nil || parsedPort <= 0 || parsedPort > 65535 {
+					return 0, nil, "", fmt.Errorf("invalid LSD port %q", value)
+				}
+				port = uint16(parsedPort)
+
+			case "Infohash":
+				infoHash, err := hex.DecodeString(value)
+				if err == nil && len(infoHash) == 20 {
+					infoHashes = append(infoHashes, string(infoHash))
+				}
+
+			case "Cookie":
+				cookie = value
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	if port == 0 || len(infoHashes) == 0 {
+		return 0, nil, "", fmt.Errorf("incomplete LSD announce")
+	}
+
+	return port, infoHashes, cookie, nil
+}
+
+type LSDPeerSource struct {
+	LSD      *LSD
+	InfoHash Hash
+}
+
+func (s *LSDPeerSource) Run(ctx context.Context, found chan<- DiscoveredPeer) error {
+	addrs := s.LSD.subscribe(s.InfoHash)
+	defer s.LSD.unsubscribe(s.InfoHash, addrs)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case addr := <-addrs:
+			if !sendDiscoveredPeer(ctx, found, DiscoveredPeer{Addr: addr, Origin: PeerOriginLSD}) {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startLSD starts an LSD client on a multicast group of the test's own, the
+// test is skipped on hosts where multicast doesn't work
+func startLSD(t *testing.T, group string, port int) *LSD {
+	lsd := NewLSD(LSDConfig{Port: port, Groups: []string{group}})
+
+	err := lsd.Start()
+	if err != nil {
+		t.Skipf("no multicast: %s", err)
+	}
+
+	t.Cleanup(func() { lsd.Close() })
+
+	return lsd
+}
+
+// testLSDGroup is the IPv4 LSD group on a free port, so tests don't hear the
+// LAN or each other
+func testLSDGroup(t *testing.T) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	return fmt.Sprintf("239.192.152.143:%d", conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func TestLSDFindsPeersOnTheLAN(t *testing.T) {
+	group := testLSDGroup(t)
+	infoHash := Hash{Hash: randomBytes(20)}
+
+	groupAddr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything sent to the group, to check who announces
+	sniffer, err := net.ListenMulticastUDP("udp4", nil, groupAddr)
+	if err != nil {
+		t.Skipf("no multicast: %s", err)
+	}
+
+	defer sniffer.Close()
+
+	announcer := startLSD(t, group, 6881)
+	listener := startLSD(t, group, 0)
+
+	listenerFound := listener.subscribe(infoHash)
+	announcerFound := announcer.subscribe(infoHash)
+
+	select {
+	case addr := <-listenerFound:
+		if addr.Port != 6881 {
+			t.Errorf("found %s, want port 6881", addr.ToString())
+		}
+	case <-time.After(5 * time.Second):
+		t.Skip("multicast isn't looped back on this host")
+	}
+
+	// A client doesn't find itself
+	select {
+	case addr := <-announcerFound:
+		t.Errorf("announcer found %s", addr.ToString())
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// A client without a port announces nothing
+	buf := make([]byte, lsdMaxPacketSize)
+	sniffer.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+
+	for {
+		n, _, err := sniffer.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+
+		if strings.Contains(string(buf[:n]), listener.cookie) {
+			t.Errorf("client without a port announced %q", buf[:n])
+		}
+	}
+}
+
+func TestParseLsdAnnounce(t *testing.T) {
+	infoHash := Hash{Hash: randomBytes(20)}
+
+	lsd := NewLSD(LSDConfig{Port: 51413})
+	packets := lsd.announcePackets(lsdIpv4Group, []string{infoHash.String()})
+
+	if len(packets) != 1 {
+		t.Fatalf("%d packets for one info hash", len(packets))
+	}
+
+	port, infoHashes, cookie, err := parseLsdAnnounce(packets[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if port != 51413 || len(infoHashes) != 1 || infoHashes[0] != infoHash.String() || cookie != lsd.cookie {
+		t.Errorf("parsed port %d, info hashes %x, cookie %q", port, infoHashes, cookie)
+	}
+
+	invalid := []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 0\r\nInfohash: " + infoHash.Hex() + "\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n",
+	}
+
+	for _, packet := range invalid {
+		_, _, _, err := parseLsdAnnounce([]byte(packet))
+		if err == nil {
+			t.Errorf("announce %q accepted", packet)
+		}
+	}
+}
@@ -2,11 +2,17 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -54,17 +60,60 @@ func main() {
 
 		t := Tracker{
 			AnnounceUrl: metaInfo.Announce,
-			PeerId:      "00112233445566778899",
+			PeerId:      NewPeerId(),
 		}
 
-		peers, err := t.getPeers(metaInfo)
+		peers, err := t.getPeers(context.Background(), metaInfo)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
 
 		for _, peer := range peers {
-			fmt.Printf("%s:%d\n", peer.Addr.Ip, peer.Addr.Port)
+			// Only trackers answering in the non-compact form tell peer ids
+			if peer.PeerId != "" {
+				fmt.Printf("%s:%d %s\n", peer.Addr.Ip, peer.Addr.Port, peer.Client())
+			} else {
+				fmt.Printf("%s:%d\n", peer.Addr.Ip, peer.Addr.Port)
+			}
+		}
+
+	case "scrape":
+		if len(os.Args) < 3 {
+			fmt.Println("Please provide at least one torrent file")
+			return
+		}
+
+		infoHashesByTracker := make(map[string][]Hash)
+		trackers := make([]string, 0)
+
+		for _, filePath := range os.Args[2:] {
+			metaInfo, err := decodeMetaInfoFile(filePath)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+
+			if _, ok := infoHashesByTracker[metaInfo.Announce]; !ok {
+				trackers = append(trackers, metaInfo.Announce)
+			}
+
+			infoHashesByTracker[metaInfo.Announce] = append(infoHashesByTracker[metaInfo.Announce], metaInfo.InfoHash)
+		}
+
+		for _, announceUrl := range trackers {
+			t := Tracker{AnnounceUrl: announceUrl}
+
+			results, err := t.Scrape(infoHashesByTracker[announceUrl])
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			fmt.Printf("Tracker URL: %s\n", announceUrl)
+			for _, result := range results {
+				fmt.Printf("%s seeders: %d, leechers: %d, completed: %d\n", result.InfoHash.Hex(), result.Seeders, result.Leechers, result.Completed)
+			}
 		}
 
 	case "handshake":
@@ -90,7 +139,7 @@ func main() {
 		}
 
 		peer := Peer{Addr: addr}
-		conn, err := peer.Connect()
+		conn, err := peer.Connect(defaultConnectTimeout)
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -98,14 +147,31 @@ func main() {
 			peer.Conn = conn
 		}
 
-		err = peer.SendHandshake(metaInfo.InfoHash, "00112233445566778899")
+		defer peer.Disconnect()
+
+		conn.SetDeadline(time.Now().Add(defaultHandshakeTimeout))
+
+		err = peer.SendHandshake(metaInfo.InfoHash, NewPeerId())
 		if err != nil {
 			fmt.Println(err)
+			return
 		}
 
-		defer peer.Disconnect()
+		fmt.Printf("Peer ID: %s\n", hex.EncodeToString([]byte(peer.PeerId)))
 
-		fmt.Printf("Peer ID: %s\n", peer.PeerId)
+		// The client name and version the peer tells in its extended
+		// handshake are more precise than its peer id
+		if peer.SupportsExtensionProtocol() {
+			registry := NewExtensionRegistry()
+			registry.Version = clientVersion
+
+			err = peer.ExchangeExtendedHandshakes(registry)
+			if err != nil {
+				fmt.Println(err)
+			}
+		}
+
+		fmt.Printf("Client: %s\n", peer.Client())
 
 	case "download_piece":
 		outputFile := os.Args[3]
@@ -120,10 +186,10 @@ func main() {
 
 		t := Tracker{
 			AnnounceUrl: metaInfo.Announce,
-			PeerId:      "00112233445566778899",
+			PeerId:      NewPeerId(),
 		}
 
-		peers, err := t.getPeers(metaInfo)
+		peers, err := t.getPeers(context.Background(), metaInfo)
 		if err != nil {
 			fmt.Println(err)
 			return
@@ -134,10 +200,10 @@ func main() {
 			Hash:  metaInfo.Info.Pieces[pieceIndex],
 		}
 
-		d := Downloader{PeerId: "00112233445566778899"}
+		d := Downloader{PeerId: NewPeerId()}
 
 		for _, peer := range peers {
-			piece.Blocks, err = d.downloadPiece(&peer, metaInfo, pieceIndex)
+			piece.Data, err = d.downloadPiece(&peer, metaInfo, pieceIndex)
 			if err != nil {
 				fmt.Println(err)
 			} else {
@@ -146,8 +212,6 @@ func main() {
 			}
 		}
 
-		piece.sortBlocks()
-
 		isValid, _ := piece.checkHash()
 		if !isValid {
 			fmt.Printf("Piece %d is invalid", piece.Index)
@@ -165,8 +229,46 @@ func main() {
 		fmt.Printf("Piece %d downloaded to %s.\n", pieceIndex, outputFile)
 
 	case "download":
-		outputFile := os.Args[3]
-		filePath := os.Args[4]
+		flags := flag.NewFlagSet("download", flag.ExitOnError)
+		outputFile := flags.String("o", "", "output file")
+		peersFile := flags.String("peers-file", "", "file with peer addresses, one ip:port per line")
+		port := flags.Int("port", 6881, "port to accept peers on while downloading, 0 to accept none")
+		uploadSlots := flags.Int("upload-slots", defaultUploadSlots, "peers unchoked for their upload rate to us")
+		optimisticSlots := flags.Int("optimistic-slots", defaultOptimisticSlots, "peers unchoked at random, rotated every 30 seconds")
+		useDht := flags.Bool("dht", false, "find peers in the mainline DHT")
+		udpAddr := flags.String("udp-addr", ":6881", "UDP listen address shared by the DHT and uTP")
+		dhtBootstrap := flags.String("dht-bootstrap", strings.Join(DefaultDHTBootstrapNodes, ","), "comma separated DHT bootstrap nodes")
+		dhtState := flags.String("dht-state", "", "file to keep the DHT routing table in between runs")
+		useLsd := flags.Bool("lsd", false, "find peers on the local network with Local Service Discovery")
+		usePex := flags.Bool("pex", true, "exchange peers with connected peers, never used for private torrents")
+		encryption := flags.String("encryption", "prefer", "message stream encryption: prefer, require or disable")
+		useUtp := flags.Bool("utp", false, "dial peers over uTP alongside TCP, keeping whichever connects first")
+		connectTimeout := flags.Duration("connect-timeout", defaultConnectTimeout, "how long to wait for a peer to accept the connection")
+		handshakeTimeout := flags.Duration("handshake-timeout", defaultHandshakeTimeout, "how long to wait for a peer's handshake")
+		requestTimeout := flags.Duration("request-timeout", defaultRequestTimeout, "how long a block request may stay unserved before the peer counts as snubbing")
+		inactivityTimeout := flags.Duration("inactivity-timeout", defaultInactivityTimeout, "drop peers that send nothing for this long")
+		banList := flags.String("ban-list", "", "file to keep the IPs of peers banned for corrupt data in between runs")
+		ipFilter := NewIPFilter()
+		flags.Func("ip-filter", "blocklist of peer IPs in P2P, DAT or CIDR format, can be repeated", ipFilter.LoadFile)
+		rateLimits := NewRateLimits(0, 0)
+		flags.Func("download-rate", "cap on the torrent's download rate in bytes per second, with a K, M or G suffix for KiB, MiB or GiB, 0 for none", rateFlag(rateLimits.Download))
+		flags.Func("upload-rate", "cap on the torrent's upload rate in bytes per second, with a K, M or G suffix for KiB, MiB or GiB, 0 for none", rateFlag(rateLimits.Upload))
+		flags.Func("global-download-rate", "cap on the download rate of every torrent of the process together, same format as -download-rate", rateFlag(globalRateLimits.Download))
+		flags.Func("global-upload-rate", "cap on the upload rate of every torrent of the process together, same format as -upload-rate", rateFlag(globalRateLimits.Upload))
+		staticPeers := make([]Addr, 0)
+		flags.Func("peer", "peer address ip:port, can be repeated", func(value string) error {
+			addr := Addr{}
+			err := addr.ReadFromString(value)
+			if err != nil {
+				return err
+			}
+
+			staticPeers = append(staticPeers, addr)
+			return nil
+		})
+		flags.Parse(os.Args[2:])
+
+		filePath := flags.Arg(0)
 
 		metaInfo, err := decodeMetaInfoFile(filePath)
 		if err != nil {
@@ -174,15 +276,345 @@ func main() {
 			return
 		}
 
-		d := Downloader{PeerId: "00112233445566778899"}
+		d := Downloader{
+			PeerId:            NewPeerId(),
+			ConnectTimeout:    *connectTimeout,
+			HandshakeTimeout:  *handshakeTimeout,
+			RequestTimeout:    *requestTimeout,
+			InactivityTimeout: *inactivityTimeout,
+			Bans:              NewBanList(*banList),
+			IPFilter:          ipFilter,
+			RateLimits:        rateLimits,
+			GlobalRateLimits:  globalRateLimits,
+		}
+
+		// Peers that upload to us fastest get the upload slots
+		d.Choker = NewChoker(ChokerConfig{
+			UploadSlots:     *uploadSlots,
+			OptimisticSlots: *optimisticSlots,
+		})
+		d.Choker.Start()
+		defer d.Choker.Close()
 
-		err = d.Download(metaInfo, outputFile)
+		if *banList != "" {
+			err = d.Bans.Load()
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+
+		d.Encryption, err = ParseEncryptionPolicy(*encryption)
 		if err != nil {
 			fmt.Println(err)
 			return
 		}
 
-		fmt.Printf("Downloaded %s to %s.\n", filePath, outputFile)
+		if *port != 0 {
+			listener := NewPeerListener(d.PeerId)
+			listener.Encryption = d.Encryption
+			listener.HandshakeTimeout = *handshakeTimeout
+			listener.IPFilter = ipFilter
+			listener.RateLimits = globalRateLimits
+
+			_, err = listener.Listen(fmt.Sprintf(":%d", *port))
+			if err != nil {
+				// The peers we connect to are served all the same
+				fmt.Printf("Not accepting peers: %s\n", err)
+				*port = 0
+			} else {
+				defer listener.Close()
+
+				d.Listener = listener
+				d.Extensions = NewExtensionRegistry()
+				d.Extensions.Version = clientVersion
+				d.Extensions.ListenPort = *port
+				d.Extensions.RequestQueueSize = defaultRequestQueueSize
+			}
+		}
+
+		var trackerSource *TrackerPeerSource
+		if metaInfo.Announce != "" {
+			trackerSource = &TrackerPeerSource{
+				Tracker:  &Tracker{AnnounceUrl: metaInfo.Announce, PeerId: d.PeerId, Port: uint16(*port)},
+				MetaInfo: metaInfo,
+			}
+
+			d.PeerSources = append(d.PeerSources, trackerSource)
+		}
+
+		if len(staticPeers) > 0 {
+			d.PeerSources = append(d.PeerSources, &StaticPeerSource{Addrs: staticPeers})
+		}
+
+		if *peersFile != "" {
+			d.PeerSources = append(d.PeerSources, &FilePeerSource{Path: *peersFile})
+		}
+
+		if *usePex {
+			d.PEX = NewPEX()
+		}
+
+		if *useUtp {
+			d.UTP, err = ListenUTP(*udpAddr)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+
+			defer d.UTP.Close()
+		}
+
+		if *useDht {
+			dhtConfig := DHTConfig{
+				ListenAddr:     *udpAddr,
+				BootstrapNodes: strings.Split(*dhtBootstrap, ","),
+				StatePath:      *dhtState,
+			}
+
+			if d.UTP != nil {
+				dhtConfig.Conn = d.UTP.PacketConn()
+			}
+
+			dht := NewDHT(dhtConfig)
+
+			err = dht.Start()
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+
+			defer dht.Close()
+
+			for _, node := range metaInfo.Nodes {
+				dht.AddNode(node)
+			}
+
+			// Without a port the DHT only looks peers up, announce_peer would
+			// send peers to a port nobody listens on
+			d.PeerSources = append(d.PeerSources, &DHTPeerSource{DHT: dht, InfoHash: metaInfo.InfoHash, Port: *port})
+		}
+
+		if *useLsd {
+			// Without a port we only listen for the peers announcing on the
+			// LAN and never announce ourselves
+			lsd := NewLSD(LSDConfig{Port: *port})
+
+			err = lsd.Start()
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+
+			defer lsd.Close()
+
+			d.PeerSources = append(d.PeerSources, &LSDPeerSource{LSD: lsd, InfoHash: metaInfo.InfoHash})
+		}
+
+		// A dead tracker is worth waiting for only while other sources look
+		// for peers too
+		if trackerSource != nil {
+			trackerSource.KeepRetrying = len(d.PeerSources) > 1
+		}
+
+		err = d.Download(metaInfo, *outputFile)
+
+		stats := d.Stats()
+		if stats.Uploaded > 0 {
+			fmt.Printf("Uploaded %d bytes\n", stats.Uploaded)
+		}
+
+		if stats.HashFailures > 0 || len(stats.Banned) > 0 {
+			fmt.Printf("Pieces failing the hash check: %d\n", stats.HashFailures)
+
+			for _, banned := range stats.Banned {
+				fmt.Printf("Banned %s since %s: %s\n", banned.Ip, banned.At.Format(time.DateTime), banned.Reason)
+			}
+		}
+
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		fmt.Printf("Downloaded %s to %s.\n", filePath, *outputFile)
+
+	case "seed":
+		flags := flag.NewFlagSet("seed", flag.ExitOnError)
+		port := flags.Int("port", 6881, "port to accept peers on")
+		encryption := flags.String("encryption", "prefer", "message stream encryption: prefer, require or disable")
+		useUtp := flags.Bool("utp", false, "accept peers over uTP on the same port too")
+		uploadSlots := flags.Int("upload-slots", defaultUploadSlots, "peers unchoked for their download rate")
+		optimisticSlots := flags.Int("optimistic-slots", defaultOptimisticSlots, "peers unchoked at random, rotated every 30 seconds")
+		handshakeTimeout := flags.Duration("handshake-timeout", defaultListenerHandshakeTimeout, "how long to wait for an inbound peer's handshakes")
+		inactivityTimeout := flags.Duration("inactivity-timeout", defaultInactivityTimeout, "drop peers that send nothing for this long")
+		ipFilter := NewIPFilter()
+		flags.Func("ip-filter", "blocklist of peer IPs in P2P, DAT or CIDR format, can be repeated", ipFilter.LoadFile)
+		rateLimits := NewRateLimits(0, 0)
+		flags.Func("download-rate", "cap on the torrent's download rate in bytes per second, with a K, M or G suffix for KiB, MiB or GiB, 0 for none", rateFlag(rateLimits.Download))
+		flags.Func("upload-rate", "cap on the torrent's upload rate in bytes per second, with a K, M or G suffix for KiB, MiB or GiB, 0 for none", rateFlag(rateLimits.Upload))
+		flags.Func("global-download-rate", "cap on the download rate of every torrent of the process together, same format as -download-rate", rateFlag(globalRateLimits.Download))
+		flags.Func("global-upload-rate", "cap on the upload rate of every torrent of the process together, same format as -upload-rate", rateFlag(globalRateLimits.Upload))
+		flags.Parse(os.Args[2:])
+
+		if flags.NArg() < 2 {
+			fmt.Println("Please provide the torrent file and the path of its data")
+			return
+		}
+
+		filePath := flags.Arg(0)
+		dataPath := flags.Arg(1)
+
+		metaInfo, err := decodeMetaInfoFile(filePath)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		storage, err := OpenStorage(metaInfo, dataPath)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		defer storage.Close()
+
+		seeder := NewSeeder(metaInfo, storage)
+		seeder.Extensions = NewExtensionRegistry()
+		seeder.Extensions.Version = clientVersion
+		seeder.Extensions.ListenPort = *port
+		seeder.Extensions.RequestQueueSize = defaultRequestQueueSize
+		seeder.InactivityTimeout = *inactivityTimeout
+		seeder.RateLimits = rateLimits
+
+		fmt.Printf("Verified %d/%d pieces of %s\n", seeder.Verify(), len(metaInfo.Info.Pieces), dataPath)
+
+		// The seeder only uploads, even with part of the data nobody sends us
+		// blocks to rank peers by
+		seeder.Choker = NewChoker(ChokerConfig{
+			UploadSlots:     *uploadSlots,
+			OptimisticSlots: *optimisticSlots,
+			Seeding:         true,
+		})
+		seeder.Choker.Start()
+		defer seeder.Choker.Close()
+
+		listener := NewPeerListener(NewPeerId())
+		listener.HandshakeTimeout = *handshakeTimeout
+		listener.IPFilter = ipFilter
+		listener.RateLimits = globalRateLimits
+
+		listener.Encryption, err = ParseEncryptionPolicy(*encryption)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		listener.Register(metaInfo.InfoHash, seeder)
+
+		listenAddr := fmt.Sprintf(":%d", *port)
+
+		addr, err := listener.Listen(listenAddr)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		defer listener.Close()
+
+		if *useUtp {
+			utpSocket, err := ListenUTP(listenAddr)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+
+			defer utpSocket.Close()
+
+			go listener.Serve(utpSocket)
+		}
+
+		fmt.Printf("Seeding %s on %s\n", metaInfo.Info.Name, addr)
+
+		if metaInfo.Announce != "" {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			source := &TrackerPeerSource{
+				Tracker: &Tracker{
+					AnnounceUrl: metaInfo.Announce,
+					PeerId:      listener.PeerId,
+					Port:        uint16(*port),
+					Seeding:     seeder.IsComplete(),
+				},
+				MetaInfo:     metaInfo,
+				KeepRetrying: true,
+			}
+
+			// Announcing makes us known to the swarm, the peers we get back
+			// connect to us on their own
+			go func() {
+				for range discoverPeers(ctx, []PeerSource{source}) {
+				}
+			}()
+		}
+
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+
+		fmt.Printf("Uploaded %d bytes\n", seeder.Uploaded())
+
+	case "tracker":
+		flags := flag.NewFlagSet("tracker", flag.ExitOnError)
+		httpAddr := flags.String("http", ":6969", "HTTP tracker listen address, empty to disable")
+		udpAddr := flags.String("udp", ":6969", "UDP tracker listen address, empty to disable")
+		interval := flags.Duration("interval", 30*time.Minute, "announce interval")
+		minInterval := flags.Duration("min-interval", 0, "minimum announce interval")
+		peerTTL := flags.Duration("peer-ttl", 0, "time after which silent peers are dropped")
+		allowlist := flags.String("allow", "", "file with allowed info hashes, one hex hash per line")
+		statePath := flags.String("state", "", "file to persist swarms to, in-memory only if empty")
+		flags.Parse(os.Args[2:])
+
+		config := TrackerServerConfig{
+			HttpAddr:    *httpAddr,
+			UdpAddr:     *udpAddr,
+			Interval:    *interval,
+			MinInterval: *minInterval,
+			PeerTTL:     *peerTTL,
+			StatePath:   *statePath,
+		}
+
+		if *allowlist != "" {
+			allowed, err := loadInfoHashAllowlist(*allowlist)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+
+			config.AllowedInfoHashes = allowed
+		}
+
+		server, err := NewTrackerServer(config)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		err = server.Start()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+
+		err = server.Close()
+		if err != nil {
+			fmt.Println(err)
+		}
 
 	default:
 		fmt.Println("Unknown command: " + command)
@@ -6,13 +6,16 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"io"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 )
 
 type TorrentFileInfoFile struct {
-	Length int    `json:"length"`
-	Path   string `json:"path"`
+	Length int `json:"length"`
+	// Path components below the torrent's directory
+	Path []string `json:"path"`
 }
 
 type TorrentFileInfo struct {
@@ -21,6 +24,9 @@ type TorrentFileInfo struct {
 	Name        string                `json:"name"`
 	PieceLength int                   `json:"piece length"`
 	Pieces      []Hash                `json:"omitempty"`
+	Private     int                   `json:"private"`
+	// Set for torrents with a files list, whose files live in a directory
+	MultiFile bool `json:"-"`
 }
 
 type TorrentMetaInfo struct {
@@ -30,6 +36,8 @@ type TorrentMetaInfo struct {
 	CreatedBy string          `json:"created by"`
 	Encoding  string          `json:"encoding"`
 	InfoHash  Hash
+	// DHT nodes as host:port for trackerless torrents
+	Nodes []string `json:"-"`
 }
 
 type Hash struct {
@@ -113,9 +121,31 @@ func decodeMetaInfoFile(path string) (TorrentMetaInfo, error) {
 	torrentFile.InfoHash = calculateInfoHash([]byte(encodedInfo))
 	torrentFile.Info.Pieces = decodePiecesHash(info["pieces"].(string))
 
+	if nodes, ok := dataAsMap["nodes"].([]any); ok {
+		for _, node := range nodes {
+			hostPort, ok := node.([]any)
+			if !ok || len(hostPort) != 2 {
+				continue
+			}
+
+			host, hostOk := hostPort[0].(string)
+			port, portOk := hostPort[1].(int)
+			if hostOk && portOk {
+				torrentFile.Nodes = append(torrentFile.Nodes, net.JoinHostPort(host, strconv.Itoa(port)))
+			}
+		}
+	}
+
 	if len(torrentFile.Info.Files) == 0 {
-		file := TorrentFileInfoFile{Path: torrentFile.Info.Name, Length: torrentFile.Info.Length}
+		file := TorrentFileInfoFile{Path: []string{torrentFile.Info.Name}, Length: torrentFile.Info.Length}
 		torrentFile.Info.Files = []TorrentFileInfoFile{file}
+	} else {
+		torrentFile.Info.MultiFile = true
+		torrentFile.Info.Length = 0
+
+		for _, file := range torrentFile.Info.Files {
+			torrentFile.Info.Length += file.Length
+		}
 	}
 
 	return torrentFile, nil
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+type EncryptionPolicy int
+
+const (
+	// Try Message Stream Encryption first and fall back to plaintext
+	EncryptionPrefer EncryptionPolicy = iota
+	// Only talk to peers over RC4 encrypted connections
+	EncryptionRequire
+	// Never encrypt, inbound encrypted connections are refused
+	EncryptionDisable
+)
+
+func ParseEncryptionPolicy(str string) (EncryptionPolicy, error) {
+	switch str {
+	case "prefer":
+		return EncryptionPrefer, nil
+	case "require":
+		return EncryptionRequire, nil
+	case "disable":
+		return EncryptionDisable, nil
+	default:
+		return 0, fmt.Errorf("unknown encryption policy %s", str)
+	}
+}
+
+const (
+	mseCryptoPlaintext = 0x01
+	mseCryptoRC4       = 0x02
+
+	mseKeySize           = 96
+	mseMaxPadding        = 512
+	mseHandshakeTimeout  = 10 * time.Second
+	mseRC4DiscardedBytes = 1024
+)
+
+var (
+	msePrime, _    = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	mseGenerator   = big.NewInt(2)
+	mseVC          = make([]byte, 8)
+	btProtocolName = []byte("\x13BitTorrent protocol")
+
+	ErrMSENegotiation = errors.New("message stream encryption negotiation failed")
+)
+
+// mseConn carries the peer wire protocol after the MSE handshake. With RC4
+// selected both directions are encrypted, with plaintext selected the
+// connection is used as is. Data the handshake already consumed and
+// decrypted is returned by Read first.
+type mseConn struct {
+	net.Conn
+	plain   []byte
+	encrypt *rc4.Cipher
+	decrypt *rc4.Cipher
+}
+
+func (c *mseConn) Read(b []byte) (int, error) {
+	if len(c.plain) > 0 {
+		n := copy(b, c.plain)
+		c.plain = c.plain[n:]
+		return n, nil
+	}
+
+	n, err := c.Conn.Read(b)
+	if c.decrypt != nil && n > 0 {
+		c.decrypt.XORKeyStream(b[:n], b[:n])
+	}
+
+	return n, err
+}
+
+func (c *mseConn) Write(b []byte) (int, error) {
+	if c.encrypt == nil {
+		return c.Conn.Write(b)
+	}
+
+	encrypted := make([]byte, len(b))
+	c.encrypt.XORKeyStream(encrypted, b)
+
+	return c.Conn.Write(encrypted)
+}
+
+type mseKeys struct {
+	private *big.Int
+	public  []byte
+}
+
+func newMseKeys() (mseKeys, error) {
+	privateBytes := make([]byte, 20)
+	_, err := rand.Read(privateBytes)
+	if err != nil {
+		return mseKeys{}, err
+	}
+
+	private := new(big.Int).SetBytes(privateBytes)
+	public := new(big.Int).Exp(mseGenerator, private, msePrime)
+
+	return mseKeys{private: private, public: padKey(public.Bytes())}, nil
+}
+
+func (k mseKeys) sharedSecret(remotePublic []byte) []byte {
+	remote := new(big.Int).SetBytes(remotePublic)
+	secret := new(big.Int).Exp(remote, k.private, msePrime)
+
+	return padKey(secret.Bytes())
+}
+
+func padKey(key []byte) []byte {
+	padded := make([]byte, mseKeySize)
+	copy(padded[mseKeySize-len(key):], key)
+
+	return padded
+}
+
+func mseHash(parts ...[]byte) []byte {
+	hasher := sha1.New()
+	for _, part := range parts {
+		hasher.Write(part)
+	}
+
+	return hasher.Sum(nil)
+}
+
+func mseCipher(name string, secret []byte, skey Hash) (*rc4.Cipher, error) {
+	cipher, err := rc4.NewCipher(mseHash([]byte(name), secret, skey.Hash))
+	if err != nil {
+		return nil, err
+	}
+
+	discard := make([]byte, mseRC4DiscardedBytes)
+	cipher.XORKeyStream(discard, discard)
+
+	return cipher, nil
+}
+
+func randomPadding() ([]byte, error) {
+	sizeBuf := make([]byte, 2)
+	_, err := rand.Read(sizeBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	padding := make([]byte, int(binary.BigEndian.Uint16(sizeBuf))%(mseMaxPadding+1))
+	_, err = rand.Read(padding)
+
+	return padding, err
+}
+
+// readUntil consumes r up to and including pattern, giving up when pattern
+// doesn't show up within limit bytes
+func readUntil(r io.Reader, pattern []byte, limit int) error {
+	window := make([]byte, 0, limit+len(pattern))
+	buf := make([]byte, 1)
+
+	for len(window) < limit+len(pattern) {
+		_, err := io.ReadFull(r, buf)
+		if err != nil {
+			return err
+		}
+
+		window = append(window, buf[0])
+
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: synchronisation pattern not found", ErrMSENegotiation)
+}
+
+// mseHandshakeDeadline is when the MSE handshake gives up,
+// mseHandshakeTimeout from now unless the caller's deadline comes first
+func mseHandshakeDeadline(deadline time.Time) time.Time {
+	handshakeDeadline := time.Now().Add(mseHandshakeTimeout)
+	if !deadline.IsZero() && deadline.Before(handshakeDeadline) {
+		return deadline
+	}
+
+	return handshakeDeadline
+}
+
+// mseInitiate runs the outgoing side of the MSE handshake on conn with the
+// info hash as the shared key. cryptoProvide is a mask of the methods we
+// accept, the peer picks one of them. deadline is the one the caller set on
+// conn, zero for none, it is set again once the handshake is done.
+func mseInitiate(conn net.Conn, deadline time.Time, skey Hash, cryptoProvide uint32) (net.Conn, error) {
+	conn.SetDeadline(mseHandshakeDeadline(deadline))
+	defer conn.SetDeadline(deadline)
+
+	keys, err := newMseKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	padA, err := randomPadding()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(append(append([]byte{}, keys.public...), padA...))
+	if err != nil {
+		return nil, err
+	}
+
+	remotePublic := make([]byte, mseKeySize)
+	_, err = io.ReadFull(conn, remotePublic)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := keys.sharedSecret(remotePublic)
+
+	encrypt, err := mseCipher("keyA", secret, skey)
+	if err != nil {
+		return nil, err
+	}
+
+	decrypt, err := mseCipher("keyB", secret, skey)
+	if err != nil {
+		return nil, err
+	}
+
+	req2 := mseHash([]byte("req2"), skey.Hash)
+	req3 := mseHash([]byte("req3"), secret)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+
+	// VC, crypto_provide, len(PadC) and len(IA), both paddings empty
+	plain := make([]byte, 8+4+2+2)
+	binary.BigEndian.PutUint32(plain[8:12], cryptoProvide)
+
+	encrypted := make([]byte, len(plain))
+	encrypt.XORKeyStream(encrypted, plain)
+
+	msg := mseHash([]byte("req1"), secret)
+	msg = append(msg, req2...)
+	msg = append(msg, encrypted...)
+
+	_, err = conn.Write(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The peer's answer starts with an encrypted VC somewhere after PadB
+	encryptedVC := make([]byte, len(mseVC))
+	decrypt.XORKeyStream(encryptedVC, mseVC)
+
+	err = readUntil(conn, encryptedVC, mseMaxPadding)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 4+2)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(header, header)
+
+	cryptoSelect := binary.BigEndian.Uint32(header[0:4])
+	padDLength := int(binary.BigEndian.Uint16(header[4:6]))
+
+	if padDLength > mseMaxPadding {
+		return nil, fmt.Errorf("%w: padding too long", ErrMSENegotiation)
+	}
+
+	padD := make([]byte, padDLength)
+	_, err = io.ReadFull(conn, padD)
+	if err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(padD, padD)
+
+	switch {
+	case cryptoSelect == mseCryptoRC4 && cryptoProvide&mseCryptoRC4 != 0:
+		return &mseConn{Conn: conn, encrypt: encrypt, decrypt: decrypt}, nil
+	case cryptoSelect == mseCryptoPlaintext && cryptoProvide&mseCryptoPlaintext != 0:
+		return &mseConn{Conn: conn}, nil
+	default:
+		return nil, fmt.Errorf("%w: peer selected crypto method %d", ErrMSENegotiation, cryptoSelect)
+	}
+}
+
+// mseAccept runs the incoming side of the handshake. Peers that start with a
+// plaintext BitTorrent handshake are let through unless encryption is
+// required. For encrypted connections the info hash the peer used as key is
+// looked up among infoHashes and returned. The caller's deadline is kept as
+// for mseInitiate.
+func mseAccept(conn net.Conn, deadline time.Time, infoHashes []Hash, policy EncryptionPolicy) (net.Conn, *Hash, error) {
+	conn.SetDeadline(mseHandshakeDeadline(deadline))
+	defer conn.SetDeadline(deadline)
+
+	start := make([]byte, len(btProtocolName))
+	_, err := io.ReadFull(conn, start)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if bytes.Equal(start, btProtocolName) {
+		if policy == EncryptionRequire {
+			return nil, nil, fmt.Errorf("%w: plaintext connection refused", ErrMSENegotiation)
+		}
+
+		return &mseConn{Conn: conn, plain: start}, nil, nil
+	}
+
+	if policy == EncryptionDisable {
+		return nil, nil, fmt.Errorf("%w: encrypted connection refused", ErrMSENegotiation)
+	}
+
+	remotePublic := make([]byte, mseKeySize)
+	copy(remotePublic, start)
+	_, err = io.ReadFull(conn, remotePublic[len(start):])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys, err := newMseKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	padB, err := randomPadding()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	_, err = conn.Write(append(append([]byte{}, keys.public...), padB...))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret := keys.sharedSecret(remotePublic)
+
+	err = readUntil(conn, mseHash([]byte("req1"), secret), mseMaxPadding)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	skeyHash := make([]byte, 20)
+	_, err = io.ReadFull(conn, skeyHash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req3 := mseHash([]byte("req3"), secret)
+
+	var skey *Hash
+	for _, infoHash := range infoHashes {
+		req2 := mseHash([]byte("req2"), infoHash.Hash)
+		for i := range req2 {
+			req2[i] ^= req3[i]
+		}
+
+		if bytes.Equal(req2, skeyHash) {
+			infoHash := infoHash
+			skey = &infoHash
+			break
+		}
+	}
+
+	if skey == nil {
+		return nil, nil, fmt.Errorf("%w: unknown info hash", ErrMSENegotiation)
+	}
+
+	decrypt, err := mseCipher("keyA", secret, *skey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encrypt, err := mseCipher("keyB", secret, *skey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	header := make([]byte, 8+4+2)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	decrypt.XORKeyStream(header, header)
+
+	if !bytes.Equal(header[0:8], mseVC) {
+		return nil, nil, fmt.Errorf("%w: bad verification constant", ErrMSENegotiation)
+	}
+
+	cryptoProvide := binary.BigEndian.Uint32(header[8:12])
+	padCLength := int(binary.BigEndian.Uint16(header[12:14]))
+
+	if padCLength > mseMaxPadding {
+		return nil, nil, fmt.Errorf("%w: padding too long", ErrMSENegotiation)
+	}
+
+	padC := make([]byte, padCLength+2)
+	_, err = io.ReadFull(conn, padC)
+	if err != nil {
+		return nil, nil, err
+	}
+	decrypt.XORKeyStream(padC, padC)
+
+	initialPayload := make([]byte, int(binary.BigEndian.Uint16(padC[padCLength:])))
+	_, err = io.ReadFull(conn, initialPayload)
+	if err != nil {
+		return nil, nil, err
+	}
+	decrypt.XORKeyStream(initialPayload, initialPayload)
+
+	var cryptoSelect uint32
+	switch {
+	case cryptoProvide&mseCryptoRC4 != 0:
+		cryptoSelect = mseCryptoRC4
+	case cryptoProvide&mseCryptoPlaintext != 0 && policy != EncryptionRequire:
+		cryptoSelect = mseCryptoPlaintext
+	default:
+		return nil, nil, fmt.Errorf("%w: no acceptable crypto method in %d", ErrMSENegotiation, cryptoProvide)
+	}
+
+	// VC, crypto_select and an empty PadD
+	reply := make([]byte, 8+4+2)
+	binary.BigEndian.PutUint32(reply[8:12], cryptoSelect)
+	encrypt.XORKeyStream(reply, reply)
+
+	_, err = conn.Write(reply)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The initial payload was sent encrypted either way
+	if cryptoSelect == mseCryptoPlaintext {
+		return &mseConn{Conn: conn, plain: initialPayload}, skey, nil
+	}
+
+	return &mseConn{Conn: conn, plain: initialPayload, encrypt: encrypt, decrypt: decrypt}, skey, nil
+}
@@ -7,7 +7,6 @@ import (
 	"io"
 	"net"
 	"strconv"
-	"strings"
 )
 
 type Addr struct {
@@ -16,11 +15,18 @@ type Addr struct {
 }
 
 func (a *Addr) ReadFromBytes(b []byte) error {
-	if len(b) != 6 {
+	var ipSize int
+
+	switch len(b) {
+	case 6:
+		ipSize = net.IPv4len
+	case 18:
+		ipSize = net.IPv6len
+	default:
 		return fmt.Errorf("incorrect address size")
 	}
 
-	ipBuff := make([]byte, 4)
+	ipBuff := make([]byte, ipSize)
 	portBuff := make([]byte, 2)
 
 	reader := bytes.NewReader(b)
@@ -28,15 +34,28 @@ func (a *Addr) ReadFromBytes(b []byte) error {
 	reader.Read(ipBuff)
 	reader.Read(portBuff)
 
-	a.Ip = net.IP{ipBuff[0], ipBuff[1], ipBuff[2], ipBuff[3]}
+	a.Ip = net.IP(ipBuff)
 	a.Port = binary.BigEndian.Uint16(portBuff)
 
 	return nil
 }
 
+func (a *Addr) ToBytes() []byte {
+	ip := a.Ip.To4()
+	if ip == nil {
+		ip = a.Ip.To16()
+	}
+
+	buf := make([]byte, len(ip)+2)
+	copy(buf, ip)
+	binary.BigEndian.PutUint16(buf[len(ip):], a.Port)
+
+	return buf
+}
+
 func (a *Addr) ReadFromString(str string) error {
-	ip, port, ok := strings.Cut(str, ":")
-	if !ok {
+	ip, port, err := net.SplitHostPort(str)
+	if err != nil {
 		return fmt.Errorf("unexpected address format")
 	}
 
@@ -46,32 +65,44 @@ func (a *Addr) ReadFromString(str string) error {
 	}
 
 	a.Ip = net.ParseIP(ip)
+	if a.Ip == nil {
+		return fmt.Errorf("unexpected ip address %s", ip)
+	}
+
 	a.Port = uint16(portStr)
 
 	return nil
 }
 
 func (a *Addr) ToString() string {
-	return fmt.Sprintf("%s:%d", a.Ip, a.Port)
+	return net.JoinHostPort(a.Ip.String(), strconv.Itoa(int(a.Port)))
 }
 
-func readBytes(r io.Reader, n int) ([]byte, error) {
-	result := make([]byte, 0)
-	needToRead := n
-	for {
-		buff := make([]byte, needToRead)
-		readed, err := r.Read(buff)
+func decodeCompactAddrs(data []byte, addrSize int) ([]Addr, error) {
+	if len(data)%addrSize != 0 {
+		return nil, fmt.Errorf("incorrect compact addresses length %d", len(data))
+	}
+
+	addrs := make([]Addr, 0, len(data)/addrSize)
+	for offset := 0; offset < len(data); offset += addrSize {
+		addr := Addr{}
+		err := addr.ReadFromBytes(data[offset : offset+addrSize])
 		if err != nil {
 			return nil, err
 		}
 
-		result = append(result, buff[:readed]...)
+		addrs = append(addrs, addr)
+	}
 
-		if readed < needToRead {
-			needToRead -= readed
-		} else {
-			break
-		}
+	return addrs, nil
+}
+
+func readBytes(r io.Reader, n int) ([]byte, error) {
+	result := make([]byte, n)
+
+	_, err := io.ReadFull(r, result)
+	if err != nil {
+		return nil, err
 	}
 
 	return result, nil
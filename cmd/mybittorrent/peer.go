@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"net"
-	"sort"
 	"time"
 )
 
@@ -23,6 +25,31 @@ const (
 	MsgIdRequest       peerMsgId = 6
 	MsgIdPiece         peerMsgId = 7
 	MsgIdCancel        peerMsgId = 8
+	MsgIdPort          peerMsgId = 9
+	MsgIdSuggestPiece  peerMsgId = 13
+	MsgIdHaveAll       peerMsgId = 14
+	MsgIdHaveNone      peerMsgId = 15
+	MsgIdRejectRequest peerMsgId = 16
+	MsgIdAllowedFast   peerMsgId = 17
+	MsgIdExtended      peerMsgId = 20
+)
+
+// Pieces are requested in blocks of this size
+const blockSize = 16 * 1024
+
+const (
+	protocolString  = "BitTorrent protocol"
+	handshakeLength = 49 + len(protocolString)
+)
+
+var ErrInvalidHandshake = errors.New("invalid handshake")
+
+// Reserved handshake bits, as byte index and mask
+const (
+	reservedExtensionByte = 5
+	reservedExtensionBit  = 0x10
+	reservedFastByte      = 7
+	reservedFastBit       = 0x04
 )
 
 type Peer struct {
@@ -30,6 +57,17 @@ type Peer struct {
 	Conn       net.Conn
 	PeerId     string
 	HavePieces PiecesMap
+	Reserved   [8]byte
+	Extensions PeerExtensions
+	// Pieces the peer lets us request while it chokes us
+	AllowedFast map[int]bool
+	// Pieces the peer suggested we download from it
+	Suggested []int
+	// The peer connected to us, its port is the one it dialed from
+	Inbound bool
+
+	// Messages go through the session once the connection has one
+	session *PeerConn
 }
 
 type PeerMsg struct {
@@ -44,9 +82,9 @@ type PieceBlock struct {
 }
 
 type Piece struct {
-	Blocks []PieceBlock
-	Hash   Hash
-	Index  int
+	Data  []byte
+	Hash  Hash
+	Index int
 }
 
 type PiecesMap struct {
@@ -88,27 +126,29 @@ func (bm PiecesMap) hasPiece(i int) bool {
 	return bm.PiecesStatus[i]
 }
 
-func (p *Piece) sortBlocks() {
-	sort.Slice(p.Blocks[:], func(i, j int) bool {
-		return p.Blocks[i].Begin < p.Blocks[j].Begin
-	})
+func (bm PiecesMap) isComplete() bool {
+	for _, have := range bm.PiecesStatus {
+		if !have {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (p *Piece) checkHash() (bool, error) {
 	hasher := sha1.New()
 
-	for _, b := range p.Blocks {
-		_, err := hasher.Write(b.Block)
-		if err != nil {
-			return false, err
-		}
+	_, err := hasher.Write(p.Data)
+	if err != nil {
+		return false, err
 	}
 
 	return hex.EncodeToString(hasher.Sum(nil)) == p.Hash.Hex(), nil
 }
 
-func (p *Peer) Connect() (net.Conn, error) {
-	return net.DialTimeout("tcp4", p.Addr.ToString(), 5*time.Second)
+func (p *Peer) Connect(timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", p.Addr.ToString(), timeout)
 }
 
 func (p *Peer) isConnected() bool {
@@ -125,18 +165,23 @@ func (p *Peer) Disconnect() error {
 	return nil
 }
 
+// SendHandshake exchanges the handshakes with the peer. The reply must be for
+// the same torrent, and come from the peer id we expect when Peer.PeerId is
+// already set, such as from a tracker.
 func (p *Peer) SendHandshake(infoHash Hash, peerId string) error {
 	handshakeReq := Handshake{
 		InfoHash: infoHash,
 		PeerId:   peerId,
 	}
+	handshakeReq.Reserved[reservedExtensionByte] |= reservedExtensionBit
+	handshakeReq.Reserved[reservedFastByte] |= reservedFastBit
 
 	_, err := p.Conn.Write(handshakeReq.toBytes())
 	if err != nil {
 		return err
 	}
 
-	resp, err := readBytes(p.Conn, 68)
+	resp, err := readBytes(p.Conn, handshakeLength)
 	if err != nil {
 		return err
 	}
@@ -146,13 +191,30 @@ func (p *Peer) SendHandshake(infoHash Hash, peerId string) error {
 		return err
 	}
 
+	if !bytes.Equal(respHandshake.InfoHash.Hash, infoHash.Hash) {
+		return fmt.Errorf("%w: info hash %s instead of %s", ErrInvalidHandshake, respHandshake.InfoHash.Hex(), infoHash.Hex())
+	}
+
+	if p.PeerId != "" && respHandshake.PeerId != p.PeerId {
+		return fmt.Errorf("%w: peer id %x instead of %x", ErrInvalidHandshake, respHandshake.PeerId, p.PeerId)
+	}
+
+	if respHandshake.PeerId == peerId {
+		return ErrSelfConnection
+	}
+
 	p.PeerId = respHandshake.PeerId
+	p.Reserved = respHandshake.Reserved
 
 	return nil
 }
 
-func (p *Peer) SendIntrested() error {
-	return p.WriteMessage(PeerMsg{MsgId: int(MsgIdInterested)})
+func (p *Peer) SupportsExtensionProtocol() bool {
+	return p.Reserved[reservedExtensionByte]&reservedExtensionBit != 0
+}
+
+func (p *Peer) SupportsFastExtension() bool {
+	return p.Reserved[reservedFastByte]&reservedFastBit != 0
 }
 
 func (p *Peer) CalculatePieceLength(fileLength int, pieceLength int, pieceIndex int) int {
@@ -162,87 +224,63 @@ func (p *Peer) CalculatePieceLength(fileLength int, pieceLength int, pieceIndex
 	return min(left, pieceLength)
 }
 
-func (p *Peer) SendPieceBlocksRequests(pieceIndex int, pieceLength int) (int, error) {
-	blockSize := 16 * 1024
-	blocksRequested := 0
-
-	for bytesToRequest := pieceLength; bytesToRequest > 0; bytesToRequest -= blockSize {
-
-		msgPayload := make([]byte, 4*3)
-		binary.BigEndian.PutUint32(msgPayload, uint32(pieceIndex))                         // piece index
-		binary.BigEndian.PutUint32(msgPayload[4:], uint32(blockSize*blocksRequested))      // block offset
-		binary.BigEndian.PutUint32(msgPayload[8:], uint32(min(blockSize, bytesToRequest))) // block length
-		blocksRequested += 1
-
-		msg := PeerMsg{MsgId: int(MsgIdRequest), Payload: msgPayload}
-
-		err := p.WriteMessage(msg)
-		if err != nil {
-			return blocksRequested, err
-		}
-	}
-
-	return blocksRequested, nil
+func (p *Peer) SendBlockRequest(pieceIndex int, begin int, length int) error {
+	return p.WriteMessage(RequestMessage{BlockRequest{Index: pieceIndex, Begin: begin, Length: length}})
 }
 
-func (p *Peer) ReceivePieceBlocks(blocksExpected int) ([]PieceBlock, error) {
-	pieceBlocks := make([]PieceBlock, 0)
-
-	for i := 0; i < blocksExpected; i++ {
-		msg, err := p.ReadMessage()
-		if err != nil {
-			return nil, err
-		}
-
-		if msg.MsgId == int(MsgIdPiece) {
-			block, err := msg.PieceBlock()
-			if err != nil {
-				return nil, err
-			}
-
-			pieceBlocks = append(pieceBlocks, block)
-		} else {
-			return nil, fmt.Errorf("undexpected message id %d", msg.MsgId)
-		}
-	}
-
-	return pieceBlocks, nil
+func (p *Peer) SendCancel(req BlockRequest) error {
+	return p.WriteMessage(CancelMessage{req})
 }
 
-func (p *Peer) ReadMessage() (PeerMsg, error) {
-	msgLengthBuff, err := readBytes(p.Conn, 4)
+// readMessage reads the next raw message, messages longer than
+// maxMessageLength are an error
+func readMessage(r io.Reader) (PeerMsg, error) {
+	msgLengthBuff := make([]byte, 4)
+	_, err := io.ReadFull(r, msgLengthBuff)
 	if err != nil {
 		return PeerMsg{}, err
 	}
 
-	msgLength := int(binary.BigEndian.Uint32(msgLengthBuff))
+	msgLength := binary.BigEndian.Uint32(msgLengthBuff)
 
 	if msgLength == 0 {
 		return PeerMsg{MsgId: int(MsgIdKeepAlive)}, nil
 	}
 
-	msgIdBuff, err := readBytes(p.Conn, 1)
-	if err != nil {
-		return PeerMsg{}, err
+	if msgLength > maxMessageLength {
+		return PeerMsg{}, fmt.Errorf("%w: message of %d bytes", ErrInvalidMessage, msgLength)
 	}
 
-	payloadBuff := make([]byte, 0)
-	if msgLength > 1 {
-		payloadBuff, err = readBytes(p.Conn, msgLength-1)
-		if err != nil {
-			return PeerMsg{}, err
-		}
+	buff := make([]byte, msgLength)
+	_, err = io.ReadFull(r, buff)
+	if err != nil {
+		return PeerMsg{}, err
 	}
 
 	msg := PeerMsg{
-		MsgId:   int(msgIdBuff[0]),
-		Payload: payloadBuff,
+		MsgId:   int(buff[0]),
+		Payload: buff[1:],
 	}
 
 	return msg, nil
 }
 
-func (p *Peer) WriteMessage(msc PeerMsg) error {
+// WriteMessage sends a message to the peer, or queues it when the connection
+// runs a session
+func (p *Peer) WriteMessage(msg Message) error {
+	if p.session != nil {
+		return p.session.Send(msg)
+	}
+
+	return writeMessage(p.Conn, msg.Encode())
+}
+
+func writeMessage(w io.Writer, msc PeerMsg) error {
+	if msc.MsgId == int(MsgIdKeepAlive) {
+		_, err := w.Write(make([]byte, 4))
+		return err
+	}
+
 	msgLen := len(msc.Payload) + 1
 	buf := make([]byte, 5)
 
@@ -253,50 +291,45 @@ func (p *Peer) WriteMessage(msc PeerMsg) error {
 		buf = append(buf, msc.Payload...)
 	}
 
-	_, err := p.Conn.Write(buf)
+	_, err := w.Write(buf)
 
 	return err
 
 }
 
-func (msg PeerMsg) PieceBlock() (PieceBlock, error) {
-	block := PieceBlock{}
-	if msg.MsgId != 7 {
-		return block, fmt.Errorf("wrong msg-id for piece block - %d", msg.MsgId)
-	}
-
-	block.Index = int(binary.BigEndian.Uint32(msg.Payload[:4]))
-	block.Begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
-	block.Block = msg.Payload[8:]
-
-	return block, nil
-}
-
 type Handshake struct {
+	Reserved [8]byte
 	InfoHash Hash
 	PeerId   string
 }
 
 func (h *Handshake) toBytes() []byte {
-	buf := make([]byte, 1)
-	buf[0] = 19 // length of the protocol
-	buf = append(buf, []byte("BitTorrent protocol")...)
-	buf = append(buf, make([]byte, 8)...) // eight reserved bytes
+	buf := make([]byte, 1, handshakeLength)
+	buf[0] = byte(len(protocolString))
+	buf = append(buf, protocolString...)
+	buf = append(buf, h.Reserved[:]...) // eight reserved bytes
 	buf = append(buf, h.InfoHash.Hash...)
 	buf = append(buf, []byte(h.PeerId)...) // peer id
 
 	return buf
 }
 
+// NewHandshakeFromBytes parses a handshake, which must be for the BitTorrent
+// protocol
 func NewHandshakeFromBytes(bytes []byte) (Handshake, error) {
 	h := Handshake{}
 
-	if len(bytes) != 68 {
-		return h, fmt.Errorf("unxepected handhake length %d", len(bytes))
+	if len(bytes) != handshakeLength {
+		return h, fmt.Errorf("%w: length %d", ErrInvalidHandshake, len(bytes))
+	}
+
+	if int(bytes[0]) != len(protocolString) || string(bytes[1:20]) != protocolString {
+		return h, fmt.Errorf("%w: protocol %q", ErrInvalidHandshake, bytes[1:20])
 	}
 
+	copy(h.Reserved[:], bytes[20:28])
 	h.InfoHash = Hash{Hash: bytes[28:48]}
-	h.PeerId = hex.EncodeToString(bytes[48:])
+	h.PeerId = string(bytes[48:])
 
 	return h, nil
 }
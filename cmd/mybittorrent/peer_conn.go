@@ -0,0 +1,514 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// A keep-alive goes out when we sent nothing for this long
+	keepAliveInterval = 2 * time.Minute
+	// Peers that send nothing, not even keep-alives, for this long are
+	// dropped. It also bounds how long a write may block.
+	defaultInactivityTimeout = 3 * time.Minute
+)
+
+var (
+	ErrPeerConnClosed = errors.New("peer connection closed")
+	ErrPeerInactive   = errors.New("peer inactive")
+)
+
+// PeerConnEvents are the callbacks a PeerConn drives. They are called one at
+// a time from Run, so they can share state without locking, and an error
+// they return closes the connection. Events left nil are ignored.
+type PeerConnEvents struct {
+	// The peer choked or unchoked us
+	Choked   func() error
+	Unchoked func() error
+	// The peer became interested or not interested in our pieces
+	Interested    func() error
+	NotInterested func() error
+	// The peer told us about new pieces, Peer.HavePieces is already updated.
+	// Bitfield is also called for HaveAll and HaveNone.
+	Have     func(pieceIndex int) error
+	Bitfield func() error
+	// The peer asks for a block or takes the request back. Without a
+	// Request event requests are rejected, or ignored without the Fast
+	// Extension.
+	Request func(req BlockRequest) error
+	Cancel  func(req BlockRequest) error
+	// A block arrived or the peer won't send the block we asked for
+	Piece  func(block PieceBlock) error
+	Reject func(req BlockRequest) error
+	// The peer lets us request the piece while it chokes us
+	AllowedFast func(pieceIndex int) error
+	Extended    func(msg ExtendedMessage) error
+	// Called every PeerConn.TickInterval
+	Tick func() error
+
+	// BlockSent is called from the writer goroutine once a block we queued
+	// went out
+	BlockSent func(req BlockRequest)
+}
+
+// PeerConn is a session with a connected peer. A reader goroutine decodes the
+// peer's messages and Run hands them to the events, a writer goroutine sends
+// what is queued with Send. PeerConn keeps the choke and interest state of
+// both sides: we start choking the peer and not interested, and so does the
+// peer.
+//
+// Once the session exists every message written to the peer, including
+// those of the Peer's Send methods, goes through its queue.
+//
+// A keep-alive is sent after KeepAliveInterval without writing, and the
+// session ends when the peer sends nothing for InactivityTimeout.
+type PeerConn struct {
+	Peer              *Peer
+	Events            PeerConnEvents
+	TickInterval      time.Duration
+	KeepAliveInterval time.Duration
+	InactivityTimeout time.Duration
+
+	conn net.Conn
+
+	mu             sync.Mutex
+	amChoking      bool
+	amInterested   bool
+	peerChoking    bool
+	peerInterested bool
+	outbox         []Message
+	// Set once the peer told what it has
+	gotBitfield bool
+
+	wake      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func NewPeerConn(peer *Peer) *PeerConn {
+	pc := &PeerConn{
+		Peer:              peer,
+		KeepAliveInterval: keepAliveInterval,
+		InactivityTimeout: defaultInactivityTimeout,
+		conn:              peer.Conn,
+		amChoking:         true,
+		peerChoking:       true,
+		wake:              make(chan struct{}, 1),
+		done:              make(chan struct{}),
+	}
+
+	peer.session = pc
+
+	return pc
+}
+
+// Run runs the session until the connection fails, an event returns an error
+// or Close is called, it returns why the session ended
+func (pc *PeerConn) Run() error {
+	conn := pc.conn
+	if conn == nil {
+		return ErrPeerConnClosed
+	}
+
+	incoming := make(chan Message)
+
+	go func() {
+		for {
+			conn.SetReadDeadline(time.Now().Add(pc.InactivityTimeout))
+
+			raw, err := readMessage(conn)
+			if err != nil {
+				pc.Close(pc.timeoutError(err))
+				return
+			}
+
+			msg, err := DecodeMessage(raw)
+			if err != nil {
+				pc.Close(err)
+				return
+			}
+
+			select {
+			case incoming <- msg:
+			case <-pc.done:
+				return
+			}
+		}
+	}()
+
+	writerDone := make(chan struct{})
+
+	go func() {
+		defer close(writerDone)
+
+		err := pc.writeLoop(conn)
+		if err != nil {
+			pc.Close(pc.timeoutError(err))
+		}
+	}()
+
+	var tick <-chan time.Time
+	if pc.TickInterval > 0 {
+		ticker := time.NewTicker(pc.TickInterval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	for {
+		var err error
+
+		select {
+		case <-pc.done:
+			<-writerDone
+			return pc.err
+
+		case msg := <-incoming:
+			err = pc.dispatch(msg)
+
+		case <-tick:
+			if pc.Events.Tick != nil {
+				err = pc.Events.Tick()
+			}
+		}
+
+		if err != nil {
+			pc.Close(err)
+		}
+	}
+}
+
+// Close ends the session with err, which Run returns. The first call wins.
+func (pc *PeerConn) Close(err error) {
+	pc.closeOnce.Do(func() {
+		if err == nil {
+			err = ErrPeerConnClosed
+		}
+
+		pc.err = err
+		close(pc.done)
+
+		if pc.conn != nil {
+			pc.conn.Close()
+		}
+	})
+}
+
+// Send queues a message for the writer
+func (pc *PeerConn) Send(msg Message) error {
+	select {
+	case <-pc.done:
+		return pc.err
+	default:
+	}
+
+	pc.mu.Lock()
+	pc.outbox = append(pc.outbox, msg)
+	pc.mu.Unlock()
+
+	select {
+	case pc.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Unqueue takes the queued messages matching drop off the queue before they
+// are sent and returns them
+func (pc *PeerConn) Unqueue(drop func(msg Message) bool) []Message {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	var dropped []Message
+
+	kept := pc.outbox[:0]
+	for _, msg := range pc.outbox {
+		if drop(msg) {
+			dropped = append(dropped, msg)
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+
+	pc.outbox = kept
+
+	return dropped
+}
+
+// Queued is the number of messages waiting to be sent
+func (pc *PeerConn) Queued() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return len(pc.outbox)
+}
+
+func (pc *PeerConn) writeLoop(conn net.Conn) error {
+	lastWrite := time.Now()
+
+	write := func(msg Message) error {
+		conn.SetWriteDeadline(time.Now().Add(pc.InactivityTimeout))
+
+		err := writeMessage(conn, msg.Encode())
+		if err != nil {
+			return err
+		}
+
+		lastWrite = time.Now()
+
+		return nil
+	}
+
+	for {
+		pc.mu.Lock()
+		outbox := pc.outbox
+		pc.outbox = nil
+		pc.mu.Unlock()
+
+		for _, msg := range outbox {
+			err := write(msg)
+			if err != nil {
+				return err
+			}
+
+			if piece, ok := msg.(PieceMessage); ok && pc.Events.BlockSent != nil {
+				pc.Events.BlockSent(piece.request())
+			}
+		}
+
+		// The peer would drop us as inactive if we stayed silent
+		keepAlive := time.After(pc.KeepAliveInterval - time.Since(lastWrite))
+
+		select {
+		case <-pc.wake:
+		case <-keepAlive:
+			err := write(KeepAliveMessage{})
+			if err != nil {
+				return err
+			}
+		case <-pc.done:
+			return nil
+		}
+	}
+}
+
+// timeoutError tells a deadline that ran out apart from other connection
+// errors
+func (pc *PeerConn) timeoutError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: connection idle for %s", ErrPeerInactive, pc.InactivityTimeout)
+	}
+
+	return err
+}
+
+// SetChoking chokes or unchokes the peer, the message is only sent when the
+// state changes
+func (pc *PeerConn) SetChoking(choking bool) error {
+	pc.mu.Lock()
+	changed := pc.amChoking != choking
+	pc.amChoking = choking
+	pc.mu.Unlock()
+
+	if !changed {
+		return nil
+	}
+
+	if choking {
+		return pc.Send(ChokeMessage{})
+	}
+
+	return pc.Send(UnchokeMessage{})
+}
+
+// SetInterested tells the peer whether we want its pieces, the message is
+// only sent when the state changes
+func (pc *PeerConn) SetInterested(interested bool) error {
+	pc.mu.Lock()
+	changed := pc.amInterested != interested
+	pc.amInterested = interested
+	pc.mu.Unlock()
+
+	if !changed {
+		return nil
+	}
+
+	if interested {
+		return pc.Send(InterestedMessage{})
+	}
+
+	return pc.Send(NotInterestedMessage{})
+}
+
+func (pc *PeerConn) AmChoking() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return pc.amChoking
+}
+
+func (pc *PeerConn) AmInterested() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return pc.amInterested
+}
+
+func (pc *PeerConn) PeerChoking() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return pc.peerChoking
+}
+
+func (pc *PeerConn) PeerInterested() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	return pc.peerInterested
+}
+
+// dispatch updates the state for a message from the peer and calls its event
+func (pc *PeerConn) dispatch(msg Message) error {
+	peer := pc.Peer
+	events := pc.Events
+	piecesCount := len(peer.HavePieces.PiecesStatus)
+
+	switch msg := msg.(type) {
+	case ChokeMessage, UnchokeMessage:
+		_, choking := msg.(ChokeMessage)
+
+		pc.mu.Lock()
+		pc.peerChoking = choking
+		pc.mu.Unlock()
+
+		if choking && events.Choked != nil {
+			return events.Choked()
+		}
+
+		if !choking && events.Unchoked != nil {
+			return events.Unchoked()
+		}
+
+	case InterestedMessage, NotInterestedMessage:
+		_, interested := msg.(InterestedMessage)
+
+		pc.mu.Lock()
+		pc.peerInterested = interested
+		pc.mu.Unlock()
+
+		if interested && events.Interested != nil {
+			return events.Interested()
+		}
+
+		if !interested && events.NotInterested != nil {
+			return events.NotInterested()
+		}
+
+	case HaveMessage:
+		if msg.Index >= piecesCount {
+			return fmt.Errorf("%w: have for piece #%d of %d", ErrInvalidMessage, msg.Index, piecesCount)
+		}
+
+		peer.HavePieces.setPieceStatus(msg.Index, true)
+
+		if events.Have != nil {
+			return events.Have(msg.Index)
+		}
+
+	case BitfieldMessage, HaveAllMessage, HaveNoneMessage:
+		// What the peer has is only told once, then kept up to date with
+		// haves
+		if pc.gotBitfield {
+			return fmt.Errorf("%w: second bitfield", ErrInvalidMessage)
+		}
+
+		pc.gotBitfield = true
+
+		if bitfield, ok := msg.(BitfieldMessage); ok {
+			err := validateBitfield(bitfield.Bitfield, piecesCount)
+			if err != nil {
+				return err
+			}
+
+			peer.HavePieces.updateFromBitfield(bitfield.Bitfield)
+		} else {
+			err := peer.handleFastMessage(msg)
+			if err != nil {
+				return err
+			}
+		}
+
+		if events.Bitfield != nil {
+			return events.Bitfield()
+		}
+
+	case SuggestPieceMessage:
+		if msg.Index >= piecesCount {
+			return fmt.Errorf("%w: suggested piece #%d of %d", ErrInvalidMessage, msg.Index, piecesCount)
+		}
+
+		return peer.handleFastMessage(msg)
+
+	case AllowedFastMessage:
+		if msg.Index >= piecesCount {
+			return fmt.Errorf("%w: allowed fast piece #%d of %d", ErrInvalidMessage, msg.Index, piecesCount)
+		}
+
+		err := peer.handleFastMessage(msg)
+		if err != nil {
+			return err
+		}
+
+		if events.AllowedFast != nil {
+			return events.AllowedFast(msg.Index)
+		}
+
+	case RequestMessage:
+		if events.Request != nil {
+			return events.Request(msg.BlockRequest)
+		}
+
+		if peer.SupportsFastExtension() {
+			return peer.SendRejectRequest(msg.BlockRequest)
+		}
+
+	case CancelMessage:
+		if events.Cancel != nil {
+			return events.Cancel(msg.BlockRequest)
+		}
+
+	case RejectRequestMessage:
+		if !peer.SupportsFastExtension() {
+			return fmt.Errorf("reject request from a peer without fast extension")
+		}
+
+		if events.Reject != nil {
+			return events.Reject(msg.BlockRequest)
+		}
+
+	case PieceMessage:
+		if events.Piece == nil {
+			return fmt.Errorf("unrequested piece #%d", msg.Index)
+		}
+
+		return events.Piece(msg.PieceBlock)
+
+	case ExtendedMessage:
+		if events.Extended != nil {
+			return events.Extended(msg)
+		}
+
+	default:
+		// Keep-alives, the DHT port and messages of extensions we didn't
+		// negotiate
+	}
+
+	return nil
+}
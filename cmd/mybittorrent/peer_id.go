@@ -0,0 +1,159 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Our Azureus-style peer id prefix, client code MB for version 0.1.0.0
+const clientPeerIdPrefix = "-MB0100-"
+
+const peerIdLength = 20
+
+// Characters of the random part of our peer ids, kept printable so the ids
+// read well in logs and tracker pages
+const peerIdAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Client codes of Azureus-style peer ids, -XXvvvv-
+var azureusClients = map[string]string{
+	"AG": "Ares",
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"FW": "FrostWire",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"MB": "mybittorrent",
+	"PI": "PicoTorrent",
+	"SD": "Thunder",
+	"TR": "Transmission",
+	"TX": "Tixati",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+	"lt": "rTorrent",
+	"qB": "qBittorrent",
+}
+
+// Client codes of Shadow-style peer ids, a letter and up to five version
+// characters padded with dashes
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// Client codes of Mainline-style peer ids such as M7-4-3--
+var mainlineClients = map[byte]string{
+	'M': "Mainline",
+	'Q': "Queen Bee",
+}
+
+var mainlinePeerId = regexp.MustCompile(`^([A-Z])(\d+)-(\d+)-(\d+)-`)
+
+// Shadow-style version characters, each one stands for its index
+const shadowVersionAlphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+// NewPeerId generates the peer id of a session, our client prefix followed
+// by random characters
+func NewPeerId() string {
+	suffix := make([]byte, peerIdLength-len(clientPeerIdPrefix))
+	rand.Read(suffix)
+
+	for i, b := range suffix {
+		suffix[i] = peerIdAlphabet[int(b)%len(peerIdAlphabet)]
+	}
+
+	return clientPeerIdPrefix + string(suffix)
+}
+
+// ClientFromPeerId identifies the client that generated a peer id, it returns
+// an empty string for ids that follow no known style
+func ClientFromPeerId(peerId string) string {
+	if len(peerId) != peerIdLength {
+		return ""
+	}
+
+	if peerId[0] == '-' && peerId[7] == '-' {
+		if name, ok := azureusClients[peerId[1:3]]; ok {
+			return name + " " + azureusVersion(peerId[3:7])
+		}
+
+		return ""
+	}
+
+	if match := mainlinePeerId.FindStringSubmatch(peerId); match != nil {
+		if name, ok := mainlineClients[match[1][0]]; ok {
+			return fmt.Sprintf("%s %s.%s.%s", name, match[2], match[3], match[4])
+		}
+	}
+
+	if name, ok := shadowClients[peerId[0]]; ok && strings.Contains(peerId[1:9], "---") {
+		if version := shadowVersion(peerId[1:6]); version != "" {
+			return name + " " + version
+		}
+	}
+
+	return ""
+}
+
+// azureusVersion decodes version digits such as 2940 into 2.9.4, letters
+// stand for numbers from 10 up
+func azureusVersion(digits string) string {
+	parts := make([]string, 0, len(digits))
+
+	for i := 0; i < len(digits); i++ {
+		index := strings.IndexByte(peerIdAlphabet, digits[i])
+		if index < 0 || index >= 36 {
+			return digits
+		}
+
+		parts = append(parts, fmt.Sprint(index))
+	}
+
+	// Trailing zeros are dropped, a major and minor version are kept
+	for len(parts) > 2 && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+
+	return strings.Join(parts, ".")
+}
+
+func shadowVersion(chars string) string {
+	parts := make([]string, 0, len(chars))
+
+	for i := 0; i < len(chars) && chars[i] != '-'; i++ {
+		index := strings.IndexByte(shadowVersionAlphabet, chars[i])
+		if index < 0 {
+			return ""
+		}
+
+		parts = append(parts, fmt.Sprint(index))
+	}
+
+	return strings.Join(parts, ".")
+}
+
+// Client names the peer's client, preferring the name and version it gives
+// in its extended handshake over what its peer id tells
+func (p *Peer) Client() string {
+	if p.Extensions.Handshake != nil && p.Extensions.Handshake.V != "" {
+		return p.Extensions.Handshake.V
+	}
+
+	if client := ClientFromPeerId(p.PeerId); client != "" {
+		return client
+	}
+
+	return "unknown"
+}
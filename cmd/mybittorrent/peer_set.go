@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var (
+	ErrSelfConnection      = errors.New("connected to ourselves")
+	ErrDuplicateConnection = errors.New("already connected to the peer")
+)
+
+type connectedPeer struct {
+	peer     *Peer
+	outbound bool
+}
+
+// connectedPeers tracks the peers of a torrent by peer id, so a peer reached
+// twice, through two addresses or once in each direction, keeps a single
+// connection.
+type connectedPeers struct {
+	mu    sync.Mutex
+	ourId string
+	peers map[string]connectedPeer
+}
+
+func newConnectedPeers(ourId string) *connectedPeers {
+	return &connectedPeers{
+		ourId: ourId,
+		peers: make(map[string]connectedPeer),
+	}
+}
+
+// add registers a peer once its handshake is done. When the peer is already
+// connected one connection has to go: of two in the same direction the older
+// one stays, otherwise the one initiated by the side with the lower peer id,
+// which both sides work out on their own. add returns ErrDuplicateConnection
+// when the new connection goes, or the peer whose connection must be closed
+// when the old one does.
+func (c *connectedPeers) add(peer *Peer, outbound bool) (*Peer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ourId != "" && peer.PeerId == c.ourId {
+		return nil, ErrSelfConnection
+	}
+
+	existing, ok := c.peers[peer.PeerId]
+	if ok && (existing.outbound == outbound || keepOutbound(c.ourId, peer.PeerId) != outbound) {
+		return nil, ErrDuplicateConnection
+	}
+
+	c.peers[peer.PeerId] = connectedPeer{peer: peer, outbound: outbound}
+
+	return existing.peer, nil
+}
+
+// remove forgets the peer, unless its connection was replaced by another one
+func (c *connectedPeers) remove(peer *Peer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if existing, ok := c.peers[peer.PeerId]; ok && existing.peer == peer {
+		delete(c.peers, peer.PeerId)
+	}
+}
+
+// closeIp ends the sessions of the peers connected from ip
+func (c *connectedPeers) closeIp(ip net.IP, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, connected := range c.peers {
+		if connected.peer.Addr.Ip.Equal(ip) && connected.peer.session != nil {
+			connected.peer.session.Close(err)
+		}
+	}
+}
+
+// keepOutbound tells whether our outbound connection wins over the inbound
+// one from the same peer
+func keepOutbound(ourId string, peerId string) bool {
+	return ourId < peerId
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type PeerOrigin string
+
+const (
+	PeerOriginTracker PeerOrigin = "tracker"
+	PeerOriginStatic  PeerOrigin = "static"
+	PeerOriginFile    PeerOrigin = "file"
+	PeerOriginDHT     PeerOrigin = "dht"
+	PeerOriginPEX     PeerOrigin = "pex"
+	PeerOriginLSD     PeerOrigin = "lsd"
+)
+
+type DiscoveredPeer struct {
+	Addr   Addr
+	Origin PeerOrigin
+}
+
+// PeerSource streams peer addresses into found until it runs out of peers or
+// ctx is cancelled. Sources may report the same address more than once.
+type PeerSource interface {
+	Run(ctx context.Context, found chan<- DiscoveredPeer) error
+}
+
+// discoverPeers runs all sources and merges what they find into one channel,
+// which is closed once every source has returned.
+func discoverPeers(ctx context.Context, sources []PeerSource) <-chan DiscoveredPeer {
+	found := make(chan DiscoveredPeer)
+
+	var wg sync.WaitGroup
+	wg.Add(len(sources))
+
+	for _, source := range sources {
+		source := source
+		go func() {
+			defer wg.Done()
+
+			err := source.Run(ctx, found)
+			if err != nil && ctx.Err() == nil {
+				fmt.Printf("Peer source error: %s\n", err)
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(found)
+	}()
+
+	return found
+}
+
+func sendDiscoveredPeer(ctx context.Context, found chan<- DiscoveredPeer, peer DiscoveredPeer) bool {
+	select {
+	case found <- peer:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+type TrackerPeerSource struct {
+	Tracker  *Tracker
+	MetaInfo TorrentMetaInfo
+	// Failed announces are retried until the tracker answers when set.
+	// Otherwise Run gives up with the error if an announce fails before the
+	// tracker gave us any peer, so a download with no other source doesn't
+	// wait forever on a dead tracker.
+	KeepRetrying bool
+}
+
+const trackerRetryInterval = time.Minute
+
+func (s *TrackerPeerSource) Run(ctx context.Context, found chan<- DiscoveredPeer) error {
+	foundPeers := false
+
+	for {
+		wait := trackerRetryInterval
+
+		peers, err := s.Tracker.getPeers(ctx, s.MetaInfo)
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if err != nil && !foundPeers && !s.KeepRetrying {
+			return fmt.Errorf("tracker announce error: %w", err)
+		} else if err != nil {
+			fmt.Printf("Tracker announce error: %s\n", err)
+		} else {
+			for _, peer := range peers {
+				if !sendDiscoveredPeer(ctx, found, DiscoveredPeer{Addr: peer.Addr, Origin: PeerOriginTracker}) {
+					return nil
+				}
+
+				foundPeers = true
+			}
+
+			if s.Tracker.Interval > 0 {
+				wait = time.Duration(s.Tracker.Interval) * time.Second
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+	}
+}
+
+type StaticPeerSource struct {
+	Addrs []Addr
+}
+
+func (s *StaticPeerSource) Run(ctx context.Context, found chan<- DiscoveredPeer) error {
+	for _, addr := range s.Addrs {
+		if !sendDiscoveredPeer(ctx, found, DiscoveredPeer{Addr: addr, Origin: PeerOriginStatic}) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// FilePeerSource reads one "ip:port" address per line, empty lines and lines
+// starting with # are skipped.
+type FilePeerSource struct {
+	Path string
+}
+
+func (s *FilePeerSource) Run(ctx context.Context, found chan<- DiscoveredPeer) error {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		addr := Addr{}
+		err := addr.ReadFromString(line)
+		if err != nil {
+			fmt.Printf("Skipping peer %q from %s: %s\n", line, s.Path, err)
+			continue
+		}
+
+		if !sendDiscoveredPeer(ctx, found, DiscoveredPeer{Addr: addr, Origin: PeerOriginFile}) {
+			return nil
+		}
+	}
+
+	return scanner.Err()
+}
+
+const (
+	peerMinBackoff = 30 * time.Second
+	peerMaxBackoff = 30 * time.Minute
+)
+
+type peerAddressEntry struct {
+	Addr        Addr
+	Origins     map[PeerOrigin]bool
+	Failures    int
+	LastFailure time.Time
+	NextAttempt time.Time
+	Connected   bool
+	Banned      bool
+}
+
+// PeerAddressBook remembers every address discovered for a torrent, so the
+// same peer isn't connected twice and failing peers are retried with an
+// exponential backoff instead of immediately.
+type PeerAddressBook struct {
+	mu      sync.Mutex
+	entries map[string]*peerAddressEntry
+}
+
+func NewPeerAddressBook() *PeerAddressBook {
+	return &PeerAddressBook{entries: make(map[string]*peerAddressEntry)}
+}
+
+func (b *PeerAddressBook) Add(peer DiscoveredPeer) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := peer.Addr.ToString()
+
+	entry, ok := b.entries[key]
+	if !ok {
+		entry = &peerAddressEntry{Addr: peer.Addr, Origins: make(map[PeerOrigin]bool)}
+		b.entries[key] = entry
+	}
+
+	entry.Origins[peer.Origin] = true
+
+	return !ok
+}
+
+// Acquire marks the address as connected if it isn't already and its backoff
+// has expired. The caller must report the outcome with MarkFailed or
+// MarkDisconnected.
+func (b *PeerAddressBook) Acquire(addr Addr) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.entries[addr.ToString()]
+	if !ok || entry.Connected || entry.Banned || time.Now().Before(entry.NextAttempt) {
+		return false
+	}
+
+	entry.Connected = true
+
+	return true
+}
+
+func (b *PeerAddressBook) MarkFailed(addr Addr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.entries[addr.ToString()]
+	if !ok {
+		return
+	}
+
+	entry.Connected = false
+	entry.Failures++
+	entry.LastFailure = time.Now()
+
+	backoff := peerMinBackoff << min(entry.Failures-1, 10)
+	entry.NextAttempt = entry.LastFailure.Add(min(backoff, peerMaxBackoff))
+}
+
+func (b *PeerAddressBook) MarkDisconnected(addr Addr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.entries[addr.ToString()]
+	if !ok {
+		return
+	}
+
+	entry.Connected = false
+	entry.Failures = 0
+	entry.NextAttempt = time.Now().Add(peerMinBackoff)
+}
+
+// Ban stops the address from being tried again, such as our own address
+func (b *PeerAddressBook) Ban(addr Addr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.entries[addr.ToString()]
+	if !ok {
+		return
+	}
+
+	entry.Connected = false
+	entry.Banned = true
+}
+
+// Ready returns the addresses that aren't connected and may be tried again
+func (b *PeerAddressBook) Ready() []Addr {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+
+	addrs := make([]Addr, 0)
+	for _, entry := range b.entries {
+		if !entry.Connected && !entry.Banned && !now.Before(entry.NextAttempt) {
+			addrs = append(addrs, entry.Addr)
+		}
+	}
+
+	return addrs
+}
+
+func (b *PeerAddressBook) Origins(addr Addr) []PeerOrigin {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	entry, ok := b.entries[addr.ToString()]
+	if !ok {
+		return nil
+	}
+
+	origins := make([]PeerOrigin, 0, len(entry.Origins))
+	for origin := range entry.Origins {
+		origins = append(origins, origin)
+	}
+
+	return origins
+}
+
+func (b *PeerAddressBook) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.entries)
+}
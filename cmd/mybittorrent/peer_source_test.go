@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTrackerPeerSourceGivesUpOnDeadTracker(t *testing.T) {
+	// Nothing listens on port 1, the announce is refused right away
+	announceUrl := "http://127.0.0.1:1/announce"
+
+	newSource := func(keepRetrying bool) *TrackerPeerSource {
+		return &TrackerPeerSource{
+			Tracker:      &Tracker{AnnounceUrl: announceUrl, PeerId: NewPeerId()},
+			MetaInfo:     TorrentMetaInfo{Announce: announceUrl},
+			KeepRetrying: keepRetrying,
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := newSource(false).Run(ctx, make(chan DiscoveredPeer))
+	if err == nil || ctx.Err() != nil {
+		t.Fatalf("Run returned %v, want the announce error", err)
+	}
+
+	retryCtx, retryCancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer retryCancel()
+
+	err = newSource(true).Run(retryCtx, make(chan DiscoveredPeer))
+	if err != nil || retryCtx.Err() == nil {
+		t.Fatalf("Run returned %v before being cancelled, want it to keep retrying", err)
+	}
+}
+
+func TestTrackerPeerSourceStopsOnStuckTracker(t *testing.T) {
+	// Accepts connections and never answers
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpListener.Close()
+
+	go func() {
+		for {
+			conn, err := httpListener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	udpUrl, _ := fakeUdpTracker(t, func([]byte, int) [][]byte {
+		return nil
+	})
+
+	announceUrls := []string{"http://" + httpListener.Addr().String() + "/announce", udpUrl}
+
+	for _, announceUrl := range announceUrls {
+		source := &TrackerPeerSource{
+			Tracker:      &Tracker{AnnounceUrl: announceUrl, PeerId: NewPeerId()},
+			MetaInfo:     TorrentMetaInfo{Announce: announceUrl},
+			KeepRetrying: true,
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+
+		done := make(chan error, 1)
+		go func() {
+			done <- source.Run(ctx, make(chan DiscoveredPeer))
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("%s: %s", announceUrl, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s: Run still waiting on the tracker after being cancelled", announceUrl)
+		}
+
+		cancel()
+	}
+}
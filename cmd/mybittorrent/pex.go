@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	pexExtensionName = "ut_pex"
+	pexInterval      = time.Minute
+	// BEP 11 limits a message to 50 added and 50 dropped peers, messages with
+	// more are cut to this size instead of being trusted
+	pexMaxPeersPerMessage = 50
+	// Peers sending PEX more often than this are ignored for the extra messages
+	pexMinReceiveInterval = 45 * time.Second
+)
+
+const (
+	PexFlagEncryption = 0x01
+	PexFlagSeed       = 0x02
+	PexFlagUtp        = 0x04
+	PexFlagHolepunch  = 0x08
+	PexFlagReachable  = 0x10
+)
+
+type pexPeerState struct {
+	lastSent     time.Time
+	lastReceived time.Time
+	sent         map[string]bool
+}
+
+// PEX implements the ut_pex extension: every connected peer is told which
+// peers we got connected to or disconnected from since the last message, and
+// the peers peers tell us about are handed to the download as a peer source.
+type PEX struct {
+	mu        sync.Mutex
+	connected map[string]byte
+	peers     map[*Peer]*pexPeerState
+	found     chan Addr
+}
+
+func NewPEX() *PEX {
+	return &PEX{
+		connected: make(map[string]byte),
+		peers:     make(map[*Peer]*pexPeerState),
+		found:     make(chan Addr, 256),
+	}
+}
+
+// AddConnected adds a peer we are connected to, it is advertised with flags
+// in our next messages
+func (x *PEX) AddConnected(addr Addr, flags byte) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.connected[string(addr.ToBytes())] = flags
+}
+
+func (x *PEX) RemoveConnected(addr Addr) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	delete(x.connected, string(addr.ToBytes()))
+}
+
+func (x *PEX) PeerDisconnected(peer *Peer) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	delete(x.peers, peer)
+}
+
+func (x *PEX) PeerHandshaked(peer *Peer) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if _, ok := x.peers[peer]; !ok {
+		x.peers[peer] = &pexPeerState{sent: make(map[string]bool)}
+	}
+}
+
+// MaybeSend sends the peer the changes to our peer list if it supports PEX
+// and the last message was sent at least a minute ago
+func (x *PEX) MaybeSend(peer *Peer) error {
+	if !peer.SupportsExtension(pexExtensionName) {
+		return nil
+	}
+
+	x.mu.Lock()
+
+	state, ok := x.peers[peer]
+	if !ok {
+		state = &pexPeerState{sent: make(map[string]bool)}
+		x.peers[peer] = state
+	}
+
+	if !state.lastSent.IsZero() && time.Since(state.lastSent) < pexInterval {
+		x.mu.Unlock()
+		return nil
+	}
+
+	ownAddr := string(peer.Addr.ToBytes())
+
+	added := make([]byte, 0)
+	addedFlags := make([]byte, 0)
+	added6 := make([]byte, 0)
+	added6Flags := make([]byte, 0)
+	dropped := make([]byte, 0)
+	dropped6 := make([]byte, 0)
+
+	addedCount := 0
+	for compactAddr, flags := range x.connected {
+		if addedCount == pexMaxPeersPerMessage {
+			break
+		}
+
+		if compactAddr == ownAddr || state.sent[compactAddr] {
+			continue
+		}
+
+		if len(compactAddr) == 6 {
+			added = append(added, compactAddr...)
+			addedFlags = append(addedFlags, flags)
+		} else {
+			added6 = append(added6, compactAddr...)
+			added6Flags = append(added6Flags, flags)
+		}
+
+		state.sent[compactAddr] = true
+		addedCount++
+	}
+
+	droppedCount := 0
+	for compactAddr := range state.sent {
+		if droppedCount == pexMaxPeersPerMessage {
+			break
+		}
+
+		if _, ok := x.connected[compactAddr]; ok {
+			continue
+		}
+
+		if len(compactAddr) == 6 {
+			dropped = append(dropped, compactAddr...)
+		} else {
+			dropped6 = append(dropped6, compactAddr...)
+		}
+
+		delete(state.sent, compactAddr)
+		droppedCount++
+	}
+
+	state.lastSent = time.Now()
+
+	x.mu.Unlock()
+
+	if addedCount == 0 && droppedCount == 0 {
+		return nil
+	}
+
+	encoded, err := encodeBencode(map[string]any{
+		"added":    string(added),
+		"added.f":  string(addedFlags),
+		"added6":   string(added6),
+		"added6.f": string(added6Flags),
+		"dropped":  string(dropped),
+		"dropped6": string(dropped6),
+	})
+	if err != nil {
+		return err
+	}
+
+	return peer.SendExtendedMessage(pexExtensionName, []byte(encoded))
+}
+
+func (x *PEX) HandleMessage(peer *Peer, payload []byte) error {
+	x.mu.Lock()
+	state, ok := x.peers[peer]
+	if !ok {
+		state = &pexPeerState{sent: make(map[string]bool)}
+		x.peers[peer] = state
+	}
+
+	tooSoon := !state.lastReceived.IsZero() && time.Since(state.lastReceived) < pexMinReceiveInterval
+	if !tooSoon {
+		state.lastReceived = time.Now()
+	}
+	x.mu.Unlock()
+
+	if tooSoon {
+		return nil
+	}
+
+	decoded, err := decodeBencode(bufio.NewReader(bytes.NewReader(payload)))
+	if err != nil {
+		return err
+	}
+
+	dict, ok := decoded.(map[string]any)
+	if !ok {
+		return fmt.Errorf("pex message is not a dictionary")
+	}
+
+	addrs := make([]Addr, 0)
+
+	for _, key := range []string{"added", "added6"} {
+		compactAddrs, ok := dict[key].(string)
+		if !ok {
+			continue
+		}
+
+		addrSize := 6
+		if key == "added6" {
+			addrSize = 18
+		}
+
+		decodedAddrs, err := decodeCompactAddrs([]byte(compactAddrs), addrSize)
+		if err != nil {
+			return fmt.Errorf("pex %s: %s", key, err)
+		}
+
+		addrs = append(addrs, decodedAddrs...)
+	}
+
+	accepted := 0
+	for _, addr := range addrs {
+		if accepted == pexMaxPeersPerMessage {
+			break
+		}
+
+		if !isUsablePeerAddr(addr) || addr.ToString() == peer.Addr.ToString() {
+			continue
+		}
+
+		select {
+		case x.found <- addr:
+			accepted++
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func isUsablePeerAddr(addr Addr) bool {
+	return addr.Port != 0 &&
+		!addr.Ip.IsUnspecified() &&
+		!addr.Ip.IsMulticast() &&
+		!addr.Ip.Equal(net.IPv4bcast)
+}
+
+type PEXPeerSource struct {
+	PEX *PEX
+}
+
+func (s *PEXPeerSource) Run(ctx context.Context, found chan<- DiscoveredPeer) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case addr := <-s.PEX.found:
+			if !sendDiscoveredPeer(ctx, found, DiscoveredPeer{Addr: addr, Origin: PeerOriginPEX}) {
+				return nil
+			}
+		}
+	}
+}
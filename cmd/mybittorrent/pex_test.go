@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPEXHandleMessage(t *testing.T) {
+	pex := NewPEX()
+	peer := &Peer{Addr: Addr{Ip: net.IPv4(10, 0, 0, 1), Port: 6881}}
+
+	added := string([]byte{10, 0, 0, 2, 0x1a, 0xe1, 0, 0, 0, 0, 0x1a, 0xe1})
+	payload := "d5:added12:" + added + "e"
+
+	err := pex.HandleMessage(peer, []byte(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The unspecified address is skipped
+	select {
+	case addr := <-pex.found:
+		if addr.ToString() != "10.0.0.2:6881" {
+			t.Errorf("found %s", addr.ToString())
+		}
+	default:
+		t.Fatal("no peer found")
+	}
+
+	if len(pex.found) != 0 {
+		t.Errorf("%d more peers found", len(pex.found))
+	}
+}
+
+func TestPEXMalformedMessages(t *testing.T) {
+	payloads := []string{
+		"d5:added999999999999999:abce",
+		"d5:added5:abcdee",
+		"d6:added6-1:e",
+		"l5:addede",
+		"d5:added",
+	}
+
+	pex := NewPEX()
+
+	for i, payload := range payloads {
+		// A new peer each time, a peer's messages count against its rate
+		peer := &Peer{Addr: Addr{Ip: net.IPv4(10, 0, 1, byte(i)), Port: 6881}}
+
+		err := pex.HandleMessage(peer, []byte(payload))
+		if err == nil {
+			t.Errorf("pex message %q accepted", payload)
+		}
+	}
+
+	if len(pex.found) != 0 {
+		t.Errorf("%d peers found in malformed messages", len(pex.found))
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+)
+
+// pieceState is a piece being downloaded. Blocks are written into the
+// piece's buffer as they arrive, possibly from different peers, and a bitmap
+// tracks which blocks are there.
+type pieceState struct {
+	Index  int
+	Hash   Hash
+	length int
+	data   []byte
+
+	// Bit per block, set once the block is received
+	have      []byte
+	haveCount int
+	// Number of peers with an outstanding request, per block
+	requested []int
+	// The peer that picked the piece, nil while nobody works on it
+	owner *Peer
+	// The peer each block came from
+	contributors []*Peer
+	// Only the owner downloads the piece, after it failed the hash check
+	// with blocks from several peers
+	singleSource bool
+}
+
+func newPieceState(index int, hash Hash, length int) *pieceState {
+	blocksCount := calculateBlocksCount(length)
+
+	return &pieceState{
+		Index:        index,
+		Hash:         hash,
+		length:       length,
+		have:         make([]byte, (blocksCount+7)/8),
+		requested:    make([]int, blocksCount),
+		contributors: make([]*Peer, blocksCount),
+	}
+}
+
+func (ps *pieceState) blocksCount() int {
+	return len(ps.requested)
+}
+
+func (ps *pieceState) hasBlock(block int) bool {
+	return ps.have[block/8]&(0x80>>(block%8)) != 0
+}
+
+func (ps *pieceState) isComplete() bool {
+	return ps.haveCount == ps.blocksCount()
+}
+
+func (ps *pieceState) blockRequest(block int) BlockRequest {
+	begin := block * blockSize
+
+	return BlockRequest{Index: ps.Index, Begin: begin, Length: min(blockSize, ps.length-begin)}
+}
+
+// validateBlock checks that a block of a piece of pieceLength bytes lines
+// up with the blocks we request, an offset or length we'd never ask for is
+// an error
+func validateBlock(req BlockRequest, pieceLength int) error {
+	if req.Begin < 0 || req.Begin >= pieceLength || req.Begin%blockSize != 0 {
+		return fmt.Errorf("invalid block offset %d in piece #%d", req.Begin, req.Index)
+	}
+
+	if req.Length != min(blockSize, pieceLength-req.Begin) {
+		return fmt.Errorf("invalid block length %d at offset %d in piece #%d", req.Length, req.Begin, req.Index)
+	}
+
+	return nil
+}
+
+// addBlock stores a validated block from peer, it tells whether the block
+// was new
+func (ps *pieceState) addBlock(block PieceBlock, peer *Peer) bool {
+	blockIndex := block.Begin / blockSize
+	if ps.hasBlock(blockIndex) {
+		return false
+	}
+
+	if ps.data == nil {
+		ps.data = make([]byte, ps.length)
+	}
+
+	copy(ps.data[block.Begin:], block.Block)
+	ps.contributors[blockIndex] = peer
+	ps.have[blockIndex/8] |= 0x80 >> (blockIndex % 8)
+	ps.haveCount++
+
+	return true
+}
+
+// soleContributor is the peer every block came from, nil when there were
+// several
+func (ps *pieceState) soleContributor() *Peer {
+	for _, peer := range ps.contributors {
+		if peer != ps.contributors[0] {
+			return nil
+		}
+	}
+
+	return ps.contributors[0]
+}
+
+func (ps *pieceState) piece() Piece {
+	return Piece{Index: ps.Index, Hash: ps.Hash, Data: ps.data}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// In endgame a block is requested from at most this many peers at once, which
+	// bounds the bandwidth wasted on duplicates
+	endgameMaxRequestsPerBlock = 2
+	// Until this many pieces are done pieces are picked at random, so we
+	// quickly have something to trade instead of waiting on rare pieces
+	pickerRandomFirstPieces = 4
+)
+
+// piecePicker decides which piece a peer downloads next and holds what is
+// known about the pieces being downloaded. It counts how many connected
+// peers have each piece and hands out the rarest pieces first, so they
+// spread before the peers having them leave. Pieces with blocks received
+// from a peer that left are finished first, and the first few pieces are
+// picked at random.
+//
+// A peer owns the pieces it picked until they are done or it gives them back.
+// Once every piece is done or owned the download is in endgame: blocks still
+// missing are also requested from other peers that have them, and whoever
+// gets a block first wins.
+//
+// A piece that fails the hash check with blocks from several peers is
+// downloaded again from a single peer, one that didn't send the bad piece if
+// there is one. The blocks that differ between the two versions tell who sent
+// bad data.
+type piecePicker struct {
+	fileLength  int
+	pieceLength int
+	hashes      []Hash
+
+	mu           sync.Mutex
+	rand         *rand.Rand
+	availability []int
+	peers        map[*Peer][]bool
+	progress     map[int]*pieceState
+	done         []bool
+	doneCount    int
+	// The last version of pieces that failed the hash check with blocks from
+	// several peers, kept until a good version tells which blocks were bad
+	failed map[int]*pieceState
+}
+
+// newPiecePicker creates a picker for the pieces in wanted, the other pieces
+// of the torrent are never picked
+func newPiecePicker(metafile TorrentMetaInfo, wanted []int) *piecePicker {
+	piecesCount := len(metafile.Info.Pieces)
+
+	p := &piecePicker{
+		fileLength:   metafile.Info.Length,
+		pieceLength:  metafile.Info.PieceLength,
+		hashes:       metafile.Info.Pieces,
+		rand:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		availability: make([]int, piecesCount),
+		peers:        make(map[*Peer][]bool),
+		progress:     make(map[int]*pieceState),
+		done:         make([]bool, piecesCount),
+		failed:       make(map[int]*pieceState),
+	}
+
+	for pieceIndex := range p.done {
+		p.done[pieceIndex] = true
+	}
+
+	for _, pieceIndex := range wanted {
+		p.done[pieceIndex] = false
+	}
+
+	return p
+}
+
+// updatePeer brings the availability in line with the pieces the peer has
+func (p *piecePicker) updatePeer(peer *Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	counted, ok := p.peers[peer]
+	if !ok {
+		counted = make([]bool, len(p.availability))
+		p.peers[peer] = counted
+	}
+
+	for pieceIndex := range counted {
+		has := peer.HavePieces.hasPiece(pieceIndex)
+
+		if has && !counted[pieceIndex] {
+			p.availability[pieceIndex]++
+		} else if !has && counted[pieceIndex] {
+			p.availability[pieceIndex]--
+		}
+
+		counted[pieceIndex] = has
+	}
+}
+
+func (p *piecePicker) peerHave(peer *Peer, pieceIndex int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	counted, ok := p.peers[peer]
+	if !ok || pieceIndex < 0 || pieceIndex >= len(counted) || counted[pieceIndex] {
+		return
+	}
+
+	counted[pieceIndex] = true
+	p.availability[pieceIndex]++
+}
+
+// removePeer stops counting the peer's pieces and gives back the pieces it
+// owns
+func (p *piecePicker) removePeer(peer *Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for pieceIndex, has := range p.peers[peer] {
+		if has {
+			p.availability[pieceIndex]--
+		}
+	}
+
+	delete(p.peers, peer)
+
+	p.disown(peer)
+}
+
+// pick makes the peer the owner of the next piece it should download, while
+// the peer chokes us only its allowed fast pieces are picked
+func (p *piecePicker) pick(peer *Peer, skipped map[int]bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	picked := -1
+	pickedPartial := false
+	candidates := 0
+
+	for pieceIndex, done := range p.done {
+		if done || skipped[pieceIndex] || !peer.HavePieces.hasPiece(pieceIndex) || !peer.canRequest(pieceIndex) {
+			continue
+		}
+
+		progress, inProgress := p.progress[pieceIndex]
+		if inProgress && progress.owner != nil {
+			continue
+		}
+
+		if p.isSuspect(pieceIndex, peer) {
+			continue
+		}
+
+		partial := inProgress && progress.haveCount > 0
+
+		if picked != -1 {
+			switch {
+			case pickedPartial && !partial:
+				continue
+
+			case partial == pickedPartial && p.doneCount >= pickerRandomFirstPieces:
+				if p.availability[pieceIndex] > p.availability[picked] {
+					continue
+				}
+
+				if p.availability[pieceIndex] < p.availability[picked] {
+					candidates = 0
+				}
+			}
+
+			if partial && !pickedPartial {
+				candidates = 0
+			}
+		}
+
+		// Reservoir sampling picks uniformly among the equally good pieces
+		candidates++
+		if p.rand.Intn(candidates) == 0 {
+			picked = pieceIndex
+			pickedPartial = partial
+		}
+	}
+
+	if picked == -1 {
+		return false
+	}
+
+	progress, ok := p.progress[picked]
+	if !ok {
+		progress = newPieceState(picked, p.hashes[picked], p.pieceLengthOf(picked))
+		progress.singleSource = p.failed[picked] != nil
+		p.progress[picked] = progress
+	}
+	progress.owner = peer
+
+	return true
+}
+
+// isEndgame tells whether every piece is done or being downloaded
+func (p *piecePicker) isEndgame() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for pieceIndex, done := range p.done {
+		if done {
+			continue
+		}
+
+		progress, ok := p.progress[pieceIndex]
+		if !ok || progress.owner == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isInteresting tells whether the peer has a piece we still need, other than
+// the pieces skipped for it
+func (p *piecePicker) isInteresting(peer *Peer, skipped map[int]bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for pieceIndex, done := range p.done {
+		if !done && !skipped[pieceIndex] && peer.HavePieces.hasPiece(pieceIndex) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// haveAll tells whether we have every piece of the torrent, not only the
+// wanted ones
+func (p *piecePicker) haveAll() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.doneCount == len(p.done)
+}
+
+// giveBack makes the piece available to other peers if the peer owns it
+func (p *piecePicker) giveBack(pieceIndex int, peer *Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if progress, ok := p.progress[pieceIndex]; ok && progress.owner == peer {
+		progress.owner = nil
+	}
+}
+
+// giveBackAll makes every piece the peer owns available to other peers
+func (p *piecePicker) giveBackAll(peer *Peer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.disown(peer)
+}
+
+func (p *piecePicker) disown(peer *Peer) {
+	for _, progress := range p.progress {
+		if progress.owner == peer {
+			progress.owner = nil
+		}
+	}
+}
+
+// nextBlock is a block nobody received or requested yet, from the pieces
+// the peer owns or else from pieces other peers are downloading, so pieces
+// in progress are finished before new ones are started
+func (p *piecePicker) nextBlock(peer *Peer, skipped map[int]bool) (BlockRequest, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pieceIndexes := p.sortedProgress()
+
+	for _, owned := range []bool{true, false} {
+		for _, pieceIndex := range pieceIndexes {
+			progress := p.progress[pieceIndex]
+
+			if !owned && progress.singleSource {
+				continue
+			}
+
+			if (progress.owner == peer) != owned || skipped[pieceIndex] || !peer.HavePieces.hasPiece(pieceIndex) || !peer.canRequest(pieceIndex) {
+				continue
+			}
+
+			for block := 0; block < progress.blocksCount(); block++ {
+				if !progress.hasBlock(block) && progress.requested[block] == 0 {
+					return progress.blockRequest(block), true
+				}
+			}
+		}
+	}
+
+	return BlockRequest{}, false
+}
+
+func (p *piecePicker) sortedProgress() []int {
+	pieceIndexes := make([]int, 0, len(p.progress))
+	for pieceIndex := range p.progress {
+		pieceIndexes = append(pieceIndexes, pieceIndex)
+	}
+
+	sort.Ints(pieceIndexes)
+
+	return pieceIndexes
+}
+
+// endgameBlock is a missing block of a piece owned by another peer that the
+// peer can request too, within the duplication budget
+func (p *piecePicker) endgameBlock(peer *Peer, skipped map[int]bool, queue *requestQueue) (BlockRequest, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, pieceIndex := range p.sortedProgress() {
+		progress := p.progress[pieceIndex]
+
+		if (progress.singleSource && progress.owner != peer) || skipped[pieceIndex] || !peer.HavePieces.hasPiece(pieceIndex) || !peer.canRequest(pieceIndex) {
+			continue
+		}
+
+		for block := 0; block < progress.blocksCount(); block++ {
+			req := progress.blockRequest(block)
+
+			if progress.hasBlock(block) || progress.requested[block] >= endgameMaxRequestsPerBlock || queue.isPending(req) {
+				continue
+			}
+
+			return req, true
+		}
+	}
+
+	return BlockRequest{}, false
+}
+
+func (p *piecePicker) requested(req BlockRequest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if progress, ok := p.progress[req.Index]; ok {
+		progress.requested[req.Begin/blockSize]++
+	}
+}
+
+func (p *piecePicker) unrequested(req BlockRequest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if progress, ok := p.progress[req.Index]; ok && progress.requested[req.Begin/blockSize] > 0 {
+		progress.requested[req.Begin/blockSize]--
+	}
+}
+
+// isReceived tells whether a request became pointless because the block
+// arrived from some peer or its piece is no longer downloaded
+func (p *piecePicker) isReceived(req BlockRequest) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	progress, ok := p.progress[req.Index]
+	if !ok {
+		return true
+	}
+
+	return progress.hasBlock(req.Begin / blockSize)
+}
+
+// validate checks that the block belongs to a wanted piece and lines up
+// with the blocks we request
+func (p *piecePicker) validate(req BlockRequest) error {
+	if req.Index < 0 || req.Index >= len(p.done) {
+		return fmt.Errorf("invalid piece index %d", req.Index)
+	}
+
+	return validateBlock(req, p.pieceLengthOf(req.Index))
+}
+
+// receive stores a validated block from peer and returns the piece if the
+// block completed it, the piece is then done. Blocks that arrived already are
+// dropped.
+func (p *piecePicker) receive(block PieceBlock, peer *Peer) *pieceState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	progress, ok := p.progress[block.Index]
+	if !ok || !progress.addBlock(block, peer) || !progress.isComplete() {
+		return nil
+	}
+
+	delete(p.progress, block.Index)
+	p.done[block.Index] = true
+	p.doneCount++
+
+	return progress
+}
+
+func (p *piecePicker) pieceLengthOf(pieceIndex int) int {
+	return min(p.pieceLength, p.fileLength-pieceIndex*p.pieceLength)
+}
+
+// hashFailed throws away a piece that failed the hash check so it is
+// downloaded again. It returns the peer that sent the bad data when all of
+// it came from one peer, otherwise the piece is kept to compare with the
+// next version.
+func (p *piecePicker) hashFailed(progress *pieceState) *Peer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pieceIndex := progress.Index
+
+	delete(p.progress, pieceIndex)
+
+	if p.done[pieceIndex] {
+		p.done[pieceIndex] = false
+		p.doneCount--
+	}
+
+	culprit := progress.soleContributor()
+	if culprit == nil {
+		p.failed[pieceIndex] = progress
+	}
+
+	return culprit
+}
+
+// verified is told about a piece that passed the hash check, it returns the
+// peers that sent blocks which differ from an earlier version that failed
+func (p *piecePicker) verified(progress *pieceState) []*Peer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	failed, ok := p.failed[progress.Index]
+	if !ok {
+		return nil
+	}
+
+	delete(p.failed, progress.Index)
+
+	var culprits []*Peer
+	seen := make(map[*Peer]bool)
+
+	for block := 0; block < progress.blocksCount(); block++ {
+		req := progress.blockRequest(block)
+		good := progress.data[req.Begin : req.Begin+req.Length]
+		bad := failed.data[req.Begin : req.Begin+req.Length]
+
+		culprit := failed.contributors[block]
+		if !bytes.Equal(good, bad) && !seen[culprit] {
+			seen[culprit] = true
+			culprits = append(culprits, culprit)
+		}
+	}
+
+	return culprits
+}
+
+// isSuspect tells whether the peer sent blocks of the failed version of the
+// piece while another peer could download it instead
+func (p *piecePicker) isSuspect(pieceIndex int, peer *Peer) bool {
+	failed, ok := p.failed[pieceIndex]
+	if !ok || !slices.Contains(failed.contributors, peer) {
+		return false
+	}
+
+	for other, counted := range p.peers {
+		if counted[pieceIndex] && !slices.Contains(failed.contributors, other) {
+			return true
+		}
+	}
+
+	return false
+}
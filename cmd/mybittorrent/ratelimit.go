@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reads and writes through a rate limited connection move at most this many
+// bytes at once, so a big block doesn't hold the bucket for long
+const rateLimitChunkSize = 16 * 1024
+
+// How long a limiter may go at its full rate once it was idle
+const rateLimitBurst = 250 * time.Millisecond
+
+// RateLimiter is a token bucket shared by the connections it limits, it lets
+// Rate bytes per second through. A zero rate or a nil limiter doesn't limit.
+//
+// Bytes are taken from the bucket as they go, which can leave it in debt, the
+// next one to take waits for the debt to be paid back. The rate can change
+// at any time, waiting connections are let go when it does.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    int64
+	tokens  float64
+	updated time.Time
+	changed chan struct{}
+}
+
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	return &RateLimiter{
+		rate:    max(bytesPerSecond, 0),
+		updated: time.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+// Rate is the limit in bytes per second, zero when unlimited
+func (l *RateLimiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.rate
+}
+
+// SetRate changes the limit, zero removes it. The debt taken at the old rate
+// is forgiven. A nil limiter stays unlimited.
+func (l *RateLimiter) SetRate(bytesPerSecond int64) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = max(bytesPerSecond, 0)
+	l.tokens = 0
+	l.updated = time.Now()
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// take removes n bytes from the bucket. It returns how long to wait before
+// they may go and a channel closed if the rate changes in the meantime.
+func (l *RateLimiter) take(n int) (time.Duration, <-chan struct{}) {
+	if l == nil {
+		return 0, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate == 0 {
+		return 0, nil
+	}
+
+	now := time.Now()
+	rate := float64(l.rate)
+	burst := max(rate*rateLimitBurst.Seconds(), rateLimitChunkSize)
+
+	l.tokens = min(l.tokens+now.Sub(l.updated).Seconds()*rate, burst)
+	l.updated = now
+	l.tokens -= float64(n)
+
+	if l.tokens >= 0 {
+		return 0, nil
+	}
+
+	return time.Duration(-l.tokens / rate * float64(time.Second)), l.changed
+}
+
+// RateLimits caps the bandwidth of a group of connections, such as those of
+// a torrent or all of them. Nil limiters don't limit.
+type RateLimits struct {
+	Download *RateLimiter
+	Upload   *RateLimiter
+}
+
+// globalRateLimits caps every peer connection of the process, whichever
+// torrent it belongs to
+var globalRateLimits = NewRateLimits(0, 0)
+
+func NewRateLimits(download int64, upload int64) *RateLimits {
+	return &RateLimits{
+		Download: NewRateLimiter(download),
+		Upload:   NewRateLimiter(upload),
+	}
+}
+
+// rateLimitedConn counts everything read and written on the connection
+// against the limits, handshakes and message headers included
+type rateLimitedConn struct {
+	net.Conn
+	download []*RateLimiter
+	upload   []*RateLimiter
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// limitConn wraps conn so it stays within every one of the limits, nil limits
+// are skipped
+func limitConn(conn net.Conn, limits ...*RateLimits) net.Conn {
+	limited := &rateLimitedConn{
+		Conn:   conn,
+		closed: make(chan struct{}),
+	}
+
+	for _, l := range limits {
+		if l == nil {
+			continue
+		}
+
+		if l.Download != nil {
+			limited.download = append(limited.download, l.Download)
+		}
+
+		if l.Upload != nil {
+			limited.upload = append(limited.upload, l.Upload)
+		}
+	}
+
+	if len(limited.download) == 0 && len(limited.upload) == 0 {
+		return conn
+	}
+
+	return limited
+}
+
+func (c *rateLimitedConn) Read(b []byte) (int, error) {
+	if len(c.download) > 0 && len(b) > rateLimitChunkSize {
+		b = b[:rateLimitChunkSize]
+	}
+
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.wait(c.download, n)
+	}
+
+	return n, err
+}
+
+func (c *rateLimitedConn) Write(b []byte) (int, error) {
+	if len(c.upload) == 0 {
+		return c.Conn.Write(b)
+	}
+
+	written := 0
+
+	for written < len(b) {
+		chunk := b[written:min(written+rateLimitChunkSize, len(b))]
+
+		err := c.wait(c.upload, len(chunk))
+		if err != nil {
+			return written, err
+		}
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+func (c *rateLimitedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+
+	return c.Conn.Close()
+}
+
+// wait takes n bytes from each limiter and sleeps until the slowest of them
+// lets them go
+func (c *rateLimitedConn) wait(limiters []*RateLimiter, n int) error {
+	for _, l := range limiters {
+		delay, changed := l.take(n)
+		if delay <= 0 {
+			continue
+		}
+
+		timer := time.NewTimer(delay)
+
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		case <-c.closed:
+			timer.Stop()
+			return net.ErrClosed
+		}
+	}
+
+	return nil
+}
+
+// ParseRate parses a rate in bytes per second, with an optional K, M or G
+// suffix for powers of 1024
+func ParseRate(s string) (int64, error) {
+	digits := strings.TrimSpace(s)
+	multiplier := int64(1)
+
+	if digits != "" {
+		switch strings.ToUpper(digits[len(digits)-1:]) {
+		case "K":
+			multiplier = 1 << 10
+		case "M":
+			multiplier = 1 << 20
+		case "G":
+			multiplier = 1 << 30
+		}
+
+		if multiplier > 1 {
+			digits = digits[:len(digits)-1]
+		}
+	}
+
+	// Rates that overflow with their suffix are as invalid as those that
+	// overflow without one
+	rate, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || rate < 0 || rate > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+
+	return rate * multiplier, nil
+}
+
+// rateFlag sets the limiter's rate from a flag parsed by ParseRate
+func rateFlag(limiter *RateLimiter) func(string) error {
+	return func(value string) error {
+		rate, err := ParseRate(value)
+		if err != nil {
+			return err
+		}
+
+		limiter.SetRate(rate)
+		return nil
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Achieved rates may be this far off the limit, the bucket's burst and the
+// scheduler both add some
+const rateTolerance = 0.15
+
+// loopbackPair connects two TCP sockets over loopback
+func loopbackPair(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return client, server
+}
+
+// sendAll writes n bytes to w while r drains them, it returns the rate in
+// bytes per second
+func sendAll(w io.Writer, r io.Reader, n int) (float64, error) {
+	start := time.Now()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := w.Write(make([]byte, n))
+		errs <- err
+	}()
+
+	_, err := io.ReadFull(r, make([]byte, n))
+	if err != nil {
+		return 0, err
+	}
+
+	err = <-errs
+	if err != nil {
+		return 0, err
+	}
+
+	return float64(n) / time.Since(start).Seconds(), nil
+}
+
+func checkRate(t *testing.T, name string, rate float64, limit int64) {
+	t.Helper()
+
+	if rate < float64(limit)*(1-rateTolerance) || rate > float64(limit)*(1+rateTolerance) {
+		t.Errorf("%s: %.0f bytes/s, want %d within %.0f%%", name, rate, limit, rateTolerance*100)
+	}
+}
+
+func TestRateLimitedConn(t *testing.T) {
+	const limit = 256 * 1024
+
+	for _, download := range []bool{false, true} {
+		client, server := loopbackPair(t)
+
+		// Made right before the transfer, the bucket is still empty and no
+		// burst skews the rate
+		limits := NewRateLimits(0, limit)
+		name := "upload"
+		if download {
+			limits = NewRateLimits(limit, 0)
+			name = "download"
+		}
+
+		limited := limitConn(client, limits)
+
+		var rate float64
+		var err error
+
+		// A second at the limit
+		if download {
+			rate, err = sendAll(server, limited, limit)
+		} else {
+			rate, err = sendAll(limited, server, limit)
+		}
+
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+
+		checkRate(t, name, rate, limit)
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	client, server := loopbackPair(t)
+	limits := NewRateLimits(0, 0)
+	limited := limitConn(client, limits)
+
+	// Unlimited a transfer takes no time at all
+	rate, err := sendAll(limited, server, 1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rate < 16*1024*1024 {
+		t.Errorf("unlimited: %.0f bytes/s", rate)
+	}
+
+	// The new rate applies to connections made before
+	limits.Upload.SetRate(128 * 1024)
+
+	rate, err = sendAll(limited, server, 128*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkRate(t, "after SetRate", rate, 128*1024)
+
+	// A writer waiting on a slow rate is let go when it is raised
+	limits.Upload.SetRate(1024)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := sendAll(limited, server, 64*1024)
+		done <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	limits.Upload.SetRate(0)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("writer still waiting after the limit was removed")
+	}
+}
+
+func TestRateLimitSharedByConnections(t *testing.T) {
+	const limit = 300 * 1024
+
+	global := NewRateLimits(0, limit)
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+
+	// Three connections share the global limit, each has a looser one of
+	// its own
+	for i := 0; i < 3; i++ {
+		client, server := loopbackPair(t)
+		limited := limitConn(client, global, NewRateLimits(0, limit))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, err := sendAll(limited, server, limit/2)
+			errs <- err
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkRate(t, "shared", float64(3*limit/2)/time.Since(start).Seconds(), limit)
+}
+
+func TestRateLimitsNil(t *testing.T) {
+	var limiter *RateLimiter
+	limiter.SetRate(1024)
+
+	if limiter.Rate() != 0 {
+		t.Errorf("nil limiter has rate %d", limiter.Rate())
+	}
+
+	client, _ := loopbackPair(t)
+
+	if conn := limitConn(client, nil, &RateLimits{}); conn != client {
+		t.Errorf("nil limits wrapped the connection in %T", conn)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		value string
+		rate  int64
+		valid bool
+	}{
+		{"0", 0, true},
+		{"1500", 1500, true},
+		{"512K", 512 * 1024, true},
+		{"2m", 2 * 1024 * 1024, true},
+		{" 1G ", 1024 * 1024 * 1024, true},
+		{"8589934591G", 8589934591 << 30, true},
+		{"", 0, false},
+		{"K", 0, false},
+		{"-1", 0, false},
+		{"1.5M", 0, false},
+		{"10T", 0, false},
+		{"9999999999999G", 0, false},
+		{"99999999999999999999", 0, false},
+	}
+
+	for _, test := range tests {
+		rate, err := ParseRate(test.value)
+
+		switch {
+		case test.valid && err != nil:
+			t.Errorf("%q: %s", test.value, err)
+		case !test.valid && err == nil:
+			t.Errorf("%q parsed as %d", test.value, rate)
+		case rate != test.rate:
+			t.Errorf("%q parsed as %d, want %d", test.value, rate, test.rate)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// Requests kept outstanding before we know anything about the peer, and
+	// the least we ever keep
+	requestQueueMin = 4
+	// How often the peer's download rate is sampled
+	requestQueueRateInterval = time.Second
+	// A request the peer didn't serve within this long means the peer is
+	// snubbing us
+	defaultRequestTimeout = time.Minute
+)
+
+// requestQueue decides how many block requests a peer gets to keep
+// outstanding. It is sized to twice the bandwidth-delay product of the
+// connection, the download rate times the lowest request round trip seen, so
+// the peer always has blocks to send while its rate can still grow. The peer's
+// reqq caps it. A snubbing peer only gets one request at a time until it
+// serves one.
+type requestQueue struct {
+	limit   int
+	pending map[BlockRequest]time.Time
+	snubbed bool
+
+	rate       float64
+	rateBytes  int
+	rateStart  time.Time
+	minLatency time.Duration
+}
+
+func newRequestQueue(limit int) *requestQueue {
+	return &requestQueue{
+		limit:     limit,
+		pending:   make(map[BlockRequest]time.Time),
+		rateStart: time.Now(),
+	}
+}
+
+// size is the number of requests the peer should have outstanding
+func (q *requestQueue) size() int {
+	if q.snubbed {
+		return 1
+	}
+
+	size := requestQueueMin
+
+	if q.rate > 0 && q.minLatency > 0 {
+		bdp := q.rate * q.minLatency.Seconds()
+		size = max(size, int(math.Ceil(2*bdp/blockSize)))
+	}
+
+	return min(size, q.limit)
+}
+
+func (q *requestQueue) hasRoom() bool {
+	return len(q.pending) < q.size()
+}
+
+func (q *requestQueue) outstanding() int {
+	return len(q.pending)
+}
+
+func (q *requestQueue) isPending(req BlockRequest) bool {
+	_, ok := q.pending[req]
+
+	return ok
+}
+
+func (q *requestQueue) sent(req BlockRequest) {
+	q.pending[req] = time.Now()
+}
+
+// received takes the request of an arrived block off the queue and updates
+// the rate and latency measurements, it tells whether the block was requested
+func (q *requestQueue) received(req BlockRequest) bool {
+	sentAt, ok := q.pending[req]
+	if !ok {
+		return false
+	}
+
+	delete(q.pending, req)
+	q.snubbed = false
+
+	now := time.Now()
+
+	latency := now.Sub(sentAt)
+	if q.minLatency == 0 || latency < q.minLatency {
+		q.minLatency = latency
+	}
+
+	q.rateBytes += req.Length
+	if elapsed := now.Sub(q.rateStart); elapsed >= requestQueueRateInterval {
+		sample := float64(q.rateBytes) / elapsed.Seconds()
+		if q.rate == 0 {
+			q.rate = sample
+		} else {
+			q.rate = (q.rate + sample) / 2
+		}
+
+		q.rateBytes = 0
+		q.rateStart = now
+	}
+
+	return true
+}
+
+// remove drops a request that won't be served, because it was rejected,
+// cancelled or lost to a choke
+func (q *requestQueue) remove(req BlockRequest) {
+	delete(q.pending, req)
+}
+
+// timedOut tells whether a request has been outstanding for longer than
+// timeout
+func (q *requestQueue) timedOut(timeout time.Duration) bool {
+	now := time.Now()
+
+	for _, sentAt := range q.pending {
+		if now.Sub(sentAt) > timeout {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (q *requestQueue) clear() {
+	q.pending = make(map[BlockRequest]time.Time)
+}
+
+// requestQueueLimit is the peer's reqq, peers that don't send one are assumed
+// to take as many requests as we do
+func (p *Peer) requestQueueLimit() int {
+	if p.Extensions.Handshake != nil && p.Extensions.Handshake.Reqq > 0 {
+		return p.Extensions.Handshake.Reqq
+	}
+
+	return defaultRequestQueueSize
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Requests for longer blocks are a protocol violation, everyone asks for
+// 16 KiB and some clients go up to 128 KiB
+const maxBlockRequestLength = 128 * 1024
+
+// Seeder uploads the pieces of a torrent we have in storage to the peers that
+// connect to us. A download serves the pieces it saved through one too,
+// adding them as they come.
+type Seeder struct {
+	MetaInfo   TorrentMetaInfo
+	Storage    *Storage
+	Extensions *ExtensionRegistry
+	// Decides who we upload to, every interested peer is unchoked when nil
+	Choker *Choker
+	// Peers silent for this long are dropped, defaultInactivityTimeout if
+	// zero
+	InactivityTimeout time.Duration
+	// Bandwidth caps of this torrent's peers, on top of the listener's
+	RateLimits *RateLimits
+
+	mu       sync.Mutex
+	have     PiecesMap
+	uploaded atomic.Int64
+	// Peers are served once however often they connect, the listener
+	// refuses our own connections
+	connected *connectedPeers
+}
+
+func NewSeeder(metafile TorrentMetaInfo, storage *Storage) *Seeder {
+	return &Seeder{
+		MetaInfo:  metafile,
+		Storage:   storage,
+		have:      NewPiecesMap(len(metafile.Info.Pieces)),
+		connected: newConnectedPeers(""),
+	}
+}
+
+// Verify hashes the pieces in storage, only pieces that pass are uploaded. It
+// returns the number of pieces we have.
+func (s *Seeder) Verify() int {
+	pieceLength := s.MetaInfo.Info.PieceLength
+	haveCount := 0
+
+	for pieceIndex, hash := range s.MetaInfo.Info.Pieces {
+		data := make([]byte, min(pieceLength, s.MetaInfo.Info.Length-pieceIndex*pieceLength))
+
+		_, err := s.Storage.ReadAt(data, int64(pieceIndex)*int64(pieceLength))
+		sum := sha1.Sum(data)
+		have := err == nil && bytes.Equal(sum[:], hash.Hash)
+
+		s.mu.Lock()
+		s.have.setPieceStatus(pieceIndex, have)
+		s.mu.Unlock()
+
+		if have {
+			haveCount++
+		}
+	}
+
+	return haveCount
+}
+
+func (s *Seeder) IsComplete() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.have.isComplete()
+}
+
+// AddPiece makes a piece that was written to storage and verified available
+// to peers, the sessions announce it on their next tick
+func (s *Seeder) AddPiece(pieceIndex int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.have.setPieceStatus(pieceIndex, true)
+}
+
+func (s *Seeder) hasPiece(pieceIndex int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.have.hasPiece(pieceIndex)
+}
+
+// havePieces returns a copy of the pieces we have
+func (s *Seeder) havePieces() []bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.have.PiecesStatus)
+}
+
+// Uploaded is the number of block bytes sent to peers
+func (s *Seeder) Uploaded() int64 {
+	return s.uploaded.Load()
+}
+
+func (s *Seeder) HandlePeer(peer *Peer) {
+	peer.HavePieces = NewPiecesMap(len(s.MetaInfo.Info.Pieces))
+
+	_, err := s.connected.add(peer, false)
+	if err != nil {
+		fmt.Printf("Refused %s: %s\n", peer.Addr.ToString(), err)
+		return
+	}
+
+	defer s.connected.remove(peer)
+
+	peer.Conn = limitConn(peer.Conn, s.RateLimits)
+
+	pc := NewPeerConn(peer)
+	if s.InactivityTimeout > 0 {
+		pc.InactivityTimeout = s.InactivityTimeout
+	}
+
+	session := &seedSession{
+		seeder: s,
+		pc:     pc,
+	}
+
+	err = session.run()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, ErrBothSeeders) {
+		fmt.Printf("Stopped seeding to %s: %s\n", peer.Addr.ToString(), err)
+	}
+}
+
+// seedSession serves one peer. Requested blocks are read from storage and
+// queued on the connection, cancels take them off the queue if they weren't
+// sent yet.
+type seedSession struct {
+	seeder *Seeder
+	pc     *PeerConn
+	// Pieces the peer may request while choked, set before the session runs
+	allowedFast map[int]bool
+	// Pieces the peer was told we have
+	announced []bool
+}
+
+func (ss *seedSession) run() error {
+	s := ss.seeder
+	peer := ss.pc.Peer
+
+	ss.pc.Events = PeerConnEvents{
+		Have: func(pieceIndex int) error {
+			return ss.checkSeeder()
+		},
+
+		Bitfield: ss.checkSeeder,
+
+		Extended: func(msg ExtendedMessage) error {
+			if s.Extensions == nil {
+				return nil
+			}
+
+			return s.Extensions.HandleMessage(peer, msg)
+		},
+	}
+
+	ss.serveEvents(&ss.pc.Events)
+
+	err := ss.sendGreeting()
+	if err != nil {
+		return err
+	}
+
+	if s.Choker != nil {
+		s.Choker.AddPeer(peer, ss.setChoked)
+		defer s.Choker.RemovePeer(peer)
+	}
+
+	return ss.pc.Run()
+}
+
+// serveEvents sets the events of the peer's interest, requests and the
+// blocks we send it. The other events are left to the caller, a download
+// handles them itself.
+func (ss *seedSession) serveEvents(events *PeerConnEvents) {
+	s := ss.seeder
+	peer := ss.pc.Peer
+
+	events.Interested = func() error {
+		if s.Choker == nil {
+			return ss.setChoked(false)
+		}
+
+		s.Choker.SetInterested(peer, true)
+
+		return nil
+	}
+
+	events.NotInterested = func() error {
+		if s.Choker != nil {
+			s.Choker.SetInterested(peer, false)
+		}
+
+		return nil
+	}
+
+	events.Request = ss.request
+
+	events.Cancel = func(req BlockRequest) error {
+		ss.pc.Unqueue(func(msg Message) bool {
+			piece, ok := msg.(PieceMessage)
+
+			return ok && piece.request() == req
+		})
+
+		return nil
+	}
+
+	events.BlockSent = func(req BlockRequest) {
+		s.uploaded.Add(int64(req.Length))
+
+		if s.Choker != nil {
+			s.Choker.Uploaded(peer, req.Length)
+		}
+	}
+}
+
+// sendGreeting queues what we have and which pieces the peer may request
+// while choked
+func (ss *seedSession) sendGreeting() error {
+	peer := ss.pc.Peer
+	s := ss.seeder
+
+	if s.Extensions != nil && peer.SupportsExtensionProtocol() {
+		err := peer.SendExtendedHandshake(s.Extensions)
+		if err != nil {
+			return err
+		}
+	}
+
+	fast := peer.SupportsFastExtension()
+	have := s.havePieces()
+	ss.announced = have
+
+	switch {
+	case fast && !slices.Contains(have, false):
+		err := peer.SendHaveAll()
+		if err != nil {
+			return err
+		}
+
+	case fast && !slices.Contains(have, true):
+		err := peer.SendHaveNone()
+		if err != nil {
+			return err
+		}
+
+	default:
+		err := peer.WriteMessage(BitfieldMessage{Bitfield: encodeBitfield(have)})
+		if err != nil {
+			return err
+		}
+	}
+
+	if !fast {
+		return nil
+	}
+
+	ss.allowedFast = make(map[int]bool)
+	for _, pieceIndex := range allowedFastSet(peer.Addr.Ip, s.MetaInfo.InfoHash, len(s.MetaInfo.Info.Pieces), allowedFastSetSize) {
+		ss.allowedFast[pieceIndex] = true
+
+		err := peer.SendAllowedFast(pieceIndex)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func encodeBitfield(have []bool) []byte {
+	bitfield := make([]byte, (len(have)+7)/8)
+	for pieceIndex, has := range have {
+		if has {
+			bitfield[pieceIndex/8] |= 0x80 >> (pieceIndex % 8)
+		}
+	}
+
+	return bitfield
+}
+
+// sendHaves tells the peer about the pieces we got since the greeting
+func (ss *seedSession) sendHaves() error {
+	for pieceIndex, have := range ss.seeder.havePieces() {
+		if !have || ss.announced[pieceIndex] {
+			continue
+		}
+
+		ss.announced[pieceIndex] = true
+
+		err := ss.pc.Send(HaveMessage{Index: pieceIndex})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkSeeder ends the session once the peer has every piece while we do
+// too, neither side would ever be interested
+func (ss *seedSession) checkSeeder() error {
+	if ss.seeder.IsComplete() && ss.pc.Peer.HavePieces.isComplete() {
+		return ErrBothSeeders
+	}
+
+	return nil
+}
+
+// setChoked chokes or unchokes the peer. Choking drops the queued blocks
+// except those of allowed fast pieces, peers with the Fast Extension are told
+// which ones with rejects.
+func (ss *seedSession) setChoked(choked bool) error {
+	peer := ss.pc.Peer
+
+	if !choked {
+		return ss.pc.SetChoking(false)
+	}
+
+	dropped := ss.pc.Unqueue(func(msg Message) bool {
+		piece, ok := msg.(PieceMessage)
+
+		return ok && !ss.allowedFast[piece.Index]
+	})
+
+	err := ss.pc.SetChoking(true)
+	if err != nil || !peer.SupportsFastExtension() {
+		return err
+	}
+
+	for _, msg := range dropped {
+		err = peer.SendRejectRequest(msg.(PieceMessage).request())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// request queues a block the peer asked for. Requests we can't serve are
+// rejected if the peer has the Fast Extension and dropped otherwise.
+func (ss *seedSession) request(req BlockRequest) error {
+	s := ss.seeder
+	peer := ss.pc.Peer
+	info := s.MetaInfo.Info
+
+	if req.Index < 0 || req.Index >= len(info.Pieces) {
+		return fmt.Errorf("request for invalid piece index %d", req.Index)
+	}
+
+	pieceLength := min(info.PieceLength, info.Length-req.Index*info.PieceLength)
+	if req.Length <= 0 || req.Length > maxBlockRequestLength || req.Begin < 0 || req.Begin+req.Length > pieceLength {
+		return fmt.Errorf("invalid request of %d bytes at offset %d in piece #%d", req.Length, req.Begin, req.Index)
+	}
+
+	allowed := s.hasPiece(req.Index) &&
+		(!ss.pc.AmChoking() || ss.allowedFast[req.Index]) &&
+		ss.pc.Queued() < defaultRequestQueueSize
+
+	if !allowed {
+		if peer.SupportsFastExtension() {
+			return peer.SendRejectRequest(req)
+		}
+
+		return nil
+	}
+
+	block := make([]byte, req.Length)
+	offset := int64(req.Index)*int64(info.PieceLength) + int64(req.Begin)
+
+	_, err := s.Storage.ReadAt(block, offset)
+	if err != nil {
+		return err
+	}
+
+	return ss.pc.Send(PieceMessage{PieceBlock{Index: req.Index, Begin: req.Begin, Block: block}})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+type storageFile struct {
+	path   string
+	offset int64
+	length int64
+	f      *os.File
+}
+
+// Storage reads the torrent's data from its files on disk. The torrent is one
+// stream of bytes split into pieces, Storage maps offsets in that stream to
+// the files they fall in.
+type Storage struct {
+	files  []storageFile
+	length int64
+}
+
+// OpenStorage opens the files of the torrent at path. For a single file
+// torrent path is the file or the directory containing it, for a multi file
+// torrent it is the torrent's directory or the directory containing it.
+func OpenStorage(metafile TorrentMetaInfo, path string) (*Storage, error) {
+	paths, err := storagePaths(metafile, path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Storage{}
+
+	for i, file := range metafile.Info.Files {
+		sf := storageFile{path: paths[i], offset: s.length, length: int64(file.Length)}
+		s.length += sf.length
+
+		// Empty files hold no pieces and don't have to exist
+		if sf.length > 0 {
+			sf.f, err = os.Open(sf.path)
+			if err != nil {
+				s.Close()
+				return nil, err
+			}
+		}
+
+		s.files = append(s.files, sf)
+	}
+
+	return s, nil
+}
+
+// storagePaths finds where each file of the torrent is on disk
+func storagePaths(metafile TorrentMetaInfo, path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	root := path
+
+	switch {
+	case !metafile.Info.MultiFile && !info.IsDir():
+		return []string{path}, nil
+
+	case metafile.Info.MultiFile && !info.IsDir():
+		return nil, fmt.Errorf("%s is not a directory", path)
+
+	case metafile.Info.MultiFile && filepath.Base(path) != metafile.Info.Name:
+		nested := filepath.Join(path, metafile.Info.Name)
+		if info, err := os.Stat(nested); err == nil && info.IsDir() {
+			root = nested
+		}
+	}
+
+	paths := make([]string, 0, len(metafile.Info.Files))
+	for _, file := range metafile.Info.Files {
+		filePath, err := storageFilePath(root, file.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		paths = append(paths, filePath)
+	}
+
+	return paths, nil
+}
+
+// storageFilePath joins the path components of a file in the torrent, which
+// must stay below root
+func storageFilePath(root string, components []string) (string, error) {
+	if len(components) == 0 {
+		return "", fmt.Errorf("torrent file with an empty path")
+	}
+
+	for _, component := range components {
+		if component == "" || component == "." || component == ".." || filepath.Base(component) != component {
+			return "", fmt.Errorf("invalid torrent file path %q", components)
+		}
+	}
+
+	return filepath.Join(append([]string{root}, components...)...), nil
+}
+
+// ReadAt reads len(b) bytes of the torrent starting at off, possibly across
+// several files
+func (s *Storage) ReadAt(b []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(b)) > s.length {
+		return 0, fmt.Errorf("read of %d bytes at %d is outside the torrent", len(b), off)
+	}
+
+	// The first file that ends after off
+	fileIndex := sort.Search(len(s.files), func(i int) bool {
+		return s.files[i].offset+s.files[i].length > off
+	})
+
+	n := 0
+	for n < len(b) && fileIndex < len(s.files) {
+		file := s.files[fileIndex]
+		fileIndex++
+
+		if file.length == 0 {
+			continue
+		}
+
+		fileOffset := off + int64(n) - file.offset
+		chunk := b[n:min(len(b), n+int(file.length-fileOffset))]
+
+		read, err := file.f.ReadAt(chunk, fileOffset)
+		n += read
+		if err == io.EOF {
+			return n, fmt.Errorf("%s is shorter than %d bytes", file.path, file.length)
+		}
+
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+func (s *Storage) Close() error {
+	var err error
+
+	for _, file := range s.files {
+		if file.f != nil {
+			if closeErr := file.f.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	}
+
+	return err
+}
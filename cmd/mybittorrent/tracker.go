@@ -2,41 +2,78 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
+// Port announced when the tracker isn't told where we listen
+const defaultAnnouncePort = 6881
+
+// HTTP trackers that don't answer within this time are given up on
+const trackerHttpTimeout = 30 * time.Second
+
 type Tracker struct {
 	AnnounceUrl string
 	PeerId      string
 	Interval    int
+	// Port peers can connect to us on
+	Port uint16
+	// Seeders announce that they have nothing left to download
+	Seeding bool
+	// How long to wait for a UDP tracker's reply before sending the request
+	// again, doubled on every retransmit, udpTrackerTimeout if zero
+	UdpTimeout time.Duration
+}
+
+func (t *Tracker) announcePort() uint16 {
+	if t.Port == 0 {
+		return defaultAnnouncePort
+	}
+
+	return t.Port
+}
+
+func (t *Tracker) left(metafile TorrentMetaInfo) int {
+	if t.Seeding {
+		return 0
+	}
+
+	return metafile.Info.Length
 }
 
 type PeersResponse struct {
 	Interval int
 	Peers    []Addr
+	// Peer ids by address, only peers not sent in compact form have one
+	PeerIds map[string]string
 }
 
-func (t *Tracker) getPeers(metafile TorrentMetaInfo) ([]Peer, error) {
+// getPeers announces us to the tracker and returns the peers it knows,
+// cancelling ctx stops waiting for the tracker
+func (t *Tracker) getPeers(ctx context.Context, metafile TorrentMetaInfo) ([]Peer, error) {
 	switch {
 	case strings.HasPrefix(t.AnnounceUrl, "http"):
-		return t.getPeersHttp(metafile)
+		return t.getPeersHttp(ctx, metafile)
 	case strings.HasPrefix(t.AnnounceUrl, "udp"):
-		return t.getPeersUdp(metafile)
+		return t.getPeersUdp(ctx, metafile)
 	default:
 		return nil, fmt.Errorf("undexpected tracker proticol %s", metafile.Announce)
 	}
 }
 
-func (t *Tracker) getPeersHttp(metafile TorrentMetaInfo) ([]Peer, error) {
-	client := http.Client{}
-	req, err := createHttpPeersRequest(t.PeerId, metafile)
+func (t *Tracker) getPeersHttp(ctx context.Context, metafile TorrentMetaInfo) ([]Peer, error) {
+	client := http.Client{Timeout: trackerHttpTimeout}
+	req, err := t.createHttpPeersRequest(ctx, metafile)
 	if err != nil {
 		return nil, err
 	}
@@ -63,6 +100,7 @@ func (t *Tracker) getPeersHttp(metafile TorrentMetaInfo) ([]Peer, error) {
 	for i, peerAddr := range responseStruct.Peers {
 		peers[i] = Peer{
 			Addr:       peerAddr,
+			PeerId:     responseStruct.PeerIds[peerAddr.ToString()],
 			HavePieces: NewPiecesMap(len(metafile.Info.Pieces)),
 		}
 	}
@@ -78,168 +116,295 @@ func decodeHttpPeersRespone(r *io.ReadCloser) (PeersResponse, error) {
 		return resp, err
 	}
 
-	respMap := decodedResp.(map[string]any)
+	respMap, ok := decodedResp.(map[string]any)
+	if !ok {
+		return resp, fmt.Errorf("unexpected peers response")
+	}
 
-	resp.Interval = respMap["interval"].(int)
-	endcodedPeers := respMap["peers"].(string)
+	if reason, ok := respMap["failure reason"].(string); ok {
+		return resp, fmt.Errorf("announce failed: %s", reason)
+	}
 
-	reader := strings.NewReader(endcodedPeers)
+	resp.Interval, _ = respMap["interval"].(int)
 
-	buff := make([]byte, 6)
+	switch peers := respMap["peers"].(type) {
+	case string:
+		resp.Peers, err = decodeCompactAddrs([]byte(peers), 6)
+		if err != nil {
+			return resp, err
+		}
 
-	for {
-		_, err := reader.Read(buff)
-		if err == io.EOF {
-			break
+	case []any:
+		for _, peer := range peers {
+			peerMap, ok := peer.(map[string]any)
+			if !ok {
+				continue
+			}
+
+			ip, _ := peerMap["ip"].(string)
+			port, _ := peerMap["port"].(int)
+
+			addr := Addr{Ip: net.ParseIP(ip), Port: uint16(port)}
+			if addr.Ip == nil {
+				continue
+			}
+
+			resp.Peers = append(resp.Peers, addr)
+
+			if peerId, ok := peerMap["peer id"].(string); ok {
+				if resp.PeerIds == nil {
+					resp.PeerIds = make(map[string]string)
+				}
+
+				resp.PeerIds[addr.ToString()] = peerId
+			}
 		}
+	}
 
-		addr := Addr{}
-		err = addr.ReadFromBytes(buff)
+	if peers6, ok := respMap["peers6"].(string); ok {
+		addrs, err := decodeCompactAddrs([]byte(peers6), 18)
 		if err != nil {
 			return resp, err
 		}
 
-		resp.Peers = append(resp.Peers, addr)
+		resp.Peers = append(resp.Peers, addrs...)
 	}
 
-	return resp, err
+	return resp, nil
 }
 
-func createHttpPeersRequest(peerId string, metafile TorrentMetaInfo) (*http.Request, error) {
-	req, err := http.NewRequest("GET", metafile.Announce, nil)
+func (t *Tracker) createHttpPeersRequest(ctx context.Context, metafile TorrentMetaInfo) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", metafile.Announce, nil)
 	if err != nil {
 		return nil, err
 	}
 
 	query := req.URL.Query()
 	query.Add("info_hash", metafile.InfoHash.String())
-	query.Add("peer_id", peerId)
-	query.Add("port", "6881")
+	query.Add("peer_id", t.PeerId)
+	query.Add("port", strconv.Itoa(int(t.announcePort())))
 	query.Add("uploaded", "0")
 	query.Add("downloaded", "0")
-	query.Add("left", strconv.Itoa(metafile.Info.Length))
+	query.Add("left", strconv.Itoa(t.left(metafile)))
 	query.Add("compact", "1")
 	req.URL.RawQuery = query.Encode()
 
 	return req, nil
 }
 
-func (t *Tracker) getPeersUdp(metafile TorrentMetaInfo) ([]Peer, error) {
-	u, err := url.Parse(t.AnnounceUrl)
+// UDP tracker protocol actions (BEP 15)
+const (
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+)
+
+// A UDP request without a reply is sent again after udpTrackerTimeout·2ⁿ,
+// n being the number of retransmits so far (BEP 15). The BEP goes on up to
+// n = 8, over an hour, we give up after udpTrackerRetransmits so a dead
+// tracker fails within minutes.
+const (
+	udpTrackerTimeout     = 15 * time.Second
+	udpTrackerRetransmits = 3
+)
+
+func (t *Tracker) getPeersUdp(ctx context.Context, metafile TorrentMetaInfo) ([]Peer, error) {
+	conn, err := t.dialUdp()
 	if err != nil {
 		return nil, err
 	}
 
-	peerPort, err := strconv.Atoi(u.Port())
+	defer conn.Close()
+
+	// Closing the socket ends the read waiting for a reply
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	connection_id, err := t.udpConnect(conn)
 	if err != nil {
 		return nil, err
 	}
 
-	a, err := net.LookupIP(u.Hostname())
+	buf := make([]byte, 100)
+
+	peersRequested := 100
+	binary.BigEndian.PutUint64(buf[0:8], connection_id)              // int64_t 	connection_id 	The connection id acquired from establishing the connection.
+	binary.BigEndian.PutUint32(buf[8:12], udpActionAnnounce)         // int32_t 	action 	Action. in this case, 1 for announce. See actions.
+	copyToSlice(buf, metafile.InfoHash.Hash, 16)                     // int8_t[20] 	info_hash 	The info-hash of the torrent you want announce yourself in.
+	copyToSlice(buf, []byte(t.PeerId), 36)                           // int8_t[20] 	peer_id 	Your peer id.
+	binary.BigEndian.PutUint64(buf[56:64], 0)                        // int64_t 	downloaded 	The number of byte you've downloaded in this session.
+	binary.BigEndian.PutUint64(buf[64:72], uint64(t.left(metafile))) // int64_t 	left 	The number of bytes you have left to download until you're finished.
+	binary.BigEndian.PutUint64(buf[72:80], 0)                        // int64_t 	uploaded 	The number of bytes you have uploaded in this session.
+	binary.BigEndian.PutUint32(buf[80:84], 0)                        // int32_t 	event
+	binary.BigEndian.PutUint32(buf[84:88], 0)                        // uint32_t 	ip 	Your ip address. Set to 0 if you want the tracker to use the sender of this UDP packet.
+	binary.BigEndian.PutUint32(buf[88:92], rand.Uint32())            // uint32_t 	key 	A unique key that is randomized by the client.
+	binary.BigEndian.PutUint32(buf[92:96], uint32(peersRequested))   // int32_t 	num_want 	The maximum number of peers you want in the reply. Use -1 for default.
+	binary.BigEndian.PutUint16(buf[96:98], t.announcePort())         // uint16_t 	port 	The port you're listening on.
+	binary.BigEndian.PutUint16(buf[98:100], 0)                       // uint16_t 	extensions
+
+	reply, err := t.udpTrackerRequest(conn, buf, udpActionAnnounce, 20, 100+peersRequested*6)
 	if err != nil {
 		return nil, err
 	}
 
-	raddr := net.UDPAddr{
-		IP:   a[0],
-		Port: peerPort,
+	interval := binary.BigEndian.Uint32(reply[8:12])
+	peerData := reply[20:]
+
+	// Trackers reached over IPv6 reply with 18 byte IPv6 peer addresses
+	addrSize := 6
+	if conn.RemoteAddr().(*net.UDPAddr).IP.To4() == nil {
+		addrSize = 18
 	}
 
-	conn, err := net.DialUDP("udp", nil, &raddr)
+	addrs, err := decodeCompactAddrs(peerData, addrSize)
 	if err != nil {
 		return nil, err
 	}
 
-	defer conn.Close()
+	t.Interval = int(interval)
 
-	buf := make([]byte, 16)
+	peers := make([]Peer, 0, len(addrs))
+	for _, addr := range addrs {
+		peers = append(peers, Peer{
+			Addr:       addr,
+			HavePieces: NewPiecesMap(len(metafile.Info.Pieces)),
+		})
+	}
 
-	transactionId := 4609668
-	binary.BigEndian.PutUint64(buf[0:], 0x41727101980)          // connection_id
-	binary.BigEndian.PutUint32(buf[8:], 0)                      // action
-	binary.BigEndian.PutUint32(buf[12:], uint32(transactionId)) // transaction_id
+	return peers, nil
+}
 
-	_, err = conn.Write(buf)
+func (t *Tracker) dialUdp() (*net.UDPConn, error) {
+	u, err := url.Parse(t.AnnounceUrl)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := readBytes(conn, 16)
+	peerPort, err := strconv.Atoi(u.Port())
 	if err != nil {
 		return nil, err
 	}
 
-	action := binary.BigEndian.Uint32(resp[:4])
-	transaction_id := binary.BigEndian.Uint32(resp[4:8])
-	connection_id := binary.BigEndian.Uint64(resp[8:])
+	a, err := net.LookupIP(u.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	raddr := net.UDPAddr{
+		IP:   a[0],
+		Port: peerPort,
+	}
 
-	fmt.Printf("Action: %d, Transaction: %d, connection: %d \n", action, transaction_id, connection_id)
+	return net.DialUDP("udp", nil, &raddr)
+}
 
-	buf = make([]byte, 100)
+func (t *Tracker) udpConnect(conn *net.UDPConn) (uint64, error) {
+	buf := make([]byte, 16)
 
-	peersRequested := 100
-	binary.BigEndian.PutUint64(buf[0:8], connection_id)                  // int64_t 	connection_id 	The connection id acquired from establishing the connection.
-	binary.BigEndian.PutUint32(buf[8:12], 1)                             // int32_t 	action 	Action. in this case, 1 for announce. See actions.
-	binary.BigEndian.PutUint32(buf[12:16], uint32(transactionId))        // int32_t 	transaction_id 	Randomized by client.
-	copyToSlice(buf, metafile.InfoHash.Hash, 16)                         // int8_t[20] 	info_hash 	The info-hash of the torrent you want announce yourself in.
-	copyToSlice(buf, []byte(t.PeerId), 36)                               // int8_t[20] 	peer_id 	Your peer id.
-	binary.BigEndian.PutUint64(buf[56:64], 0)                            // int64_t 	downloaded 	The number of byte you've downloaded in this session.
-	binary.BigEndian.PutUint64(buf[64:72], uint64(metafile.Info.Length)) // int64_t 	left 	The number of bytes you have left to download until you're finished.
-	binary.BigEndian.PutUint64(buf[72:80], 0)                            // int64_t 	uploaded 	The number of bytes you have uploaded in this session.
-	binary.BigEndian.PutUint32(buf[80:84], 0)                            // int32_t 	event
-	binary.BigEndian.PutUint32(buf[84:88], 0)                            // uint32_t 	ip 	Your ip address. Set to 0 if you want the tracker to use the sender of this UDP packet.
-	binary.BigEndian.PutUint32(buf[88:92], uint32(transactionId))        // uint32_t 	key 	A unique key that is randomized by the client.
-	binary.BigEndian.PutUint32(buf[92:96], uint32(peersRequested))       // int32_t 	num_want 	The maximum number of peers you want in the reply. Use -1 for default.
-	binary.BigEndian.PutUint16(buf[96:98], 9999)                         // uint16_t 	port 	The port you're listening on.
-	binary.BigEndian.PutUint16(buf[98:100], 0)                           // uint16_t 	extensions
+	binary.BigEndian.PutUint64(buf[0:], 0x41727101980) // connection_id
+	binary.BigEndian.PutUint32(buf[8:], 0)             // action
 
-	n, err := conn.Write(buf)
+	// Error replies carry a message, so the reply may be longer than 16 bytes
+	resp, err := t.udpTrackerRequest(conn, buf, udpActionConnect, 16, 512)
 	if err != nil {
-		fmt.Printf("N: %d \n", n)
-		return nil, err
+		return 0, err
 	}
 
-	buf = make([]byte, 100+peersRequested*6)
-	readed, err := conn.Read(buf)
-	if err != nil {
-		return nil, err
+	connection_id := binary.BigEndian.Uint64(resp[8:16])
+
+	return connection_id, nil
+}
+
+// udpTrackerRequest sends request with a new random transaction id and
+// returns the reply to it, sending the request again while none comes.
+// Replies to other transactions are late replies to earlier requests and are
+// skipped. The reply must have the expected action and be minLength to
+// maxLength bytes long.
+func (t *Tracker) udpTrackerRequest(conn *net.UDPConn, request []byte, action uint32, minLength int, maxLength int) ([]byte, error) {
+	transactionId := rand.Uint32()
+	binary.BigEndian.PutUint32(request[12:16], transactionId) // transaction_id
+
+	timeout := t.UdpTimeout
+	if timeout == 0 {
+		timeout = udpTrackerTimeout
 	}
 
-	action = binary.BigEndian.Uint32(buf[:4])
-	transaction_id = binary.BigEndian.Uint32(buf[4:8])
-	interval := binary.BigEndian.Uint32(buf[8:12])
-	leechers := binary.BigEndian.Uint32(buf[12:16])
-	seeders := binary.BigEndian.Uint32(buf[16:20])
+	for retransmits := 0; retransmits <= udpTrackerRetransmits; retransmits++ {
+		_, err := conn.Write(request)
+		if err != nil {
+			return nil, err
+		}
+
+		deadline := time.Now().Add(timeout << retransmits)
 
-	fmt.Printf("Action: %d, Transaction: %d, interval: %d, leechers: %d, seeders: %d \n", action, transaction_id, interval, leechers, seeders)
+		reply, err := readUdpTrackerReply(conn, deadline, action, transactionId, minLength, maxLength)
 
-	peerData := buf[20:readed]
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			continue
+		}
 
-	peers := make([]Peer, 0)
+		return reply, err
+	}
 
-	t.Interval = int(interval)
+	return nil, fmt.Errorf("tracker didn't reply to %d requests", udpTrackerRetransmits+1)
+}
+
+// readUdpTrackerReply reads until the reply to transactionId comes or the
+// deadline passes
+func readUdpTrackerReply(conn *net.UDPConn, deadline time.Time, action uint32, transactionId uint32, minLength int, maxLength int) ([]byte, error) {
+	conn.SetReadDeadline(deadline)
+
+	reply := make([]byte, maxLength)
 
 	for {
-		addr := Addr{}
-		err = addr.ReadFromBytes(peerData[:6])
+		readed, err := conn.Read(reply)
 		if err != nil {
 			return nil, err
 		}
 
-		peerData = peerData[6:]
-
-		peer := Peer{
-			Addr:       addr,
-			HavePieces: NewPiecesMap(len(metafile.Info.Pieces)),
+		if readed >= 8 && binary.BigEndian.Uint32(reply[4:8]) != transactionId {
+			continue
 		}
 
-		peers = append(peers, peer)
-		if len(peerData) == 0 {
-			break
+		err = checkUdpTrackerReply(reply[:readed], action, transactionId, minLength)
+		if err != nil {
+			return nil, err
 		}
+
+		return reply[:readed], nil
 	}
+}
 
-	return peers, nil
+// checkUdpTrackerReply checks that a UDP tracker reply answers our request
+// with the expected action and is at least minLength bytes long, error
+// replies become errors carrying the tracker's message
+func checkUdpTrackerReply(reply []byte, action uint32, transactionId uint32, minLength int) error {
+	if len(reply) < 8 {
+		return fmt.Errorf("tracker reply of %d bytes is too short", len(reply))
+	}
+
+	replyAction := binary.BigEndian.Uint32(reply[:4])
+	replyTransactionId := binary.BigEndian.Uint32(reply[4:8])
+
+	if replyTransactionId != transactionId {
+		return fmt.Errorf("unexpected transaction id %d", replyTransactionId)
+	}
+
+	if replyAction == udpActionError {
+		return fmt.Errorf("tracker error: %s", string(reply[8:]))
+	}
+
+	if replyAction != action {
+		return fmt.Errorf("unexpected tracker action %d", replyAction)
+	}
+
+	if len(reply) < minLength {
+		return fmt.Errorf("tracker reply of %d bytes is too short", len(reply))
+	}
+
+	return nil
 }
 
 func copyToSlice(target []byte, source []byte, targetOffset int) {
@@ -247,3 +412,160 @@ func copyToSlice(target []byte, source []byte, targetOffset int) {
 		target[i+targetOffset] = b
 	}
 }
+
+type ScrapeResult struct {
+	InfoHash  Hash
+	Seeders   int
+	Leechers  int
+	Completed int
+}
+
+func (t *Tracker) Scrape(infoHashes []Hash) ([]ScrapeResult, error) {
+	switch {
+	case strings.HasPrefix(t.AnnounceUrl, "http"):
+		return t.scrapeHttp(infoHashes)
+	case strings.HasPrefix(t.AnnounceUrl, "udp"):
+		return t.scrapeUdp(infoHashes)
+	default:
+		return nil, fmt.Errorf("undexpected tracker proticol %s", t.AnnounceUrl)
+	}
+}
+
+// The scrape URL is derived from the announce URL by replacing the "announce"
+// at the start of the last path segment with "scrape". Trackers whose announce
+// URL doesn't follow this convention don't support scrape.
+func scrapeUrl(announceUrl string) (string, error) {
+	u, err := url.Parse(announceUrl)
+	if err != nil {
+		return "", err
+	}
+
+	slashIndex := strings.LastIndex(u.Path, "/")
+	lastSegment := u.Path[slashIndex+1:]
+
+	if !strings.HasPrefix(lastSegment, "announce") {
+		return "", fmt.Errorf("tracker %s doesn't support scrape", announceUrl)
+	}
+
+	u.Path = u.Path[:slashIndex+1] + "scrape" + strings.TrimPrefix(lastSegment, "announce")
+
+	return u.String(), nil
+}
+
+func (t *Tracker) scrapeHttp(infoHashes []Hash) ([]ScrapeResult, error) {
+	scrapeUrl, err := scrapeUrl(t.AnnounceUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("GET", scrapeUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	query := req.URL.Query()
+	for _, infoHash := range infoHashes {
+		query.Add("info_hash", infoHash.String())
+	}
+	req.URL.RawQuery = query.Encode()
+
+	client := http.Client{Timeout: trackerHttpTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("scrape - error response %d", resp.StatusCode)
+	}
+
+	return decodeHttpScrapeResponse(bufio.NewReader(resp.Body), infoHashes)
+}
+
+func decodeHttpScrapeResponse(r *bufio.Reader, infoHashes []Hash) ([]ScrapeResult, error) {
+	decodedResp, err := decodeBencode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	respMap, ok := decodedResp.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("unexpected scrape response")
+	}
+
+	if reason, ok := respMap["failure reason"].(string); ok {
+		return nil, fmt.Errorf("scrape failed: %s", reason)
+	}
+
+	files, ok := respMap["files"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("scrape response has no files")
+	}
+
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		stats, ok := files[infoHash.String()].(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("scrape response has no stats for %s", infoHash.Hex())
+		}
+
+		result := ScrapeResult{InfoHash: infoHash}
+		result.Seeders, _ = stats["complete"].(int)
+		result.Leechers, _ = stats["incomplete"].(int)
+		result.Completed, _ = stats["downloaded"].(int)
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// A single UDP scrape packet can carry at most 74 info hashes
+const maxUdpScrapeHashes = 74
+
+func (t *Tracker) scrapeUdp(infoHashes []Hash) ([]ScrapeResult, error) {
+	conn, err := t.dialUdp()
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	connection_id, err := t.udpConnect(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]ScrapeResult, 0, len(infoHashes))
+
+	for len(infoHashes) > 0 {
+		batch := infoHashes[:min(len(infoHashes), maxUdpScrapeHashes)]
+		infoHashes = infoHashes[len(batch):]
+
+		buf := make([]byte, 16+20*len(batch))
+		binary.BigEndian.PutUint64(buf[0:8], connection_id) // connection_id
+		binary.BigEndian.PutUint32(buf[8:12], 2)            // action - 2 for scrape
+		for i, infoHash := range batch {
+			copyToSlice(buf, infoHash.Hash, 16+20*i) // info_hash
+		}
+
+		buf, err = t.udpTrackerRequest(conn, buf, udpActionScrape, 8+12*len(batch), 8+12*len(batch)+100)
+		if err != nil {
+			return nil, fmt.Errorf("scrape failed: %w", err)
+		}
+
+		for i, infoHash := range batch {
+			offset := 8 + 12*i
+			results = append(results, ScrapeResult{
+				InfoHash:  infoHash,
+				Seeders:   int(binary.BigEndian.Uint32(buf[offset : offset+4])),
+				Completed: int(binary.BigEndian.Uint32(buf[offset+4 : offset+8])),
+				Leechers:  int(binary.BigEndian.Uint32(buf[offset+8 : offset+12])),
+			})
+		}
+	}
+
+	return results, nil
+}
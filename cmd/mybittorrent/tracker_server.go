@@ -0,0 +1,768 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	trackerDefaultNumWant = 50
+	trackerMaxNumWant     = 200
+	// Expired peers are dropped and the state saved at most this often, and
+	// at least this rarely
+	trackerMinHousekeepingInterval = time.Second
+	trackerMaxHousekeepingInterval = time.Minute
+)
+
+type TrackerServerConfig struct {
+	HttpAddr    string
+	UdpAddr     string
+	Interval    time.Duration
+	MinInterval time.Duration
+	PeerTTL     time.Duration
+	// Only these info hashes (hex encoded) are tracked, nil allows any
+	AllowedInfoHashes map[string]bool
+	// Swarms are kept in memory only when empty
+	StatePath string
+}
+
+type trackerPeer struct {
+	PeerId   string
+	Ip       net.IP
+	Port     uint16
+	Left     int
+	LastSeen time.Time
+}
+
+type trackerSwarm struct {
+	Peers     map[string]*trackerPeer
+	Completed int
+}
+
+func (s *trackerSwarm) counts() (seeders int, leechers int) {
+	for _, peer := range s.Peers {
+		if peer.Left == 0 {
+			seeders++
+		} else {
+			leechers++
+		}
+	}
+
+	return seeders, leechers
+}
+
+type TrackerServer struct {
+	Config TrackerServerConfig
+
+	mu     sync.Mutex
+	swarms map[string]*trackerSwarm
+
+	udpSecret  []byte
+	httpServer *http.Server
+	udpConn    *net.UDPConn
+	done       chan struct{}
+	wg         sync.WaitGroup
+}
+
+type announceRequest struct {
+	InfoHash   string
+	PeerId     string
+	Ip         net.IP
+	Port       uint16
+	Uploaded   int
+	Downloaded int
+	Left       int
+	Event      string
+	NumWant    int
+}
+
+type announceResult struct {
+	Seeders  int
+	Leechers int
+	Peers    []trackerPeer
+}
+
+var ErrTrackerInfoHashNotAllowed = errors.New("info hash is not allowed on this tracker")
+
+func NewTrackerServer(config TrackerServerConfig) (*TrackerServer, error) {
+	if config.Interval < 0 || config.MinInterval < 0 || config.PeerTTL < 0 {
+		return nil, fmt.Errorf("tracker intervals can't be negative")
+	}
+
+	if config.Interval == 0 {
+		config.Interval = 30 * time.Minute
+	}
+
+	if config.MinInterval == 0 {
+		config.MinInterval = config.Interval / 2
+	}
+
+	if config.PeerTTL == 0 {
+		config.PeerTTL = config.Interval * 3 / 2
+	}
+
+	return &TrackerServer{
+		Config: config,
+		swarms: make(map[string]*trackerSwarm),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+func (s *TrackerServer) Start() error {
+	s.udpSecret = make([]byte, 16)
+	_, err := rand.Read(s.udpSecret)
+	if err != nil {
+		return err
+	}
+
+	if s.Config.StatePath != "" {
+		err = s.loadState()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.Config.HttpAddr != "" {
+		listener, err := net.Listen("tcp", s.Config.HttpAddr)
+		if err != nil {
+			return err
+		}
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/announce", s.handleHttpAnnounce)
+		mux.HandleFunc("/scrape", s.handleHttpScrape)
+		s.httpServer = &http.Server{Handler: mux}
+
+		fmt.Printf("HTTP tracker listening on %s\n", listener.Addr())
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.httpServer.Serve(listener)
+		}()
+	}
+
+	if s.Config.UdpAddr != "" {
+		addr, err := net.ResolveUDPAddr("udp", s.Config.UdpAddr)
+		if err != nil {
+			return err
+		}
+
+		s.udpConn, err = net.ListenUDP("udp", addr)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("UDP tracker listening on %s\n", s.udpConn.LocalAddr())
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveUdp()
+		}()
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.housekeeping()
+	}()
+
+	return nil
+}
+
+func (s *TrackerServer) Close() error {
+	close(s.done)
+
+	if s.httpServer != nil {
+		s.httpServer.Close()
+	}
+
+	if s.udpConn != nil {
+		s.udpConn.Close()
+	}
+
+	s.wg.Wait()
+
+	if s.Config.StatePath != "" {
+		return s.saveState()
+	}
+
+	return nil
+}
+
+func (s *TrackerServer) housekeeping() {
+	interval := min(max(s.Config.PeerTTL/2, trackerMinHousekeepingInterval), trackerMaxHousekeepingInterval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.expirePeers()
+
+			if s.Config.StatePath != "" {
+				err := s.saveState()
+				if err != nil {
+					fmt.Printf("Tracker state save error: %s\n", err)
+				}
+			}
+		}
+	}
+}
+
+func (s *TrackerServer) expirePeers() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deadline := time.Now().Add(-s.Config.PeerTTL)
+
+	for infoHash, swarm := range s.swarms {
+		for peerId, peer := range swarm.Peers {
+			if peer.LastSeen.Before(deadline) {
+				delete(swarm.Peers, peerId)
+			}
+		}
+
+		if len(swarm.Peers) == 0 && swarm.Completed == 0 {
+			delete(s.swarms, infoHash)
+		}
+	}
+}
+
+func (s *TrackerServer) isAllowed(infoHash string) bool {
+	if s.Config.AllowedInfoHashes == nil {
+		return true
+	}
+
+	return s.Config.AllowedInfoHashes[hex.EncodeToString([]byte(infoHash))]
+}
+
+func (s *TrackerServer) announce(req announceRequest) (announceResult, error) {
+	if !s.isAllowed(req.InfoHash) {
+		return announceResult{}, ErrTrackerInfoHashNotAllowed
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	swarm, ok := s.swarms[req.InfoHash]
+	if !ok {
+		swarm = &trackerSwarm{Peers: make(map[string]*trackerPeer)}
+		s.swarms[req.InfoHash] = swarm
+	}
+
+	switch req.Event {
+	case "stopped":
+		delete(swarm.Peers, req.PeerId)
+	case "completed":
+		swarm.Completed++
+		fallthrough
+	default:
+		swarm.Peers[req.PeerId] = &trackerPeer{
+			PeerId:   req.PeerId,
+			Ip:       req.Ip,
+			Port:     req.Port,
+			Left:     req.Left,
+			LastSeen: time.Now(),
+		}
+	}
+
+	result := announceResult{}
+	result.Seeders, result.Leechers = swarm.counts()
+
+	numWant := req.NumWant
+	if numWant < 0 {
+		numWant = trackerDefaultNumWant
+	}
+	numWant = min(numWant, trackerMaxNumWant)
+
+	// Map iteration order is random, so every announce gets a different subset
+	for peerId, peer := range swarm.Peers {
+		if len(result.Peers) >= numWant {
+			break
+		}
+
+		if peerId == req.PeerId {
+			continue
+		}
+
+		// Seeders have no use for other seeders
+		if req.Left == 0 && peer.Left == 0 {
+			continue
+		}
+
+		result.Peers = append(result.Peers, *peer)
+	}
+
+	return result, nil
+}
+
+func (s *TrackerServer) scrape(infoHashes []string) map[string]ScrapeResult {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(infoHashes) == 0 {
+		for infoHash := range s.swarms {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+
+	results := make(map[string]ScrapeResult)
+	for _, infoHash := range infoHashes {
+		if !s.isAllowed(infoHash) {
+			continue
+		}
+
+		result := ScrapeResult{InfoHash: Hash{Hash: []byte(infoHash)}}
+
+		if swarm, ok := s.swarms[infoHash]; ok {
+			result.Seeders, result.Leechers = swarm.counts()
+			result.Completed = swarm.Completed
+		}
+
+		results[infoHash] = result
+	}
+
+	return results
+}
+
+func (s *TrackerServer) handleHttpAnnounce(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	req := announceRequest{
+		InfoHash: query.Get("info_hash"),
+		PeerId:   query.Get("peer_id"),
+		Event:    query.Get("event"),
+		NumWant:  -1,
+	}
+
+	if len(req.InfoHash) != 20 || len(req.PeerId) != 20 {
+		writeHttpTrackerFailure(w, "invalid info_hash or peer_id")
+		return
+	}
+
+	port, err := strconv.Atoi(query.Get("port"))
+	if err != nil || port <= 0 || port > 65535 {
+		writeHttpTrackerFailure(w, "invalid port")
+		return
+	}
+	req.Port = uint16(port)
+
+	req.Uploaded, _ = strconv.Atoi(query.Get("uploaded"))
+	req.Downloaded, _ = strconv.Atoi(query.Get("downloaded"))
+
+	req.Left, err = strconv.Atoi(query.Get("left"))
+	if err != nil {
+		writeHttpTrackerFailure(w, "invalid left")
+		return
+	}
+
+	if numWant, err := strconv.Atoi(query.Get("numwant")); err == nil {
+		req.NumWant = numWant
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		writeHttpTrackerFailure(w, "unknown remote address")
+		return
+	}
+	req.Ip = net.ParseIP(host)
+
+	result, err := s.announce(req)
+	if err != nil {
+		writeHttpTrackerFailure(w, err.Error())
+		return
+	}
+
+	resp := map[string]any{
+		"interval":     int(s.Config.Interval.Seconds()),
+		"min interval": int(s.Config.MinInterval.Seconds()),
+		"complete":     result.Seeders,
+		"incomplete":   result.Leechers,
+	}
+
+	if query.Get("compact") == "0" {
+		peers := make([]any, 0, len(result.Peers))
+		for _, peer := range result.Peers {
+			peerDict := map[string]any{
+				"ip":   peer.Ip.String(),
+				"port": int(peer.Port),
+			}
+
+			if query.Get("no_peer_id") != "1" {
+				peerDict["peer id"] = peer.PeerId
+			}
+
+			peers = append(peers, peerDict)
+		}
+
+		resp["peers"] = peers
+	} else {
+		peers := make([]byte, 0)
+		peers6 := make([]byte, 0)
+
+		for _, peer := range result.Peers {
+			addr := Addr{Ip: peer.Ip, Port: peer.Port}
+			if peer.Ip.To4() != nil {
+				peers = append(peers, addr.ToBytes()...)
+			} else {
+				peers6 = append(peers6, addr.ToBytes()...)
+			}
+		}
+
+		resp["peers"] = string(peers)
+		if len(peers6) > 0 {
+			resp["peers6"] = string(peers6)
+		}
+	}
+
+	writeHttpTrackerResponse(w, resp)
+}
+
+func (s *TrackerServer) handleHttpScrape(w http.ResponseWriter, r *http.Request) {
+	infoHashes := r.URL.Query()["info_hash"]
+	for _, infoHash := range infoHashes {
+		if len(infoHash) != 20 {
+			writeHttpTrackerFailure(w, "invalid info_hash")
+			return
+		}
+	}
+
+	files := make(map[string]any)
+	for infoHash, result := range s.scrape(infoHashes) {
+		files[infoHash] = map[string]any{
+			"complete":   result.Seeders,
+			"incomplete": result.Leechers,
+			"downloaded": result.Completed,
+		}
+	}
+
+	writeHttpTrackerResponse(w, map[string]any{"files": files})
+}
+
+func writeHttpTrackerFailure(w http.ResponseWriter, reason string) {
+	writeHttpTrackerResponse(w, map[string]any{"failure reason": reason})
+}
+
+func writeHttpTrackerResponse(w http.ResponseWriter, resp map[string]any) {
+	encoded, err := encodeBencode(resp)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(encoded))
+}
+
+func (s *TrackerServer) serveUdp() {
+	buf := make([]byte, 2048)
+
+	for {
+		n, addr, err := s.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+				continue
+			}
+		}
+
+		resp := s.handleUdpPacket(buf[:n], addr)
+		if resp != nil {
+			s.udpConn.WriteToUDP(resp, addr)
+		}
+	}
+}
+
+// Connection ids are derived from the client address and the current minute,
+// so the server doesn't have to remember issued ids. An id stays valid for
+// about two minutes as the protocol requires.
+func (s *TrackerServer) udpConnectionId(addr *net.UDPAddr, minute int64) uint64 {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(minute))
+
+	hasher := sha1.New()
+	hasher.Write(s.udpSecret)
+	hasher.Write(buf)
+	hasher.Write([]byte(addr.String()))
+
+	return binary.BigEndian.Uint64(hasher.Sum(nil))
+}
+
+func (s *TrackerServer) isValidUdpConnectionId(addr *net.UDPAddr, connectionId uint64) bool {
+	minute := time.Now().Unix() / 60
+
+	return connectionId == s.udpConnectionId(addr, minute) || connectionId == s.udpConnectionId(addr, minute-1)
+}
+
+func (s *TrackerServer) handleUdpPacket(packet []byte, addr *net.UDPAddr) []byte {
+	if len(packet) < 16 {
+		return nil
+	}
+
+	connectionId := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionId := binary.BigEndian.Uint32(packet[12:16])
+
+	if action == 0 {
+		if connectionId != 0x41727101980 {
+			return nil
+		}
+
+		resp := make([]byte, 16)
+		binary.BigEndian.PutUint32(resp[0:4], 0)
+		binary.BigEndian.PutUint32(resp[4:8], transactionId)
+		binary.BigEndian.PutUint64(resp[8:16], s.udpConnectionId(addr, time.Now().Unix()/60))
+
+		return resp
+	}
+
+	if !s.isValidUdpConnectionId(addr, connectionId) {
+		return udpTrackerError(transactionId, "invalid connection id")
+	}
+
+	switch action {
+	case 1:
+		return s.handleUdpAnnounce(packet, addr, transactionId)
+	case 2:
+		return s.handleUdpScrape(packet, transactionId)
+	default:
+		return udpTrackerError(transactionId, "unknown action")
+	}
+}
+
+func (s *TrackerServer) handleUdpAnnounce(packet []byte, addr *net.UDPAddr, transactionId uint32) []byte {
+	if len(packet) < 98 {
+		return udpTrackerError(transactionId, "announce request is too short")
+	}
+
+	req := announceRequest{
+		InfoHash:   string(packet[16:36]),
+		PeerId:     string(packet[36:56]),
+		Downloaded: int(binary.BigEndian.Uint64(packet[56:64])),
+		Left:       int(binary.BigEndian.Uint64(packet[64:72])),
+		Uploaded:   int(binary.BigEndian.Uint64(packet[72:80])),
+		NumWant:    int(int32(binary.BigEndian.Uint32(packet[92:96]))),
+		Port:       binary.BigEndian.Uint16(packet[96:98]),
+		Ip:         addr.IP,
+	}
+
+	switch binary.BigEndian.Uint32(packet[80:84]) {
+	case 1:
+		req.Event = "completed"
+	case 2:
+		req.Event = "started"
+	case 3:
+		req.Event = "stopped"
+	}
+
+	result, err := s.announce(req)
+	if err != nil {
+		return udpTrackerError(transactionId, err.Error())
+	}
+
+	resp := make([]byte, 20)
+	binary.BigEndian.PutUint32(resp[0:4], 1)
+	binary.BigEndian.PutUint32(resp[4:8], transactionId)
+	binary.BigEndian.PutUint32(resp[8:12], uint32(s.Config.Interval.Seconds()))
+	binary.BigEndian.PutUint32(resp[12:16], uint32(result.Leechers))
+	binary.BigEndian.PutUint32(resp[16:20], uint32(result.Seeders))
+
+	// The address family of the peers is the one the request came over
+	isIpv4 := addr.IP.To4() != nil
+	for _, peer := range result.Peers {
+		if (peer.Ip.To4() != nil) != isIpv4 {
+			continue
+		}
+
+		peerAddr := Addr{Ip: peer.Ip, Port: peer.Port}
+		resp = append(resp, peerAddr.ToBytes()...)
+	}
+
+	return resp
+}
+
+func (s *TrackerServer) handleUdpScrape(packet []byte, transactionId uint32) []byte {
+	infoHashes := make([]string, 0)
+	for offset := 16; offset+20 <= len(packet) && len(infoHashes) < maxUdpScrapeHashes; offset += 20 {
+		infoHashes = append(infoHashes, string(packet[offset:offset+20]))
+	}
+
+	if len(infoHashes) == 0 {
+		return udpTrackerError(transactionId, "no info hashes to scrape")
+	}
+
+	results := s.scrape(infoHashes)
+
+	resp := make([]byte, 8, 8+12*len(infoHashes))
+	binary.BigEndian.PutUint32(resp[0:4], 2)
+	binary.BigEndian.PutUint32(resp[4:8], transactionId)
+
+	for _, infoHash := range infoHashes {
+		result := results[infoHash]
+
+		stats := make([]byte, 12)
+		binary.BigEndian.PutUint32(stats[0:4], uint32(result.Seeders))
+		binary.BigEndian.PutUint32(stats[4:8], uint32(result.Completed))
+		binary.BigEndian.PutUint32(stats[8:12], uint32(result.Leechers))
+		resp = append(resp, stats...)
+	}
+
+	return resp
+}
+
+func udpTrackerError(transactionId uint32, message string) []byte {
+	resp := make([]byte, 8, 8+len(message))
+	binary.BigEndian.PutUint32(resp[0:4], 3)
+	binary.BigEndian.PutUint32(resp[4:8], transactionId)
+
+	return append(resp, []byte(message)...)
+}
+
+// Peer ids are any 20 bytes, like info hashes they are saved hex encoded so
+// the JSON state keeps them intact
+type trackerStatePeer struct {
+	PeerId   string
+	Ip       net.IP
+	Port     uint16
+	Left     int
+	LastSeen time.Time
+}
+
+type trackerStateSwarm struct {
+	Peers     []trackerStatePeer
+	Completed int
+}
+
+func (s *TrackerServer) saveState() error {
+	s.mu.Lock()
+	state := make(map[string]trackerStateSwarm, len(s.swarms))
+	for infoHash, swarm := range s.swarms {
+		saved := trackerStateSwarm{
+			Peers:     make([]trackerStatePeer, 0, len(swarm.Peers)),
+			Completed: swarm.Completed,
+		}
+
+		for _, peer := range swarm.Peers {
+			saved.Peers = append(saved.Peers, trackerStatePeer{
+				PeerId:   hex.EncodeToString([]byte(peer.PeerId)),
+				Ip:       peer.Ip,
+				Port:     peer.Port,
+				Left:     peer.Left,
+				LastSeen: peer.LastSeen,
+			})
+		}
+
+		state[hex.EncodeToString([]byte(infoHash))] = saved
+	}
+	s.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	tmpPath := s.Config.StatePath + ".tmp"
+	err = os.WriteFile(tmpPath, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, s.Config.StatePath)
+}
+
+func (s *TrackerServer) loadState() error {
+	data, err := os.ReadFile(s.Config.StatePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	state := make(map[string]trackerStateSwarm)
+	err = json.Unmarshal(data, &state)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for hexInfoHash, saved := range state {
+		infoHash, err := hex.DecodeString(hexInfoHash)
+		if err != nil || len(infoHash) != 20 {
+			continue
+		}
+
+		swarm := &trackerSwarm{
+			Peers:     make(map[string]*trackerPeer, len(saved.Peers)),
+			Completed: saved.Completed,
+		}
+
+		for _, peer := range saved.Peers {
+			peerId, err := hex.DecodeString(peer.PeerId)
+			if err != nil || len(peerId) != peerIdLength {
+				continue
+			}
+
+			swarm.Peers[string(peerId)] = &trackerPeer{
+				PeerId:   string(peerId),
+				Ip:       peer.Ip,
+				Port:     peer.Port,
+				Left:     peer.Left,
+				LastSeen: peer.LastSeen,
+			}
+		}
+
+		s.swarms[string(infoHash)] = swarm
+	}
+
+	return nil
+}
+
+func loadInfoHashAllowlist(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	allowed := make(map[string]bool)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		infoHash, err := hex.DecodeString(line)
+		if err != nil || len(infoHash) != 20 {
+			return nil, fmt.Errorf("invalid info hash in allowlist: %s", line)
+		}
+
+		allowed[line] = true
+	}
+
+	return allowed, scanner.Err()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTrackerServerStateKeepsBinaryIds(t *testing.T) {
+	config := TrackerServerConfig{StatePath: filepath.Join(t.TempDir(), "state.json")}
+
+	server, err := NewTrackerServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infoHash := string([]byte{0xff, 0xfe, 0x00, 0x80, 0xc3, 0x28, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1})
+	peerIds := []string{
+		string([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}),
+		string([]byte{0xfe, 0xfe, 0xfe, 0xfe, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}),
+		NewPeerId(),
+	}
+
+	for i, peerId := range peerIds {
+		_, err := server.announce(announceRequest{
+			InfoHash: infoHash,
+			PeerId:   peerId,
+			Ip:       net.IPv4(10, 0, 0, byte(i)),
+			Port:     6881,
+			Left:     i,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = server.saveState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewTrackerServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restarted.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	swarm, ok := restarted.swarms[infoHash]
+	if !ok {
+		t.Fatalf("swarm lost, have %d swarms", len(restarted.swarms))
+	}
+
+	if len(swarm.Peers) != len(peerIds) {
+		t.Fatalf("%d peers after a restart, want %d", len(swarm.Peers), len(peerIds))
+	}
+
+	for i, peerId := range peerIds {
+		peer, ok := swarm.Peers[peerId]
+		if !ok {
+			t.Errorf("peer id %x lost", peerId)
+			continue
+		}
+
+		if peer.PeerId != peerId || peer.Left != i || !peer.Ip.Equal(net.IPv4(10, 0, 0, byte(i))) {
+			t.Errorf("peer %x restored as %+v", peerId, peer)
+		}
+	}
+}
+
+func TestTrackerServerIntervals(t *testing.T) {
+	_, err := NewTrackerServer(TrackerServerConfig{PeerTTL: -time.Second})
+	if err == nil {
+		t.Error("negative peer TTL accepted")
+	}
+
+	// A tiny TTL must not make the housekeeping ticker panic
+	server, err := NewTrackerServer(TrackerServerConfig{PeerTTL: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = server.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
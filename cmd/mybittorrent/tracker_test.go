@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func udpTrackerReply(action uint32, transactionId uint32, body string) []byte {
+	reply := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(reply[0:4], action)
+	binary.BigEndian.PutUint32(reply[4:8], transactionId)
+
+	return append(reply, body...)
+}
+
+func TestCheckUdpTrackerReply(t *testing.T) {
+	tests := []struct {
+		name    string
+		reply   []byte
+		wantErr string
+	}{
+		{"announce", udpTrackerReply(udpActionAnnounce, 7, strings.Repeat("x", 12)), ""},
+		{"short header", []byte{0, 0, 0, 1}, "too short"},
+		{"short announce", udpTrackerReply(udpActionAnnounce, 7, "xx"), "too short"},
+		{"other transaction", udpTrackerReply(udpActionAnnounce, 8, strings.Repeat("x", 12)), "transaction id"},
+		{"tracker error", udpTrackerReply(udpActionError, 7, "go away"), "tracker error: go away"},
+		{"other action", udpTrackerReply(udpActionScrape, 7, strings.Repeat("x", 12)), "unexpected tracker action"},
+	}
+
+	for _, test := range tests {
+		err := checkUdpTrackerReply(test.reply, udpActionAnnounce, 7, 20)
+
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+// fakeUdpTracker answers UDP tracker requests with reply, which returns nil
+// to drop a request. It returns the announce URL and the requests received.
+func fakeUdpTracker(t *testing.T, reply func(request []byte, count int) [][]byte) (string, chan []byte) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	requests := make(chan []byte, 100)
+
+	go func() {
+		buf := make([]byte, 1500)
+
+		for count := 0; ; count++ {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			request := append([]byte(nil), buf[:n]...)
+			requests <- request
+
+			for _, packet := range reply(request, count) {
+				conn.WriteTo(packet, addr)
+			}
+		}
+	}()
+
+	return "udp://" + conn.LocalAddr().String() + "/announce", requests
+}
+
+func TestUdpTrackerRetransmits(t *testing.T) {
+	announceUrl, requests := fakeUdpTracker(t, func(request []byte, count int) [][]byte {
+		action := binary.BigEndian.Uint32(request[8:12])
+		transactionId := binary.BigEndian.Uint32(request[12:16])
+
+		switch {
+		// The first connect request is lost
+		case count == 0:
+			return nil
+		case action == udpActionConnect:
+			// A late reply to an earlier request comes first
+			return [][]byte{
+				udpTrackerReply(udpActionConnect, transactionId+1, "\x00\x00\x00\x00\x00\x00\x00\x01"),
+				udpTrackerReply(udpActionConnect, transactionId, "\x00\x00\x00\x00\x00\x00\x00\x02"),
+			}
+		default:
+			return [][]byte{udpTrackerReply(udpActionAnnounce, transactionId, "\x00\x00\x07\x08\x00\x00\x00\x00\x00\x00\x00\x01\x0a\x00\x00\x02\x1a\xe1")}
+		}
+	})
+
+	tracker := &Tracker{AnnounceUrl: announceUrl, PeerId: NewPeerId(), UdpTimeout: 50 * time.Millisecond}
+
+	peers, err := tracker.getPeers(context.Background(), TorrentMetaInfo{Announce: announceUrl, InfoHash: Hash{Hash: randomBytes(20)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(peers) != 1 || peers[0].Addr.ToString() != "10.0.0.2:6881" || tracker.Interval != 0x708 {
+		t.Errorf("got peers %v and interval %d", peers, tracker.Interval)
+	}
+
+	var transactionIds []uint32
+	for len(requests) > 0 {
+		request := <-requests
+		transactionIds = append(transactionIds, binary.BigEndian.Uint32(request[12:16]))
+	}
+
+	// The connect request twice, then the announce with the connection id
+	if len(transactionIds) != 3 {
+		t.Fatalf("tracker got %d requests, want 3", len(transactionIds))
+	}
+
+	if transactionIds[0] != transactionIds[1] || transactionIds[1] == transactionIds[2] {
+		t.Errorf("transaction ids %v, want the connect one retransmitted and a new one for the announce", transactionIds)
+	}
+}
+
+func TestUdpTrackerGivesUp(t *testing.T) {
+	announceUrl, requests := fakeUdpTracker(t, func([]byte, int) [][]byte {
+		return nil
+	})
+
+	tracker := &Tracker{AnnounceUrl: announceUrl, PeerId: NewPeerId(), UdpTimeout: 10 * time.Millisecond}
+
+	_, err := tracker.getPeers(context.Background(), TorrentMetaInfo{Announce: announceUrl, InfoHash: Hash{Hash: randomBytes(20)}})
+	if err == nil {
+		t.Fatal("announce to a silent tracker succeeded")
+	}
+
+	if len(requests) != udpTrackerRetransmits+1 {
+		t.Errorf("tracker got %d requests, want %d", len(requests), udpTrackerRetransmits+1)
+	}
+}
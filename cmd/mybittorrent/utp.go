@@ -0,0 +1,1161 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	utpTypeData  = 0
+	utpTypeFin   = 1
+	utpTypeState = 2
+	utpTypeReset = 3
+	utpTypeSyn   = 4
+
+	utpVersion       = 1
+	utpExtensionSack = 1
+	utpHeaderSize    = 20
+
+	// Payload that keeps packets below common path MTUs
+	utpPacketSize = 1380
+	// Received data we buffer before advertising a smaller window
+	utpRecvBufferSize = 1024 * 1024
+	// Out of order packets further ahead than this are dropped
+	utpReorderWindow = 1024
+
+	// LEDBAT aims at adding this much queuing delay and no more
+	utpTargetDelay           = 100 * time.Millisecond
+	utpMaxCwndIncreasePerRtt = 3000
+	utpMinWindow             = utpPacketSize
+	utpMaxWindow             = 4 * 1024 * 1024
+
+	utpMinRto            = 500 * time.Millisecond
+	utpMaxRto            = 60 * time.Second
+	utpMaxTimeouts       = 6
+	utpSynRetries        = 3
+	utpTickInterval      = 50 * time.Millisecond
+	utpKeepAliveInterval = 29 * time.Second
+	utpCloseLinger       = 10 * time.Second
+	utpAcceptBacklog     = 64
+	utpOtherPacketsQueue = 256
+)
+
+var ErrUTPTimeout = &utpTimeoutError{}
+
+type utpTimeoutError struct{}
+
+func (e *utpTimeoutError) Error() string   { return "utp i/o timeout" }
+func (e *utpTimeoutError) Timeout() bool   { return true }
+func (e *utpTimeoutError) Temporary() bool { return true }
+
+type utpHeader struct {
+	Type          uint8
+	ConnectionId  uint16
+	Timestamp     uint32
+	TimestampDiff uint32
+	WndSize       uint32
+	SeqNr         uint16
+	AckNr         uint16
+	// Selective ACK bitmask, bit i acknowledges AckNr+2+i
+	Sack []byte
+}
+
+func (h *utpHeader) encode(payload []byte) []byte {
+	size := utpHeaderSize + len(payload)
+	if h.Sack != nil {
+		size += 2 + len(h.Sack)
+	}
+
+	buf := make([]byte, utpHeaderSize, size)
+	buf[0] = h.Type<<4 | utpVersion
+	if h.Sack != nil {
+		buf[1] = utpExtensionSack
+	}
+	binary.BigEndian.PutUint16(buf[2:4], h.ConnectionId)
+	binary.BigEndian.PutUint32(buf[4:8], h.Timestamp)
+	binary.BigEndian.PutUint32(buf[8:12], h.TimestampDiff)
+	binary.BigEndian.PutUint32(buf[12:16], h.WndSize)
+	binary.BigEndian.PutUint16(buf[16:18], h.SeqNr)
+	binary.BigEndian.PutUint16(buf[18:20], h.AckNr)
+
+	if h.Sack != nil {
+		buf = append(buf, 0, byte(len(h.Sack)))
+		buf = append(buf, h.Sack...)
+	}
+
+	return append(buf, payload...)
+}
+
+func isUtpPacket(b []byte) bool {
+	return len(b) >= utpHeaderSize && b[0]&0x0f == utpVersion && b[0]>>4 <= utpTypeSyn
+}
+
+func decodeUtpPacket(b []byte) (utpHeader, []byte, error) {
+	h := utpHeader{}
+
+	if !isUtpPacket(b) {
+		return h, nil, fmt.Errorf("not a utp packet")
+	}
+
+	h.Type = b[0] >> 4
+	h.ConnectionId = binary.BigEndian.Uint16(b[2:4])
+	h.Timestamp = binary.BigEndian.Uint32(b[4:8])
+	h.TimestampDiff = binary.BigEndian.Uint32(b[8:12])
+	h.WndSize = binary.BigEndian.Uint32(b[12:16])
+	h.SeqNr = binary.BigEndian.Uint16(b[16:18])
+	h.AckNr = binary.BigEndian.Uint16(b[18:20])
+
+	extension := b[1]
+	offset := utpHeaderSize
+
+	for extension != 0 {
+		if offset+2 > len(b) {
+			return h, nil, fmt.Errorf("truncated utp extension")
+		}
+
+		next := b[offset]
+		length := int(b[offset+1])
+		offset += 2
+
+		if offset+length > len(b) {
+			return h, nil, fmt.Errorf("truncated utp extension")
+		}
+
+		if extension == utpExtensionSack {
+			h.Sack = b[offset : offset+length]
+		}
+
+		extension = next
+		offset += length
+	}
+
+	return h, b[offset:], nil
+}
+
+func utpTimestamp() uint32 {
+	return uint32(time.Now().UnixMicro())
+}
+
+// seqLess compares 16 bit sequence numbers that wrap around
+func seqLess(a uint16, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// UTPSocket runs uTP connections over one UDP socket. Packets that aren't
+// uTP, like DHT messages, are handed to the PacketConn returned by
+// PacketConn, so the DHT can share the socket.
+type UTPSocket struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	conns   map[string]*utpConn
+	accept  chan *utpConn
+	other   *utpPacketConn
+	closing bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+func ListenUTP(addr string) (*UTPSocket, error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewUTPSocket(conn), nil
+}
+
+func NewUTPSocket(conn net.PacketConn) *UTPSocket {
+	s := &UTPSocket{
+		conn:   conn,
+		conns:  make(map[string]*utpConn),
+		accept: make(chan *utpConn, utpAcceptBacklog),
+		done:   make(chan struct{}),
+	}
+
+	s.other = &utpPacketConn{
+		socket:  s,
+		packets: make(chan utpOtherPacket, utpOtherPacketsQueue),
+		closed:  make(chan struct{}),
+	}
+
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		s.readLoop()
+	}()
+	go func() {
+		defer s.wg.Done()
+		s.tickLoop()
+	}()
+
+	return s
+}
+
+func (s *UTPSocket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *UTPSocket) PacketConn() net.PacketConn {
+	return s.other
+}
+
+func (s *UTPSocket) Close() error {
+	s.mu.Lock()
+	if s.closing {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closing = true
+	conns := make([]*utpConn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.terminate(net.ErrClosed)
+	}
+
+	close(s.done)
+	err := s.conn.Close()
+	s.wg.Wait()
+
+	return err
+}
+
+func (s *UTPSocket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *UTPSocket) Dial(addr string) (net.Conn, error) {
+	return s.DialTimeout(addr, 5*time.Second)
+}
+
+func (s *UTPSocket) DialTimeout(addr string, timeout time.Duration) (net.Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	idBuf := make([]byte, 2)
+
+	s.mu.Lock()
+	var c *utpConn
+	for c == nil {
+		rand.Read(idBuf)
+		recvId := binary.BigEndian.Uint16(idBuf)
+
+		if _, ok := s.conns[connKey(remote, recvId)]; !ok {
+			c = newUtpConn(s, remote, recvId, recvId+1)
+			s.conns[connKey(remote, recvId)] = c
+		}
+	}
+	s.mu.Unlock()
+
+	err = c.connect(timeout)
+	if err != nil {
+		s.remove(c)
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func connKey(addr net.Addr, recvId uint16) string {
+	return fmt.Sprintf("%s/%d", addr, recvId)
+}
+
+func (s *UTPSocket) remove(c *utpConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := connKey(c.remote, c.recvId)
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *UTPSocket) writeTo(packet []byte, addr net.Addr) error {
+	_, err := s.conn.WriteTo(packet, addr)
+
+	return err
+}
+
+func (s *UTPSocket) readLoop() {
+	buf := make([]byte, 65536)
+
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				s.other.closeOnce()
+				return
+			default:
+				continue
+			}
+		}
+
+		if !isUtpPacket(buf[:n]) {
+			s.other.deliver(buf[:n], from)
+			continue
+		}
+
+		header, payload, err := decodeUtpPacket(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		s.handlePacket(header, append([]byte{}, payload...), from)
+	}
+}
+
+func (s *UTPSocket) handlePacket(header utpHeader, payload []byte, from net.Addr) {
+	s.mu.Lock()
+
+	if header.Type == utpTypeSyn {
+		key := connKey(from, header.ConnectionId+1)
+
+		if c, ok := s.conns[key]; ok {
+			s.mu.Unlock()
+			// Our reply got lost, the peer retransmitted the SYN
+			c.sendState()
+			return
+		}
+
+		if s.closing {
+			s.mu.Unlock()
+			return
+		}
+
+		c := newUtpConn(s, from, header.ConnectionId+1, header.ConnectionId)
+		c.ackNr = header.SeqNr
+		c.state = utpStateConnected
+		close(c.connected)
+
+		select {
+		case s.accept <- c:
+			s.conns[key] = c
+			s.mu.Unlock()
+			c.handleTimestamps(header)
+			c.sendState()
+		default:
+			s.mu.Unlock()
+			s.sendReset(from, header)
+		}
+
+		return
+	}
+
+	c, ok := s.conns[connKey(from, header.ConnectionId)]
+	s.mu.Unlock()
+
+	if !ok {
+		if header.Type != utpTypeReset {
+			s.sendReset(from, header)
+		}
+		return
+	}
+
+	c.handlePacket(header, payload)
+}
+
+func (s *UTPSocket) sendReset(to net.Addr, received utpHeader) {
+	reset := utpHeader{
+		Type:         utpTypeReset,
+		ConnectionId: received.ConnectionId,
+		Timestamp:    utpTimestamp(),
+		AckNr:        received.SeqNr,
+	}
+
+	s.writeTo(reset.encode(nil), to)
+}
+
+func (s *UTPSocket) tickLoop() {
+	ticker := time.NewTicker(utpTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		conns := make([]*utpConn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+
+		for _, c := range conns {
+			c.tick()
+		}
+	}
+}
+
+type utpOtherPacket struct {
+	data []byte
+	from net.Addr
+}
+
+// utpPacketConn is the part of the UDP socket that isn't uTP
+type utpPacketConn struct {
+	socket  *UTPSocket
+	packets chan utpOtherPacket
+	closed  chan struct{}
+	once    sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+func (p *utpPacketConn) deliver(data []byte, from net.Addr) {
+	select {
+	case p.packets <- utpOtherPacket{data: append([]byte{}, data...), from: from}:
+	default:
+	}
+}
+
+func (p *utpPacketConn) closeOnce() {
+	p.once.Do(func() { close(p.closed) })
+}
+
+func (p *utpPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	p.mu.Lock()
+	deadline := p.readDeadline
+	p.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case packet := <-p.packets:
+		return copy(b, packet.data), packet.from, nil
+	case <-p.closed:
+		return 0, nil, net.ErrClosed
+	case <-timeout:
+		return 0, nil, ErrUTPTimeout
+	}
+}
+
+func (p *utpPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-p.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	return p.socket.conn.WriteTo(b, addr)
+}
+
+func (p *utpPacketConn) Close() error {
+	p.closeOnce()
+	return nil
+}
+
+func (p *utpPacketConn) LocalAddr() net.Addr {
+	return p.socket.conn.LocalAddr()
+}
+
+func (p *utpPacketConn) SetDeadline(t time.Time) error {
+	return p.SetReadDeadline(t)
+}
+
+func (p *utpPacketConn) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.readDeadline = t
+
+	return nil
+}
+
+func (p *utpPacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+const (
+	utpStateSynSent = iota
+	utpStateConnected
+	utpStateClosing
+	utpStateClosed
+)
+
+type utpOutPacket struct {
+	header        utpHeader
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	sacked        bool
+	needResend    bool
+	fastResent    bool
+}
+
+func (p *utpOutPacket) size() int {
+	return utpHeaderSize + len(p.payload)
+}
+
+// utpConn is one uTP connection, used through the net.Conn interface
+type utpConn struct {
+	socket *UTPSocket
+	remote net.Addr
+	recvId uint16
+	sendId uint16
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	state     int
+	err       error
+	connected chan struct{}
+
+	seqNr    uint16
+	ackNr    uint16
+	outbuf   []*utpOutPacket
+	inFlight int
+
+	maxWindow     float64
+	peerWnd       int
+	rtt           time.Duration
+	rttVar        time.Duration
+	rto           time.Duration
+	timeouts      int
+	lastLoss      time.Time
+	lastAckNr     uint16
+	dupAcks       int
+	replyMicro    uint32
+	baseDelays    [2]uint32
+	baseDelayTime time.Time
+	lastSent      time.Time
+	closeStarted  time.Time
+
+	readBuf  bytes.Buffer
+	reorder  map[uint16][]byte
+	gotFin   bool
+	finSeqNr uint16
+	eof      bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newUtpConn(socket *UTPSocket, remote net.Addr, recvId uint16, sendId uint16) *utpConn {
+	seqBuf := make([]byte, 2)
+	rand.Read(seqBuf)
+
+	c := &utpConn{
+		socket:    socket,
+		remote:    remote,
+		recvId:    recvId,
+		sendId:    sendId,
+		connected: make(chan struct{}),
+		seqNr:     binary.BigEndian.Uint16(seqBuf),
+		maxWindow: 2 * utpPacketSize,
+		peerWnd:   utpRecvBufferSize,
+		rto:       time.Second,
+		reorder:   make(map[uint16][]byte),
+	}
+
+	c.cond = sync.NewCond(&c.mu)
+	c.baseDelays = [2]uint32{^uint32(0), ^uint32(0)}
+
+	return c
+}
+
+func (c *utpConn) connect(timeout time.Duration) error {
+	c.mu.Lock()
+	c.state = utpStateSynSent
+	c.seqNr = 1
+	syn := &utpOutPacket{header: utpHeader{Type: utpTypeSyn, ConnectionId: c.recvId, SeqNr: c.seqNr}}
+	c.seqNr++
+	c.outbuf = append(c.outbuf, syn)
+	c.transmit(syn)
+	c.mu.Unlock()
+
+	select {
+	case <-c.connected:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.err
+	case <-time.After(timeout):
+		c.terminate(ErrUTPTimeout)
+		return ErrUTPTimeout
+	}
+}
+
+// transmit sends an outgoing packet, must be called with c.mu held
+func (c *utpConn) transmit(p *utpOutPacket) {
+	p.header.Timestamp = utpTimestamp()
+	p.header.TimestampDiff = c.replyMicro
+	p.header.WndSize = uint32(c.recvWindow())
+	p.header.AckNr = c.ackNr
+
+	// Lost packets stopped counting as in flight when they were marked
+	if p.transmissions == 0 || p.needResend {
+		c.inFlight += p.size()
+	}
+
+	p.transmissions++
+	p.sentAt = time.Now()
+	p.needResend = false
+	c.lastSent = p.sentAt
+
+	c.socket.writeTo(p.header.encode(p.payload), c.remote)
+}
+
+func (c *utpConn) recvWindow() int {
+	return max(utpRecvBufferSize-c.readBuf.Len(), 0)
+}
+
+func (c *utpConn) sendState() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.sendStateLocked()
+}
+
+func (c *utpConn) sendStateLocked() {
+	state := utpHeader{
+		Type:          utpTypeState,
+		ConnectionId:  c.sendId,
+		Timestamp:     utpTimestamp(),
+		TimestampDiff: c.replyMicro,
+		WndSize:       uint32(c.recvWindow()),
+		SeqNr:         c.seqNr,
+		AckNr:         c.ackNr,
+		Sack:          c.sackBitmask(),
+	}
+
+	c.lastSent = time.Now()
+	c.socket.writeTo(state.encode(nil), c.remote)
+}
+
+// sackBitmask tells the peer which packets after the next expected one we
+// already have, nil when everything arrived in order
+func (c *utpConn) sackBitmask() []byte {
+	if len(c.reorder) == 0 {
+		return nil
+	}
+
+	mask := make([]byte, 32)
+	highest := -1
+
+	for seqNr := range c.reorder {
+		bit := int(seqNr - c.ackNr - 2)
+		if bit < 0 || bit >= len(mask)*8 {
+			continue
+		}
+
+		mask[bit/8] |= 1 << (bit % 8)
+		highest = max(highest, bit)
+	}
+
+	if highest == -1 {
+		return nil
+	}
+
+	// The bitmask length has to be a multiple of 4 bytes
+	return mask[:(highest/32+1)*4]
+}
+
+func (c *utpConn) handleTimestamps(header utpHeader) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.replyMicro = utpTimestamp() - header.Timestamp
+}
+
+func (c *utpConn) handlePacket(header utpHeader, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+
+	if c.state == utpStateClosed {
+		return
+	}
+
+	c.replyMicro = utpTimestamp() - header.Timestamp
+	c.peerWnd = int(header.WndSize)
+
+	if header.Type == utpTypeReset {
+		c.terminateLocked(syscall.ECONNRESET)
+		return
+	}
+
+	if c.state == utpStateSynSent {
+		if header.Type != utpTypeState {
+			return
+		}
+
+		// The first data packet of the peer will carry the sequence number
+		// of this state packet
+		c.ackNr = header.SeqNr - 1
+		c.state = utpStateConnected
+		close(c.connected)
+	}
+
+	c.handleAck(header)
+
+	switch header.Type {
+	case utpTypeData:
+		c.handleData(header.SeqNr, payload)
+		c.sendStateLocked()
+
+	case utpTypeFin:
+		if !c.gotFin {
+			c.gotFin = true
+			c.finSeqNr = header.SeqNr
+		}
+		c.handleData(header.SeqNr, nil)
+		c.sendStateLocked()
+	}
+
+	c.sendQueued()
+}
+
+func (c *utpConn) handleData(seqNr uint16, payload []byte) {
+	if seqNr != c.ackNr+1 {
+		if seqLess(c.ackNr, seqNr) && int(seqNr-c.ackNr) < utpReorderWindow {
+			if _, ok := c.reorder[seqNr]; !ok {
+				c.reorder[seqNr] = payload
+			}
+		}
+		return
+	}
+
+	c.acceptInOrder(seqNr, payload)
+
+	for {
+		next, ok := c.reorder[c.ackNr+1]
+		if !ok {
+			break
+		}
+
+		delete(c.reorder, c.ackNr+1)
+		c.acceptInOrder(c.ackNr+1, next)
+	}
+}
+
+func (c *utpConn) acceptInOrder(seqNr uint16, payload []byte) {
+	c.ackNr = seqNr
+
+	if c.gotFin && seqNr == c.finSeqNr {
+		c.eof = true
+		return
+	}
+
+	c.readBuf.Write(payload)
+}
+
+func (c *utpConn) handleAck(header utpHeader) {
+	now := time.Now()
+	bytesAcked := 0
+	newlyAcked := false
+
+	remaining := c.outbuf[:0]
+	for _, p := range c.outbuf {
+		if !seqLess(header.AckNr, p.header.SeqNr) {
+			if !p.sacked {
+				bytesAcked += p.size()
+				if !p.needResend {
+					c.inFlight -= p.size()
+				}
+			}
+
+			// Karn's algorithm, only packets sent once give an RTT sample
+			if p.transmissions == 1 {
+				c.updateRtt(now.Sub(p.sentAt))
+			}
+
+			newlyAcked = true
+			continue
+		}
+
+		remaining = append(remaining, p)
+	}
+	c.outbuf = remaining
+
+	if header.Sack != nil {
+		bytesAcked += c.handleSack(header.AckNr, header.Sack)
+	}
+
+	if newlyAcked {
+		c.timeouts = 0
+		c.dupAcks = 0
+	} else if header.Type == utpTypeState && header.AckNr == c.lastAckNr && len(c.outbuf) > 0 {
+		c.dupAcks++
+
+		if c.dupAcks == 3 {
+			c.markLost(c.outbuf[0])
+		}
+	}
+
+	c.lastAckNr = header.AckNr
+	c.inFlight = max(c.inFlight, 0)
+
+	if bytesAcked > 0 {
+		c.updateWindow(header.TimestampDiff, bytesAcked)
+	}
+}
+
+// handleSack marks selectively acknowledged packets and treats a packet as
+// lost once three packets sent after it were acknowledged
+func (c *utpConn) handleSack(ackNr uint16, mask []byte) int {
+	bytesAcked := 0
+	sackedAfter := 0
+
+	for i := len(c.outbuf) - 1; i >= 0; i-- {
+		p := c.outbuf[i]
+		bit := int(p.header.SeqNr - ackNr - 2)
+
+		if bit >= 0 && bit < len(mask)*8 && mask[bit/8]&(1<<(bit%8)) != 0 {
+			if !p.sacked {
+				p.sacked = true
+				bytesAcked += p.size()
+				if !p.needResend {
+					c.inFlight -= p.size()
+				}
+				p.needResend = false
+			}
+			sackedAfter++
+			continue
+		}
+
+		if !p.sacked && sackedAfter >= 3 && !p.fastResent {
+			p.fastResent = true
+			c.markLost(p)
+		}
+	}
+
+	return bytesAcked
+}
+
+func (c *utpConn) markLost(p *utpOutPacket) {
+	if p.needResend || p.sacked {
+		return
+	}
+
+	p.needResend = true
+	c.inFlight -= p.size()
+
+	// Halve the window at most once per round trip
+	if time.Since(c.lastLoss) > c.rtt {
+		c.maxWindow = max(c.maxWindow/2, utpMinWindow)
+		c.lastLoss = time.Now()
+	}
+}
+
+func (c *utpConn) updateRtt(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+
+	c.rto = min(max(c.rtt+4*c.rttVar, utpMinRto), utpMaxRto)
+}
+
+// updateWindow is the LEDBAT controller: the window grows while the delay
+// our packets add to the path stays below the target and shrinks above it
+func (c *utpConn) updateWindow(delaySample uint32, bytesAcked int) {
+	if delaySample == 0 {
+		return
+	}
+
+	// The base delay is the lowest delay seen in the last two minutes, one
+	// minimum per minute is kept
+	if time.Since(c.baseDelayTime) > time.Minute {
+		c.baseDelays[0] = c.baseDelays[1]
+		c.baseDelays[1] = ^uint32(0)
+		c.baseDelayTime = time.Now()
+	}
+	c.baseDelays[1] = min(c.baseDelays[1], delaySample)
+	baseDelay := min(c.baseDelays[0], c.baseDelays[1])
+
+	ourDelay := time.Duration(delaySample-baseDelay) * time.Microsecond
+	offTarget := float64(utpTargetDelay-ourDelay) / float64(utpTargetDelay)
+	windowFactor := float64(bytesAcked) / max(c.maxWindow, float64(bytesAcked))
+
+	c.maxWindow += utpMaxCwndIncreasePerRtt * offTarget * windowFactor
+	c.maxWindow = min(max(c.maxWindow, utpMinWindow), utpMaxWindow)
+}
+
+func (c *utpConn) sendWindow() int {
+	return min(int(c.maxWindow), c.peerWnd)
+}
+
+// sendQueued retransmits lost packets while the window allows it
+func (c *utpConn) sendQueued() {
+	for _, p := range c.outbuf {
+		if !p.needResend {
+			continue
+		}
+
+		if c.inFlight > 0 && c.inFlight+p.size() > c.sendWindow() {
+			return
+		}
+
+		c.transmit(p)
+	}
+}
+
+func (c *utpConn) tick() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer c.cond.Broadcast()
+
+	if c.state == utpStateClosed {
+		return
+	}
+
+	now := time.Now()
+
+	if c.state == utpStateClosing && (len(c.outbuf) == 0 || now.Sub(c.closeStarted) > utpCloseLinger) {
+		c.terminateLocked(net.ErrClosed)
+		return
+	}
+
+	var oldest *utpOutPacket
+	for _, p := range c.outbuf {
+		if !p.sacked && !p.needResend {
+			oldest = p
+			break
+		}
+	}
+
+	if oldest != nil && now.Sub(oldest.sentAt) > c.rto {
+		c.timeouts++
+
+		retries := utpMaxTimeouts
+		if c.state == utpStateSynSent {
+			retries = utpSynRetries
+		}
+
+		if c.timeouts > retries {
+			c.terminateLocked(ErrUTPTimeout)
+			return
+		}
+
+		// Everything in flight is considered lost and the window starts over
+		for _, p := range c.outbuf {
+			if !p.sacked {
+				p.needResend = true
+			}
+		}
+
+		c.inFlight = 0
+		c.maxWindow = utpMinWindow
+		c.rto = min(c.rto*2, utpMaxRto)
+	}
+
+	c.sendQueued()
+
+	if c.state == utpStateConnected && now.Sub(c.lastSent) > utpKeepAliveInterval {
+		c.sendStateLocked()
+	}
+}
+
+func (c *utpConn) terminate(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.terminateLocked(err)
+}
+
+func (c *utpConn) terminateLocked(err error) {
+	if c.state == utpStateClosed {
+		return
+	}
+
+	if c.state == utpStateSynSent {
+		close(c.connected)
+	}
+
+	c.state = utpStateClosed
+	c.err = err
+	c.cond.Broadcast()
+
+	go c.socket.remove(c)
+}
+
+func (c *utpConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.readBuf.Len() == 0 {
+		if c.eof {
+			return 0, io.EOF
+		}
+
+		if c.state == utpStateClosed || c.state == utpStateClosing {
+			return 0, c.closedErr()
+		}
+
+		if !c.readDeadline.IsZero() && time.Now().After(c.readDeadline) {
+			return 0, ErrUTPTimeout
+		}
+
+		c.cond.Wait()
+	}
+
+	windowWasFull := c.recvWindow() < utpPacketSize
+
+	n, _ := c.readBuf.Read(b)
+
+	// Tell the peer it can send again
+	if windowWasFull && c.recvWindow() >= utpPacketSize {
+		c.sendStateLocked()
+	}
+
+	return n, nil
+}
+
+func (c *utpConn) closedErr() error {
+	if c.err != nil && c.err != net.ErrClosed {
+		return c.err
+	}
+
+	return net.ErrClosed
+}
+
+func (c *utpConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+
+	for written < len(b) {
+		if c.state != utpStateConnected {
+			return written, c.closedErr()
+		}
+
+		if !c.writeDeadline.IsZero() && time.Now().After(c.writeDeadline) {
+			return written, ErrUTPTimeout
+		}
+
+		chunkSize := min(len(b)-written, utpPacketSize)
+
+		if c.inFlight > 0 && c.inFlight+utpHeaderSize+chunkSize > c.sendWindow() {
+			c.cond.Wait()
+			continue
+		}
+
+		p := &utpOutPacket{
+			header:  utpHeader{Type: utpTypeData, ConnectionId: c.sendId, SeqNr: c.seqNr},
+			payload: append([]byte{}, b[written:written+chunkSize]...),
+		}
+		c.seqNr++
+		c.outbuf = append(c.outbuf, p)
+		c.transmit(p)
+
+		written += chunkSize
+	}
+
+	return written, nil
+}
+
+// Close sends a FIN after the queued data, the connection lingers until the
+// peer acknowledged everything or gives up after utpCloseLinger
+func (c *utpConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state != utpStateConnected {
+		c.terminateLocked(net.ErrClosed)
+		return nil
+	}
+
+	fin := &utpOutPacket{header: utpHeader{Type: utpTypeFin, ConnectionId: c.sendId, SeqNr: c.seqNr}}
+	c.seqNr++
+	c.outbuf = append(c.outbuf, fin)
+	c.transmit(fin)
+
+	c.state = utpStateClosing
+	c.closeStarted = time.Now()
+	c.cond.Broadcast()
+
+	return nil
+}
+
+func (c *utpConn) LocalAddr() net.Addr {
+	return c.socket.conn.LocalAddr()
+}
+
+func (c *utpConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *utpConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+	c.writeDeadline = t
+
+	return nil
+}
+
+func (c *utpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readDeadline = t
+
+	return nil
+}
+
+func (c *utpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeDeadline = t
+
+	return nil
+}
+
+// isUtpConn tells whether conn runs over uTP, also when it is encrypted or
+// rate limited
+func isUtpConn(conn net.Conn) bool {
+	for {
+		if encrypted, ok := conn.(*mseConn); ok {
+			conn = encrypted.Conn
+		} else if limited, ok := conn.(*rateLimitedConn); ok {
+			conn = limited.Conn
+		} else {
+			break
+		}
+	}
+
+	_, ok := conn.(*utpConn)
+
+	return ok
+}
+
+var _ net.Conn = (*utpConn)(nil)
+var _ net.Listener = (*UTPSocket)(nil)
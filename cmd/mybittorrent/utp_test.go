@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyPacketConn drops a share of the packets written and delays the others
+// by a random amount up to twice delay, so they also arrive out of order
+type lossyPacketConn struct {
+	net.PacketConn
+	loss  float64
+	delay time.Duration
+
+	mu     sync.Mutex
+	random *mathrand.Rand
+}
+
+func (c *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop := c.random.Float64() < c.loss
+	delay := c.delay + time.Duration(c.random.Int63n(int64(c.delay)+1))
+	c.mu.Unlock()
+
+	if drop {
+		return len(b), nil
+	}
+
+	packet := append([]byte{}, b...)
+	time.AfterFunc(delay, func() {
+		c.PacketConn.WriteTo(packet, addr)
+	})
+
+	return len(b), nil
+}
+
+func newTestUTPSocket(t *testing.T, loss float64, delay time.Duration) *UTPSocket {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var packetConn net.PacketConn = conn
+	if loss > 0 || delay > 0 {
+		packetConn = &lossyPacketConn{
+			PacketConn: conn,
+			loss:       loss,
+			delay:      delay,
+			random:     mathrand.New(mathrand.NewSource(1)),
+		}
+	}
+
+	socket := NewUTPSocket(packetConn)
+	t.Cleanup(func() { socket.Close() })
+
+	return socket
+}
+
+// dialTestUTP connects two sockets, both sending through a path with the
+// given loss and delay
+func dialTestUTP(t *testing.T, loss float64, delay time.Duration) (net.Conn, net.Conn) {
+	server := newTestUTPSocket(t, loss, delay)
+	client := newTestUTPSocket(t, loss, delay)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+
+	clientConn, err := client.DialTimeout(server.Addr().String(), 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case serverConn := <-accepted:
+		return clientConn, serverConn
+	case <-time.After(10 * time.Second):
+		t.Fatal("connection not accepted")
+		return nil, nil
+	}
+}
+
+// transfer sends data from one end to the other and checks what arrives
+func transfer(from net.Conn, to net.Conn, data []byte) error {
+	errs := make(chan error, 1)
+
+	go func() {
+		_, err := from.Write(data)
+		errs <- err
+	}()
+
+	received := make([]byte, len(data))
+	to.SetReadDeadline(time.Now().Add(30 * time.Second))
+
+	n, err := io.ReadFull(to, received)
+	if err != nil {
+		return fmt.Errorf("read after %d bytes: %w", n, err)
+	}
+
+	if err := <-errs; err != nil {
+		return err
+	}
+
+	if !bytes.Equal(received, data) {
+		return fmt.Errorf("received data differs from the data sent")
+	}
+
+	return nil
+}
+
+func randomData(size int) []byte {
+	data := make([]byte, size)
+	rand.Read(data)
+
+	return data
+}
+
+func TestUTPTransfer(t *testing.T) {
+	client, server := dialTestUTP(t, 0, 0)
+
+	err := transfer(client, server, randomData(2*1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = transfer(server, client, randomData(64*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = server.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("read after the other end closed: %v, want EOF", err)
+	}
+}
+
+func TestUTPTransferWithLossAndDelay(t *testing.T) {
+	client, server := dialTestUTP(t, 0.05, 20*time.Millisecond)
+
+	upload := randomData(512 * 1024)
+	download := randomData(512 * 1024)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		if err := transfer(client, server, upload); err != nil {
+			t.Errorf("upload: %s", err)
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		if err := transfer(server, client, download); err != nil {
+			t.Errorf("download: %s", err)
+		}
+	}()
+
+	wg.Wait()
+}
+
+func TestUTPDecodeRejectsMalformedPackets(t *testing.T) {
+	header := utpHeader{Type: utpTypeData, ConnectionId: 7, SeqNr: 1, AckNr: 1, Sack: []byte{0xff, 0, 0, 0}}
+	packet := header.encode([]byte("payload"))
+
+	decoded, payload, err := decodeUtpPacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.ConnectionId != 7 || !bytes.Equal(decoded.Sack, header.Sack) || string(payload) != "payload" {
+		t.Fatalf("decoded %+v with payload %q", decoded, payload)
+	}
+
+	for _, malformed := range [][]byte{
+		packet[:utpHeaderSize-1],
+		// The SACK extension claims more bytes than the packet has
+		append(append([]byte{}, packet[:utpHeaderSize]...), 0, 40),
+	} {
+		_, _, err := decodeUtpPacket(malformed)
+		if err == nil {
+			t.Errorf("packet %x decoded", malformed)
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Longest message we accept, it fits a bitfield of two million pieces or a
+// 128 KiB block. Peers claiming more are dropped before anything is
+// allocated.
+const maxMessageLength = 256 * 1024
+
+var ErrInvalidMessage = errors.New("invalid message")
+
+// Message is a typed peer wire message
+type Message interface {
+	Encode() PeerMsg
+}
+
+type KeepAliveMessage struct{}
+type ChokeMessage struct{}
+type UnchokeMessage struct{}
+type InterestedMessage struct{}
+type NotInterestedMessage struct{}
+type HaveAllMessage struct{}
+type HaveNoneMessage struct{}
+
+type HaveMessage struct {
+	Index int
+}
+
+type BitfieldMessage struct {
+	Bitfield []byte
+}
+
+type RequestMessage struct {
+	BlockRequest
+}
+
+type CancelMessage struct {
+	BlockRequest
+}
+
+type RejectRequestMessage struct {
+	BlockRequest
+}
+
+type PieceMessage struct {
+	PieceBlock
+}
+
+// request is the request the block answers
+func (m PieceMessage) request() BlockRequest {
+	return BlockRequest{Index: m.Index, Begin: m.Begin, Length: len(m.Block)}
+}
+
+// PortMessage is the DHT port of the peer (BEP 5)
+type PortMessage struct {
+	Port uint16
+}
+
+type SuggestPieceMessage struct {
+	Index int
+}
+
+type AllowedFastMessage struct {
+	Index int
+}
+
+// ExtendedMessage is a BEP 10 message, Id 0 being the extended handshake
+type ExtendedMessage struct {
+	Id      byte
+	Payload []byte
+}
+
+// UnknownMessage has an id we don't know, such messages are ignored
+type UnknownMessage struct {
+	PeerMsg
+}
+
+func (KeepAliveMessage) Encode() PeerMsg     { return PeerMsg{MsgId: int(MsgIdKeepAlive)} }
+func (ChokeMessage) Encode() PeerMsg         { return PeerMsg{MsgId: int(MsgIdChoke)} }
+func (UnchokeMessage) Encode() PeerMsg       { return PeerMsg{MsgId: int(MsgIdUnchoke)} }
+func (InterestedMessage) Encode() PeerMsg    { return PeerMsg{MsgId: int(MsgIdInterested)} }
+func (NotInterestedMessage) Encode() PeerMsg { return PeerMsg{MsgId: int(MsgIdNotInterested)} }
+func (HaveAllMessage) Encode() PeerMsg       { return PeerMsg{MsgId: int(MsgIdHaveAll)} }
+func (HaveNoneMessage) Encode() PeerMsg      { return PeerMsg{MsgId: int(MsgIdHaveNone)} }
+
+func (m HaveMessage) Encode() PeerMsg {
+	return encodePieceIndex(MsgIdHave, m.Index)
+}
+
+func (m SuggestPieceMessage) Encode() PeerMsg {
+	return encodePieceIndex(MsgIdSuggestPiece, m.Index)
+}
+
+func (m AllowedFastMessage) Encode() PeerMsg {
+	return encodePieceIndex(MsgIdAllowedFast, m.Index)
+}
+
+func (m BitfieldMessage) Encode() PeerMsg {
+	return PeerMsg{MsgId: int(MsgIdBitfield), Payload: m.Bitfield}
+}
+
+func (m RequestMessage) Encode() PeerMsg {
+	return encodeBlockRequest(MsgIdRequest, m.BlockRequest)
+}
+
+func (m CancelMessage) Encode() PeerMsg {
+	return encodeBlockRequest(MsgIdCancel, m.BlockRequest)
+}
+
+func (m RejectRequestMessage) Encode() PeerMsg {
+	return encodeBlockRequest(MsgIdRejectRequest, m.BlockRequest)
+}
+
+func (m PieceMessage) Encode() PeerMsg {
+	payload := make([]byte, 8+len(m.Block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(m.Index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(m.Begin))
+	copy(payload[8:], m.Block)
+
+	return PeerMsg{MsgId: int(MsgIdPiece), Payload: payload}
+}
+
+func (m PortMessage) Encode() PeerMsg {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, m.Port)
+
+	return PeerMsg{MsgId: int(MsgIdPort), Payload: payload}
+}
+
+func (m ExtendedMessage) Encode() PeerMsg {
+	return PeerMsg{MsgId: int(MsgIdExtended), Payload: append([]byte{m.Id}, m.Payload...)}
+}
+
+func (m UnknownMessage) Encode() PeerMsg {
+	return m.PeerMsg
+}
+
+func encodePieceIndex(msgId peerMsgId, pieceIndex int) PeerMsg {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(pieceIndex))
+
+	return PeerMsg{MsgId: int(msgId), Payload: payload}
+}
+
+func encodeBlockRequest(msgId peerMsgId, req BlockRequest) PeerMsg {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(req.Index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(req.Begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(req.Length))
+
+	return PeerMsg{MsgId: int(msgId), Payload: payload}
+}
+
+// Payload length of the messages that have a fixed one
+var messagePayloadLengths = map[peerMsgId]int{
+	MsgIdKeepAlive:     0,
+	MsgIdChoke:         0,
+	MsgIdUnchoke:       0,
+	MsgIdInterested:    0,
+	MsgIdNotInterested: 0,
+	MsgIdHave:          4,
+	MsgIdRequest:       12,
+	MsgIdCancel:        12,
+	MsgIdPort:          2,
+	MsgIdSuggestPiece:  4,
+	MsgIdHaveAll:       0,
+	MsgIdHaveNone:      0,
+	MsgIdRejectRequest: 12,
+	MsgIdAllowedFast:   4,
+}
+
+// DecodeMessage decodes a raw message, payloads of the wrong length are an
+// error
+func DecodeMessage(msg PeerMsg) (Message, error) {
+	msgId := peerMsgId(msg.MsgId)
+	payload := msg.Payload
+
+	if length, ok := messagePayloadLengths[msgId]; ok && len(payload) != length {
+		return nil, fmt.Errorf("%w: payload of %d bytes for msg-id %d, expected %d", ErrInvalidMessage, len(payload), msg.MsgId, length)
+	}
+
+	switch msgId {
+	case MsgIdKeepAlive:
+		return KeepAliveMessage{}, nil
+	case MsgIdChoke:
+		return ChokeMessage{}, nil
+	case MsgIdUnchoke:
+		return UnchokeMessage{}, nil
+	case MsgIdInterested:
+		return InterestedMessage{}, nil
+	case MsgIdNotInterested:
+		return NotInterestedMessage{}, nil
+	case MsgIdHaveAll:
+		return HaveAllMessage{}, nil
+	case MsgIdHaveNone:
+		return HaveNoneMessage{}, nil
+
+	case MsgIdHave:
+		return HaveMessage{Index: decodeUint32(payload)}, nil
+	case MsgIdSuggestPiece:
+		return SuggestPieceMessage{Index: decodeUint32(payload)}, nil
+	case MsgIdAllowedFast:
+		return AllowedFastMessage{Index: decodeUint32(payload)}, nil
+
+	case MsgIdBitfield:
+		if len(payload) == 0 {
+			return nil, fmt.Errorf("%w: empty bitfield", ErrInvalidMessage)
+		}
+
+		return BitfieldMessage{Bitfield: payload}, nil
+
+	case MsgIdRequest:
+		return RequestMessage{decodeBlockRequest(payload)}, nil
+	case MsgIdCancel:
+		return CancelMessage{decodeBlockRequest(payload)}, nil
+	case MsgIdRejectRequest:
+		return RejectRequestMessage{decodeBlockRequest(payload)}, nil
+
+	case MsgIdPiece:
+		if len(payload) <= 8 {
+			return nil, fmt.Errorf("%w: piece block of %d bytes", ErrInvalidMessage, len(payload))
+		}
+
+		return PieceMessage{PieceBlock{
+			Index: decodeUint32(payload[0:4]),
+			Begin: decodeUint32(payload[4:8]),
+			Block: payload[8:],
+		}}, nil
+
+	case MsgIdPort:
+		return PortMessage{Port: binary.BigEndian.Uint16(payload)}, nil
+
+	case MsgIdExtended:
+		if len(payload) == 0 {
+			return nil, fmt.Errorf("%w: empty extended message", ErrInvalidMessage)
+		}
+
+		return ExtendedMessage{Id: payload[0], Payload: payload[1:]}, nil
+	}
+
+	return UnknownMessage{msg}, nil
+}
+
+func decodeUint32(b []byte) int {
+	return int(binary.BigEndian.Uint32(b))
+}
+
+func decodeBlockRequest(payload []byte) BlockRequest {
+	return BlockRequest{
+		Index:  decodeUint32(payload[0:4]),
+		Begin:  decodeUint32(payload[4:8]),
+		Length: decodeUint32(payload[8:12]),
+	}
+}
+
+// validateBitfield checks that a bitfield has one bit per piece, rounded up
+// to whole bytes, with the spare bits at the end cleared
+func validateBitfield(bitfield []byte, piecesCount int) error {
+	if len(bitfield) != (piecesCount+7)/8 {
+		return fmt.Errorf("%w: bitfield of %d bytes for %d pieces", ErrInvalidMessage, len(bitfield), piecesCount)
+	}
+
+	if spareBits := len(bitfield)*8 - piecesCount; spareBits > 0 {
+		if bitfield[len(bitfield)-1]&(1<<spareBits-1) != 0 {
+			return fmt.Errorf("%w: bitfield has spare bits set", ErrInvalidMessage)
+		}
+	}
+
+	return nil
+}
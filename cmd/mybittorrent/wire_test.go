@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	request := BlockRequest{Index: 1, Begin: 0x4000, Length: 0x4000}
+
+	tests := []struct {
+		name string
+		msg  Message
+		// The message on the wire, length prefix included
+		wire string
+	}{
+		{"keep-alive", KeepAliveMessage{}, "00000000"},
+		{"choke", ChokeMessage{}, "0000000100"},
+		{"unchoke", UnchokeMessage{}, "0000000101"},
+		{"interested", InterestedMessage{}, "0000000102"},
+		{"not interested", NotInterestedMessage{}, "0000000103"},
+		{"have", HaveMessage{Index: 0x0102}, "000000050400000102"},
+		{"bitfield", BitfieldMessage{Bitfield: []byte{0xff, 0x80}}, "0000000305ff80"},
+		{"request", RequestMessage{request}, "0000000d06000000010000400000004000"},
+		{"piece", PieceMessage{PieceBlock{Index: 2, Begin: 0x10, Block: []byte("abc")}}, "0000000c070000000200000010616263"},
+		{"cancel", CancelMessage{request}, "0000000d08000000010000400000004000"},
+		{"port", PortMessage{Port: 6881}, "00000003091ae1"},
+		{"suggest piece", SuggestPieceMessage{Index: 3}, "000000050d00000003"},
+		{"have all", HaveAllMessage{}, "000000010e"},
+		{"have none", HaveNoneMessage{}, "000000010f"},
+		{"reject request", RejectRequestMessage{request}, "0000000d10000000010000400000004000"},
+		{"allowed fast", AllowedFastMessage{Index: 4}, "000000051100000004"},
+		{"extended", ExtendedMessage{Id: 1, Payload: []byte("de")}, "0000000414016465"},
+		{"unknown", UnknownMessage{PeerMsg{MsgId: 42, Payload: []byte{7}}}, "000000022a07"},
+	}
+
+	for _, test := range tests {
+		var buff bytes.Buffer
+
+		err := writeMessage(&buff, test.msg.Encode())
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if wire := hex.EncodeToString(buff.Bytes()); wire != test.wire {
+			t.Errorf("%s: encoded as %s, want %s", test.name, wire, test.wire)
+		}
+
+		raw, err := readMessage(&buff)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		decoded, err := DecodeMessage(raw)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(decoded, test.msg) {
+			t.Errorf("%s: decoded as %#v, want %#v", test.name, decoded, test.msg)
+		}
+	}
+}
+
+func TestDecodeMessageRejectsBadPayloads(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  PeerMsg
+	}{
+		{"choke with payload", PeerMsg{MsgId: int(MsgIdChoke), Payload: []byte{0}}},
+		{"short have", PeerMsg{MsgId: int(MsgIdHave), Payload: []byte{0, 0, 1}}},
+		{"long have", PeerMsg{MsgId: int(MsgIdHave), Payload: make([]byte, 5)}},
+		{"empty bitfield", PeerMsg{MsgId: int(MsgIdBitfield)}},
+		{"short request", PeerMsg{MsgId: int(MsgIdRequest), Payload: make([]byte, 8)}},
+		{"piece without block", PeerMsg{MsgId: int(MsgIdPiece), Payload: make([]byte, 8)}},
+		{"short piece", PeerMsg{MsgId: int(MsgIdPiece), Payload: make([]byte, 3)}},
+		{"long cancel", PeerMsg{MsgId: int(MsgIdCancel), Payload: make([]byte, 13)}},
+		{"short port", PeerMsg{MsgId: int(MsgIdPort), Payload: []byte{0x1a}}},
+		{"suggest piece without index", PeerMsg{MsgId: int(MsgIdSuggestPiece)}},
+		{"have all with payload", PeerMsg{MsgId: int(MsgIdHaveAll), Payload: []byte{1}}},
+		{"have none with payload", PeerMsg{MsgId: int(MsgIdHaveNone), Payload: []byte{1}}},
+		{"short reject request", PeerMsg{MsgId: int(MsgIdRejectRequest), Payload: make([]byte, 4)}},
+		{"long allowed fast", PeerMsg{MsgId: int(MsgIdAllowedFast), Payload: make([]byte, 8)}},
+		{"empty extended", PeerMsg{MsgId: int(MsgIdExtended)}},
+	}
+
+	for _, test := range tests {
+		msg, err := DecodeMessage(test.msg)
+		if !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("%s: decoded as %#v, error %v", test.name, msg, err)
+		}
+	}
+}
+
+func TestReadMessageLimitsLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		length  uint32
+		wantErr bool
+	}{
+		{"largest", maxMessageLength, false},
+		{"too long", maxMessageLength + 1, true},
+		{"way too long", 0xffffffff, true},
+	}
+
+	for _, test := range tests {
+		wire := binary.BigEndian.AppendUint32(nil, test.length)
+		if !test.wantErr {
+			wire = append(wire, make([]byte, test.length)...)
+		}
+
+		_, err := readMessage(bytes.NewReader(wire))
+
+		switch {
+		case test.wantErr && !errors.Is(err, ErrInvalidMessage):
+			t.Errorf("%s: got error %v, want an invalid message", test.name, err)
+		case !test.wantErr && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		}
+	}
+
+	// A message cut short is an error, not a short payload
+	_, err := readMessage(bytes.NewReader([]byte{0, 0, 0, 5, 4, 0, 0}))
+	if err == nil {
+		t.Error("truncated message accepted")
+	}
+}
+
+func TestValidateBitfield(t *testing.T) {
+	tests := []struct {
+		name        string
+		bitfield    []byte
+		piecesCount int
+		valid       bool
+	}{
+		{"whole bytes", []byte{0xff, 0xff}, 16, true},
+		{"spare bits cleared", []byte{0xff, 0xe0}, 11, true},
+		{"spare bit set", []byte{0xff, 0xf0}, 11, false},
+		{"last spare bit set", []byte{0x81}, 7, false},
+		{"too short", []byte{0xff}, 9, false},
+		{"too long", []byte{0xff, 0x00}, 8, false},
+		{"empty", []byte{}, 1, false},
+	}
+
+	for _, test := range tests {
+		err := validateBitfield(test.bitfield, test.piecesCount)
+
+		switch {
+		case test.valid && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case !test.valid && !errors.Is(err, ErrInvalidMessage):
+			t.Errorf("%s: got error %v, want an invalid message", test.name, err)
+		}
+	}
+}